@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"greenlight.nicolasleigh.net/internal/data"
+	"greenlight.nicolasleigh.net/internal/mailer"
+	"greenlight.nicolasleigh.net/internal/validator"
+)
+
+// Define the sample data used when previewing each of the email templates. The keys
+// of the inner maps mirror the dynamic data that the real handlers pass to Send().
+// Templates which don't have an entry here are rendered with no dynamic data.
+var emailPreviewData = map[string]map[string]any{
+	"user_welcome.tmpl": {
+		"activationToken": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+		"userID":          123,
+	},
+	"user_activated.tmpl": {
+		"name":   "Alice Smith",
+		"userID": 123,
+	},
+}
+
+// The emailPreviewHandler renders one of the embedded email templates using sample
+// data and returns the result. It never sends an email. By default the HTML body is
+// returned, but the plain-text body can be requested with ?format=plain.
+func (app *application) emailPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Template string
+		Format   string
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Template = app.readString(qs, "template", "")
+	input.Format = app.readString(qs, "format", "html")
+
+	v.Check(input.Template != "", "template", "must be provided")
+	v.Check(validator.PermittedValue(input.Format, "html", "plain"), "format", "invalid format value")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	email, err := app.mailer.Render(input.Template, emailPreviewData[input.Template])
+	if err != nil {
+		switch {
+		case errors.Is(err, mailer.ErrTemplateNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Include the rendered subject line in a response header, so that it can be
+	// previewed alongside the body.
+	w.Header().Set("X-Email-Subject", email.Subject)
+
+	switch input.Format {
+	case "plain":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(email.PlainBody))
+	default:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(email.HTMLBody))
+	}
+}
+
+// The analyzeHandler runs ANALYZE to refresh the query planner statistics, which is
+// useful after a bulk import. If ?reindex=true is given, then the movie indexes are
+// rebuilt first. As rebuilding the indexes locks the movies table, this is refused
+// in production unless ?force=true is also given.
+func (app *application) analyzeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Reindex bool
+		Force   bool
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Reindex = app.readBool(qs, "reindex", false, v)
+	input.Force = app.readBool(qs, "force", false, v)
+
+	if input.Reindex && app.config.env == "production" {
+		v.Check(input.Force, "force", "must be true to reindex in production, as reindexing locks the movies table")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The operation can take much longer than the server's write timeout, so extend
+	// the write deadline for this response to cover the maintenance timeout.
+	err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(data.MaintenanceTimeout + 10*time.Second))
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	app.logger.Info("starting database maintenance", "reindex", input.Reindex, "user_id", user.ID)
+
+	start := time.Now()
+
+	err = app.requestModels(r).Maintenance.Analyze(input.Reindex)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	duration := time.Since(start)
+
+	app.logger.Info("completed database maintenance", "reindex", input.Reindex, "user_id", user.ID, "duration", duration.String())
+
+	maintenance := envelope{
+		"analyzed":  true,
+		"reindexed": input.Reindex,
+		"duration":  duration.String(),
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"maintenance": maintenance}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The dbStatsHandler returns the current statistics for the database connection pool,
+// along with the configured pool limits to compare them against. A high wait count
+// or wait duration, with the in use connections at the max_open_connections limit,
+// means that requests are queueing for a connection.
+func (app *application) dbStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := app.models.Maintenance.PoolStats()
+
+	dbStats := envelope{
+		"open_connections":     stats.OpenConnections,
+		"in_use":               stats.InUse,
+		"idle":                 stats.Idle,
+		"wait_count":           stats.WaitCount,
+		"wait_duration":        stats.WaitDuration.String(),
+		"max_idle_closed":      stats.MaxIdleClosed,
+		"max_idle_time_closed": stats.MaxIdleTimeClosed,
+		"max_lifetime_closed":  stats.MaxLifetimeClosed,
+		"limits": envelope{
+			"max_open_connections": app.config.db.maxOpenConns,
+			"max_idle_connections": app.config.db.maxIdleConns,
+			"max_idle_time":        app.config.db.maxIdleTime.String(),
+		},
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"db_stats": dbStats}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The explainMoviesHandler runs the movie list query for the same filters as GET
+// /v1/movies with EXPLAIN ANALYZE, and returns the query plan rather than the movies,
+// for diagnosing slow list queries. As EXPLAIN ANALYZE executes the query, this is
+// refused in production unless ?force=true is also given.
+func (app *application) explainMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	filters := app.readMovieListFilters(qs, v)
+
+	force := app.readBool(qs, "force", false, v)
+
+	if app.config.env == "production" {
+		v.Check(force, "force", "must be true to explain in production, as EXPLAIN ANALYZE executes the query")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	plan, err := app.requestModels(r).Movies.ExplainGetAll(filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"plan": plan}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listRoutesHandler returns all of the registered routes, along with the
+// authentication, activation and permission checks for each one. The routes are
+// sorted by path and then by method, so that the output is deterministic.
+func (app *application) listRoutesHandler(w http.ResponseWriter, r *http.Request) {
+	routes := slices.Clone(app.routeRegistry)
+
+	slices.SortFunc(routes, func(a, b routeInfo) int {
+		if c := strings.Compare(a.Path, b.Path); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Method, b.Method)
+	})
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"routes": routes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Define a cachedValue type which holds a single value for a short time. It's used
+// for expensive results, like dashboard statistics, which don't need to be completely
+// up to date. The zero value is an empty cache which is ready to use.
+type cachedValue[T any] struct {
+	mu      sync.Mutex
+	value   T
+	expires time.Time
+}
+
+// The get() method returns the cached value if it hasn't expired. Otherwise it calls
+// fn to produce a new value, and caches it for the given ttl. Errors are never
+// cached. The mutex is held while fn runs, so concurrent requests for an expired
+// value wait for a single call to fn rather than all hitting the database at once.
+func (c *cachedValue[T]) get(ttl time.Duration, fn func() (T, error)) (T, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Now().Before(c.expires) {
+		return c.value, nil
+	}
+
+	value, err := fn()
+	if err != nil {
+		return value, err
+	}
+
+	c.value = value
+	c.expires = time.Now().Add(ttl)
+
+	return value, nil
+}
@@ -15,6 +15,17 @@ type contextKey string
 // information in the request context.
 const userContextKey = contextKey("user")
 
+// The apiKeyContextKey constant is used as the key for the API key which was used to
+// authenticate the request (if any).
+const apiKeyContextKey = contextKey("api_key")
+
+// The apiVersionContextKey constant is used as the key for the API version of the
+// request, like "v1".
+const apiVersionContextKey = contextKey("api_version")
+
+// The requestIDContextKey constant is used as the key for the ID of the request.
+const requestIDContextKey = contextKey("request_id")
+
 // The contextSetUser() method returns a new copy of the request with the provided
 // User struct added to the context. Note that we use our userContextKey constant as
 // the key.
@@ -35,3 +46,52 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 
 	return user
 }
+
+// The contextSetAPIKey() method returns a new copy of the request with the provided
+// APIKey struct added to the context.
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// The contextGetAPIKey() retrieves the APIKey struct from the request context. Unlike
+// the user, it's perfectly normal for there to be no API key in the context (because
+// the request was anonymous or used a bearer token instead), so we return nil rather
+// than panicking in that case.
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, ok := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	if !ok {
+		return nil
+	}
+
+	return key
+}
+
+// The contextSetAPIVersion() method returns a new copy of the request with the API
+// version added to the context.
+func (app *application) contextSetAPIVersion(r *http.Request, version string) *http.Request {
+	ctx := context.WithValue(r.Context(), apiVersionContextKey, version)
+	return r.WithContext(ctx)
+}
+
+// The contextGetAPIVersion() method retrieves the API version from the request
+// context. It returns the empty string for requests which aren't for a versioned
+// endpoint, like GET /debug/vars.
+func (app *application) contextGetAPIVersion(r *http.Request) string {
+	version, _ := r.Context().Value(apiVersionContextKey).(string)
+	return version
+}
+
+// The contextSetRequestID() method returns a new copy of the request with the request
+// ID added to the context.
+func (app *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// The contextGetRequestID() method retrieves the request ID from the request context,
+// returning the empty string if there isn't one.
+func (app *application) contextGetRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
@@ -1,26 +1,44 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"mime"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"greenlight.nicolasleigh.net/internal/data"
 )
 
 // The logError() method is a generic helper for logging an error message along
 // with the current request method and URL as attributes in the log entry.
 func (app *application) logError(r *http.Request, err error) {
 	var (
-		method = r.Method
-		uri    = r.URL.RequestURI()
+		method    = r.Method
+		uri       = redactURI(r)
+		requestID = app.contextGetRequestID(r)
 	)
 
-	app.logger.Error(err.Error(), "method", method, "uri", uri)
+	app.logger.Error(err.Error(), "method", method, "uri", uri, "request_id", requestID)
 }
 
 // The errorResponse() method is a generic helper for sending JSON-formatted error
 // messages to the client with a given status code. Note that we're using the any
 // type for the message parameter, rather than just a string type, as this gives us
 // more flexibility over the values that we can include in the response.
+//
+// If the -error-format flag is set to "problem", then the error is sent as an RFC 7807
+// Problem Details object instead. All of the other error helpers go through this
+// method, so they all use the chosen format.
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message any) {
+	if app.config.errorFormat == "problem" {
+		app.problemResponse(w, r, status, message)
+		return
+	}
+
 	env := envelope{"error": message}
 	// Write the response using the writeJSON() helper. If this happens to return an
 	// error then log it, and fall back to sending the client an empty response with a
@@ -32,16 +50,96 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, st
 	}
 }
 
+// The problemResponse() method sends an error as an RFC 7807 Problem Details object,
+// with the application/problem+json content type. We don't have documentation pages
+// for our errors, so the type is always "about:blank" and the title is the standard
+// text for the status code. If the message is a string then it's used as the detail.
+// Otherwise the message holds more information about the error, like the validation
+// errors, and is included as an extension member. The instance is the request path,
+// and the request ID is included as an extension member so that the problem can be
+// matched up with the logs.
+func (app *application) problemResponse(w http.ResponseWriter, r *http.Request, status int, message any) {
+	problem := envelope{
+		"type":     "about:blank",
+		"title":    http.StatusText(status),
+		"status":   status,
+		"instance": r.URL.Path,
+	}
+
+	if requestID := app.contextGetRequestID(r); requestID != "" {
+		problem["request_id"] = requestID
+	}
+
+	switch message := message.(type) {
+	case string:
+		problem["detail"] = message
+	case envelope:
+		// Errors which are sent as an envelope, like those for a specific item in a
+		// batch, already have named fields, so we add them to the problem directly.
+		for key, value := range message {
+			if key == "message" {
+				problem["detail"] = value
+				continue
+			}
+			problem[key] = value
+		}
+	default:
+		problem["errors"] = message
+	}
+
+	if _, ok := problem["detail"]; !ok && status == http.StatusUnprocessableEntity {
+		problem["detail"] = "the request contains invalid values"
+	}
+
+	headers := make(http.Header)
+	headers.Set("Content-Type", "application/problem+json")
+
+	err := app.writeJSON(w, status, problem, headers)
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(500)
+	}
+}
+
 // The serverErrorResponse() method will be used when our application encounters an
 // unexpected problem at runtime. It logs the detailed error message, then uses the
 // errorResponse() helper to send a 500 Internal Server Error status code and JSON
 // response (containing a generic error message) to the client.
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	// Queries which ran out of time aren't a problem with the server as such, so they
+	// get their own response. Checking for them here means that every handler which
+	// passes on a model error handles them in the same way.
+	if errors.Is(err, data.ErrTimeout) {
+		app.timeoutResponse(w, r, err)
+		return
+	}
+
 	app.logError(r, err)
 	message := "the server encountered a problem and could not process your request"
 	app.errorResponse(w, r, http.StatusInternalServerError, message)
 }
 
+// The number of seconds which clients are asked to wait before retrying a request
+// which timed out.
+const timeoutRetryAfter = 5
+
+// The timeoutResponse() method is used when a query fails with data.ErrTimeout. We
+// send a 503 Service Unavailable response with a Retry-After header, as the same
+// request may well succeed later. If the request's context was cancelled, then the
+// client has gone away and won't see the response, so it's only logged at the INFO
+// level. The response is still sent, so that the access log has the right status.
+func (app *application) timeoutResponse(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, context.Canceled) {
+		app.logger.Info("request cancelled by client", "method", r.Method, "uri", redactURI(r), "request_id", app.contextGetRequestID(r))
+	} else {
+		app.logger.Warn(err.Error(), "method", r.Method, "uri", redactURI(r), "request_id", app.contextGetRequestID(r))
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(timeoutRetryAfter))
+	message := "the request took too long to process, please try again later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
 // The notFoundResponse() method will be used to send a 404 Not Found status code and
 // JSON response to the client.
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
@@ -62,15 +160,101 @@ func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Reques
 
 // Note that the errors parameter here has the type map[string]string, which is exactly
 // the same as the errors map contained in our Validator type.
+//
+// By default the errors are sent as a map of field names to messages. If the client
+// asks for a list via the Accept header (like "application/json; errors=list"), or the
+// -validation-errors flag is set to "list", then they are sent as an array instead.
 func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
+	if app.validationErrorFormat(r) == "list" {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, validationErrorList(errors))
+		return
+	}
+
 	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
 }
 
+// Define a validationError struct to hold a single entry in the list format of the
+// validation errors.
+type validationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+	Code    string `json:"code"`
+}
+
+// The validationErrorList() helper converts a map of validation errors into a slice,
+// sorted alphabetically by field so that the ordering is stable. Missing values get
+// the code "required", and everything else gets the code "invalid".
+func validationErrorList(errors map[string]string) []validationError {
+	list := make([]validationError, 0, len(errors))
+
+	for field, message := range errors {
+		code := "invalid"
+		if message == "must be provided" {
+			code = "required"
+		}
+
+		list = append(list, validationError{Field: field, Message: message, Code: code})
+	}
+
+	slices.SortFunc(list, func(a, b validationError) int {
+		return strings.Compare(a.Field, b.Field)
+	})
+
+	return list
+}
+
+// The validationErrorFormat() method returns the format to use for validation errors.
+// An errors parameter on any of the media ranges in the Accept header takes priority
+// over the configured default.
+func (app *application) validationErrorFormat(r *http.Request) string {
+	for _, header := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(header, ",") {
+			_, params, err := mime.ParseMediaType(mediaRange)
+			if err != nil {
+				continue
+			}
+
+			switch params["errors"] {
+			case "list", "map":
+				return params["errors"]
+			}
+		}
+	}
+
+	return app.config.validationErrors
+}
+
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
 	message := "unable to update the record due to an edit conflict, please try again"
 	app.errorResponse(w, r, http.StatusConflict, message)
 }
 
+// The conflictResponse() method sends a 409 Conflict status code and JSON response
+// with the given message. It's used when a request conflicts with the current state
+// of an existing resource.
+func (app *application) conflictResponse(w http.ResponseWriter, r *http.Request, message string) {
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+// The message for a movie title which is already taken, when -unique-titles is set.
+const duplicateTitleMessage = "a movie with this title already exists"
+
+// The duplicateTitleResponse() method sends a 409 Conflict response when a movie is
+// saved with a title which another movie already has. It's a conflict with the other
+// movie rather than a problem with the request itself, so it isn't sent as a
+// validation error.
+func (app *application) duplicateTitleResponse(w http.ResponseWriter, r *http.Request) {
+	app.conflictResponse(w, r, duplicateTitleMessage)
+}
+
+func (app *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request, message string) {
+	app.errorResponse(w, r, http.StatusUnsupportedMediaType, message)
+}
+
+func (app *application) serviceUnavailableResponse(w http.ResponseWriter, r *http.Request, message string) {
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	message := "rate limit exceeded"
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
@@ -88,6 +272,16 @@ func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
+func (app *application) invalidAPIKeyResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid or revoked API key"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *application) invalidSignatureResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid, missing or expired request signature"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	message := "you must be authenticated to access this resource"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The types of the movie events which are sent to the GET /v1/movies/events clients.
+const (
+	movieCreatedEvent   = "movie.created"
+	movieUpdatedEvent   = "movie.updated"
+	movieDeletedEvent   = "movie.deleted"
+	moviesImportedEvent = "movies.imported"
+)
+
+// The interval between the heartbeat comments sent to the event stream clients, which
+// stop proxies and load balancers from closing idle connections, and the number of
+// events which can be buffered for each client before it's treated as too slow.
+const (
+	sseHeartbeatInterval = 15 * time.Second
+	sseClientBuffer      = 16
+)
+
+var (
+	errTooManySubscribers = errors.New("too many event stream subscribers")
+	errBrokerClosed       = errors.New("event broker is closed")
+)
+
+// Define a movieEvent struct to hold a change to the movies. The ID increases with
+// each event, and is sent as the SSE event ID.
+type movieEvent struct {
+	ID   int64
+	Type string
+	Data envelope
+}
+
+// Define an eventBroker type which is an in-process publish/subscribe hub for movie
+// events. Each subscriber gets its own buffered channel. A subscriber which falls too
+// far behind is disconnected, rather than blocking the handler which publishes the
+// event.
+type eventBroker struct {
+	mu             sync.Mutex
+	subscribers    map[chan movieEvent]struct{}
+	maxSubscribers int
+	nextID         int64
+	closed         bool
+}
+
+// The newEventBroker() function returns a new eventBroker which allows up to
+// maxSubscribers subscribers at once.
+func newEventBroker(maxSubscribers int) *eventBroker {
+	return &eventBroker{
+		subscribers:    make(map[chan movieEvent]struct{}),
+		maxSubscribers: maxSubscribers,
+	}
+}
+
+// The subscribe() method returns a new channel which receives the published events.
+// The channel is closed if the subscriber is too slow, or when the broker is closed.
+func (b *eventBroker) subscribe() (chan movieEvent, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case b.closed:
+		return nil, errBrokerClosed
+	case len(b.subscribers) >= b.maxSubscribers:
+		return nil, errTooManySubscribers
+	}
+
+	ch := make(chan movieEvent, sseClientBuffer)
+	b.subscribers[ch] = struct{}{}
+
+	return ch, nil
+}
+
+// The unsubscribe() method removes a subscriber and closes its channel. It's safe to
+// call for a subscriber which has already been removed.
+func (b *eventBroker) unsubscribe(ch chan movieEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// The publish() method sends an event to all of the current subscribers. It never
+// blocks.
+func (b *eventBroker) publish(eventType string, data envelope) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	b.nextID++
+	event := movieEvent{ID: b.nextID, Type: eventType, Data: data}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// The subscriber's buffer is full, so disconnect it. The client can
+			// reconnect and fetch the current state of the movies.
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// The close() method disconnects all of the subscribers and stops any more from
+// subscribing. It's called when the server starts shutting down, so that the open
+// event streams don't hold up the graceful shutdown.
+func (b *eventBroker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+
+	for ch := range b.subscribers {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// The movieEventsHandler streams the movie events to the client as server-sent
+// events, until the client disconnects or the server shuts down. A heartbeat comment
+// is sent every sseHeartbeatInterval to keep the connection open.
+func (app *application) movieEventsHandler(w http.ResponseWriter, r *http.Request) {
+	events, err := app.movieEvents.subscribe()
+	if err != nil {
+		switch {
+		case errors.Is(err, errTooManySubscribers), errors.Is(err, errBrokerClosed):
+			w.Header().Set("Retry-After", "30")
+			app.serviceUnavailableResponse(w, r, "the event stream is not available at the moment, please try again later")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer app.movieEvents.unsubscribe(events)
+
+	// Remove the write deadline, which would otherwise end the stream once the
+	// server's WriteTimeout has passed.
+	rc := http.NewResponseController(w)
+
+	err = rc.SetWriteDeadline(time.Time{})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	err = rc.Flush()
+	if err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			// The client has disconnected.
+			return
+
+		case event, ok := <-events:
+			if !ok {
+				// The client was too slow, or the server is shutting down.
+				return
+			}
+
+			js, err := app.encodeEventData(event.Data)
+			if err != nil {
+				app.logError(r, err)
+				return
+			}
+
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, js)
+			if err != nil {
+				return
+			}
+
+		case <-heartbeat.C:
+			_, err := io.WriteString(w, ": heartbeat\n\n")
+			if err != nil {
+				return
+			}
+		}
+
+		err = rc.Flush()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// The encodeEventData() helper encodes the data for an event in the same way as
+// writeJSON(), except that the JSON is compact, as it has to fit on a single line of
+// the event stream.
+func (app *application) encodeEventData(data envelope) ([]byte, error) {
+	data, err := app.renameKeys(data)
+	if err != nil {
+		return nil, err
+	}
+
+	js, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// The same data is sent to every client, so the timestamps are always in UTC.
+	js, err = rewriteJSON(js, jsonRewrite{stringIDs: app.config.jsonStringIDs, location: time.UTC})
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+
+	err = json.Compact(&buf, js)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
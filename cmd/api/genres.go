@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"greenlight.nicolasleigh.net/internal/data"
+	"greenlight.nicolasleigh.net/internal/validator"
+)
+
+// The validateGenresHandler checks a list of genres against the canonical set (and
+// its synonyms), so that clients can validate a form before submitting a movie.
+// Nothing is created. Unknown genres aren't an error, they're just reported back in
+// the invalid list, and the valid genres are returned in their canonical form.
+func (app *application) validateGenresHandler(w http.ResponseWriter, r *http.Request) {
+	var input []string
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input != nil, "genres", "must be provided")
+	v.Check(len(input) <= 100, "genres", "must not contain more than 100 values")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	valid := []string{}
+	invalid := []string{}
+
+	for _, genre := range input {
+		if canonical, ok := data.CanonicalGenre(genre); ok {
+			valid = append(valid, canonical)
+		} else {
+			invalid = append(invalid, genre)
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"valid": valid, "invalid": invalid}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listGenresHandler returns the genres which are in use, along with the number of
+// movies in each, one page at a time.
+func (app *application) listGenresHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	input.Filters.Sort = app.readString(qs, "sort", "name")
+	input.Filters.SortSafelist = []string{"name", "count", "-name", "-count"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	genres, metadata, err := app.requestModels(r).Movies.ListGenres(input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"genres": genres, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The genreSynonymsHandler returns the canonical genres along with the synonyms that
+// are accepted for them when movies are created or updated, so that clients can
+// align their own genre lists.
+func (app *application) genreSynonymsHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"genres": data.Genres, "synonyms": data.GenreSynonyms()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The patchMovieGenresHandler adds and removes genres from a movie, using the "add"
+// and "remove" arrays in the request body. Unlike updateMovieHandler, it doesn't
+// replace the whole genres array, so two clients can change different genres at
+// the same time without one undoing the other.
+func (app *application) patchMovieGenresHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Add    []string `json:"add"`
+		Remove []string `json:"remove"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(len(input.Add)+len(input.Remove) >= 1, "genres", "must add or remove at least 1 genre")
+	v.Check(len(input.Add) <= 5, "add", "must not contain more than 5 genres")
+	v.Check(len(input.Remove) <= 5, "remove", "must not contain more than 5 genres")
+
+	// The added genres must be canonical, like the genres in updateMovieHandler, and
+	// synonyms are replaced with the canonical genre. The removed genres are
+	// canonicalized too when possible, but unrecognized ones are still removed, so
+	// that genres which predate the canonical set can be cleaned up.
+	for i, genre := range input.Add {
+		canonical, ok := data.CanonicalGenre(genre)
+		if !ok {
+			v.AddError("add", fmt.Sprintf("unsupported genre %q", genre))
+			continue
+		}
+		input.Add[i] = canonical
+	}
+	for i, genre := range input.Remove {
+		if canonical, ok := data.CanonicalGenre(genre); ok {
+			input.Remove[i] = canonical
+		}
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movie, err := app.requestModels(r).Movies.PatchGenres(id, input.Add, input.Remove)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrGenreCount):
+			v.AddError("genres", "must leave the movie with between 1 and 5 genres")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.movieEvents.publish(movieUpdatedEvent, envelope{"movie": movie})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
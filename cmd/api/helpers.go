@@ -1,22 +1,35 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/netip"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"greenlight.nicolasleigh.net/internal/data"
 	"greenlight.nicolasleigh.net/internal/validator"
 )
 
 // Define an envelope type.
 type envelope map[string]any
 
+// The requestModels() helper returns the models with the request context as the parent
+// context for their queries, so that the deadline set by the requestTimeout()
+// middleware applies to them. Use app.models directly for work which outlives the
+// request, like background tasks and shared caches.
+func (app *application) requestModels(r *http.Request) data.Models {
+	return app.models.WithContext(r.Context())
+}
+
 // Retrieve the "id" URL parameter from the current request context, then convert it to
 // an integer and return it. If the operation isn't successful, return 0 and an error.
 func (app *application) readIDParam(r *http.Request) (int64, error) {
@@ -30,6 +43,129 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 	return id, nil
 }
 
+// The parseEnvelopeKeys() helper parses space separated from=to pairs into a map of
+// envelope key renames. It returns an error if a pair is malformed, or if the same
+// key is renamed more than once.
+func parseEnvelopeKeys(val string) (map[string]string, error) {
+	keys := make(map[string]string)
+
+	for _, pair := range strings.Fields(val) {
+		from, to, found := strings.Cut(pair, "=")
+		if !found || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid envelope key pair %q: must be in the form from=to", pair)
+		}
+
+		if _, exists := keys[from]; exists {
+			return nil, fmt.Errorf("envelope key %q is renamed more than once", from)
+		}
+
+		keys[from] = to
+	}
+
+	return keys, nil
+}
+
+// The parsePrefixes() helper parses space separated CIDR ranges into a slice of
+// netip.Prefix values. A single IP address is treated as a range containing only
+// that address.
+func parsePrefixes(val string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+
+	for _, field := range strings.Fields(val) {
+		if !strings.Contains(field, "/") {
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid IP address %q", field)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q", field)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// The parseAcceptLanguage() helper returns the language tags from an Accept-Language
+// header value, in order of preference. Tags with a quality value of 0 and the "*"
+// wildcard are left out, as they don't name a language that we can look for.
+func parseAcceptLanguage(header string) []string {
+	type weightedTag struct {
+		tag     string
+		quality float64
+	}
+
+	var tags []weightedTag
+
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.TrimSpace(tag)
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		quality := 1.0
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			parsed, err := strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+
+		if quality <= 0 {
+			continue
+		}
+
+		tags = append(tags, weightedTag{tag: strings.ToLower(tag), quality: quality})
+	}
+
+	// Use a stable sort, so that tags with the same quality keep the order that the
+	// client sent them in.
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].quality > tags[j].quality
+	})
+
+	langs := make([]string, len(tags))
+	for i, t := range tags {
+		langs[i] = t.tag
+	}
+
+	return langs
+}
+
+// The renameKeys() method returns a copy of the envelope with its keys renamed
+// according to the -envelope-keys configuration. This means that the handlers can
+// continue to use the default key names, and the renaming happens in one place. If
+// two keys in the same envelope end up with the same name, we return an error rather
+// than silently dropping one of the values.
+func (app *application) renameKeys(data envelope) (envelope, error) {
+	if len(app.config.envelopeKeys) == 0 {
+		return data, nil
+	}
+
+	renamed := make(envelope, len(data))
+
+	for key, value := range data {
+		if newKey, ok := app.config.envelopeKeys[key]; ok {
+			key = newKey
+		}
+
+		if _, exists := renamed[key]; exists {
+			return nil, fmt.Errorf("envelope key %q is used more than once", key)
+		}
+
+		renamed[key] = value
+	}
+
+	return renamed, nil
+}
+
 // Define a writeJSON() helper for sending responses. This takes the destination
 // http.ResponseWriter, the HTTP status code to send, the data to encode to JSON, and a
 // header map containing any additional HTTP headers we want to include in the response.
@@ -41,11 +177,30 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data envelo
 
 	// Use the json.MarshalIndent() function so that whitespace is added to the encoded
 	// JSON. Here we use no line prefix ("") and tab indents ("\t") for each element.
+	//
+	// Before encoding, rename any of the envelope keys which have been customized.
+	data, err := app.renameKeys(data)
+	if err != nil {
+		return err
+	}
+
 	js, err := json.MarshalIndent(data, "", "\t")
 	if err != nil {
 		return err
 	}
 
+	// If the -json-string-ids flag is set, rewrite the ID fields as strings, and if
+	// the client asked for a time zone with the tz query string parameter, convert
+	// the timestamps to it. Rewriting means decoding the whole document again, so
+	// it's skipped when there's nothing to change.
+	location := responseLocation(w)
+	if app.config.jsonStringIDs || location != nil {
+		js, err = rewriteJSON(js, jsonRewrite{stringIDs: app.config.jsonStringIDs, location: location})
+		if err != nil {
+			return err
+		}
+	}
+
 	// Append a newline to make it easier to view in terminal applications.
 	js = append(js, '\n')
 
@@ -54,13 +209,17 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data envelo
 	// through the header map and add each header to the http.ResponseWriter header map.
 	// Note that it's OK if the provided header map is nil. Go doesn't throw an error
 	// if you try to range over (or generally, read from) a nil map.
+	//
+	// We set the "Content-Type: application/json" header first, so that it can be
+	// overridden by the provided headers (like for application/problem+json).
+	w.Header().Set("Content-Type", "application/json")
+
 	for key, value := range headers {
 		w.Header()[key] = value
 	}
 
-	// Add the "Content-Type: application/json" header, then write the status code and
-	// JSON response.
-	w.Header().Set("Content-Type", "application/json")
+	// Write the status code and JSON response.
+	// w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	w.Write(js)
 
@@ -130,11 +289,36 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any
 	maxBytes := 1_048_576
 	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
 
+	// If either of the JSON nesting limits are enabled, read the whole body (which is
+	// at most 1MB) and scan through its tokens to check the limits before decoding it.
+	// This means that a deeply nested or huge payload is rejected without ever being
+	// decoded into the destination.
+	var body io.Reader = r.Body
+
+	if app.config.json.maxDepth > 0 || app.config.json.maxArrayLength > 0 {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
+			}
+			return err
+		}
+
+		err = checkJSONLimits(b, app.config.json.maxDepth, app.config.json.maxArrayLength)
+		if err != nil {
+			return err
+		}
+
+		body = bytes.NewReader(b)
+	}
+
 	// Initialize the json.Decoder, and call the DisallowUnknownFields() method on it
 	// before decoding. This means that if the JSON from the client now includes any
 	// field which cannot be mapped to the target destination, the decoder will return
 	// an error instead of just ignoring the field.
-	dec := json.NewDecoder(r.Body)
+	// dec := json.NewDecoder(r.Body)
+	dec := json.NewDecoder(body)
 	dec.DisallowUnknownFields()
 
 	// Decode the request body to the destination.
@@ -198,6 +382,221 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any
 	return nil
 }
 
+// The checkJSONLimits() helper scans through the tokens in a JSON document, and
+// returns an error if objects and arrays are nested more than maxDepth levels deep,
+// or if any array contains more than maxArrayLength elements. A limit of 0 means that
+// it isn't checked. If the JSON is badly-formed then the scan just stops, and the
+// error is left for the decoder to report in the usual way.
+func checkJSONLimits(js []byte, maxDepth, maxArrayLength int) error {
+	dec := json.NewDecoder(bytes.NewReader(js))
+
+	// The stack holds the number of elements seen so far in each open array, or -1
+	// for open objects.
+	var stack []int
+
+	for {
+		token, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+
+		delim, isDelim := token.(json.Delim)
+
+		// Count the value as an element of the enclosing array, if there is one.
+		// Closing delimiters aren't values, so they're skipped.
+		if !isDelim || delim == '[' || delim == '{' {
+			if len(stack) > 0 && stack[len(stack)-1] >= 0 {
+				stack[len(stack)-1]++
+				if maxArrayLength > 0 && stack[len(stack)-1] > maxArrayLength {
+					return fmt.Errorf("body must not contain arrays with more than %d elements", maxArrayLength)
+				}
+			}
+		}
+
+		if !isDelim {
+			continue
+		}
+
+		switch delim {
+		case '[':
+			stack = append(stack, 0)
+		case '{':
+			stack = append(stack, -1)
+		default:
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		if maxDepth > 0 && len(stack) > maxDepth {
+			return fmt.Errorf("body must not be nested more than %d levels deep", maxDepth)
+		}
+	}
+}
+
+// The isIDKey() helper reports whether values for the given JSON key are IDs. This is
+// the case for the key "id", and any key ending in "_id" (like "user_id") or "_ids"
+// (like "user_ids").
+func isIDKey(key string) bool {
+	return key == "id" || strings.HasSuffix(key, "_id") || strings.HasSuffix(key, "_ids")
+}
+
+// The isTimeKey() helper reports whether values for the given JSON key are
+// timestamps. This is the case for any key ending in "_at" (like "created_at"), and
+// for the "expiry" and "last_run" keys.
+func isTimeKey(key string) bool {
+	return strings.HasSuffix(key, "_at") || key == "expiry" || key == "last_run"
+}
+
+// The jsonRewrite struct holds the changes which rewriteJSON() makes to a document.
+// If stringIDs is true, then the integer values of ID fields (see isIDKey) are
+// encoded as strings. If location isn't nil, then the timestamps (see isTimeKey) are
+// converted to that location.
+type jsonRewrite struct {
+	stringIDs bool
+	location  *time.Location
+}
+
+// The rewriteJSON() helper rewrites a JSON document as set out by rw. Encoding ID
+// fields as strings, like "id": "123", stops JavaScript clients losing precision on
+// IDs larger than 2^53. Converting the timestamps means that they're always sent in
+// the same time zone, whatever the zone of the database session or the server. In
+// UTC they end in "Z". It works on the tokens of the document, rather than decoding
+// it into a map, so that the order of the keys is preserved. Every other value is
+// left unchanged, including the pagination metadata, which only contains counts and
+// page numbers.
+func rewriteJSON(js []byte, rw jsonRewrite) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+
+	var buf bytes.Buffer
+
+	err := rewriteJSONValue(dec, &buf, rw, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+
+	err = json.Indent(&out, buf.Bytes(), "", "\t")
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// The rewriteJSONValue() helper reads the next value from dec and writes it to buf in
+// compact form, rewriting it according to rw and the key that it belongs to. Objects
+// and arrays are handled recursively; the elements of an array are treated as if
+// they belong to the array's key, while the values in an object are decided by their
+// own keys.
+func rewriteJSONValue(dec *json.Decoder, buf *bytes.Buffer, rw jsonRewrite, key string) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	switch t := tok.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			buf.WriteByte('{')
+			for i := 0; dec.More(); i++ {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+
+				keyTok, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				key := keyTok.(string)
+
+				err = writeJSONString(buf, key)
+				if err != nil {
+					return err
+				}
+				buf.WriteByte(':')
+
+				err = rewriteJSONValue(dec, buf, rw, key)
+				if err != nil {
+					return err
+				}
+			}
+			buf.WriteByte('}')
+		case '[':
+			buf.WriteByte('[')
+			for i := 0; dec.More(); i++ {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+
+				err := rewriteJSONValue(dec, buf, rw, key)
+				if err != nil {
+					return err
+				}
+			}
+			buf.WriteByte(']')
+		}
+
+		// Consume the closing delimiter.
+		_, err = dec.Token()
+		return err
+	case json.Number:
+		if rw.stringIDs && isIDKey(key) && !strings.ContainsAny(t.String(), ".eE") {
+			return writeJSONString(buf, t.String())
+		}
+		buf.WriteString(t.String())
+	case string:
+		// Strings which don't parse as timestamps are left as they are.
+		if rw.location != nil && isTimeKey(key) {
+			if ts, err := time.Parse(time.RFC3339Nano, t); err == nil {
+				return writeJSONString(buf, ts.In(rw.location).Format(time.RFC3339Nano))
+			}
+		}
+		return writeJSONString(buf, t)
+	case bool:
+		buf.WriteString(strconv.FormatBool(t))
+	case nil:
+		buf.WriteString("null")
+	}
+
+	return nil
+}
+
+// The writeJSONString() helper writes s to buf as a JSON string, escaped in the same
+// way as json.Marshal() would.
+func writeJSONString(buf *bytes.Buffer, s string) error {
+	js, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	buf.Write(js)
+	return nil
+}
+
+// Define a jsonID type for reading IDs from JSON request bodies. It accepts the ID as
+// either a number (123) or a string ("123"), so that clients using -json-string-ids
+// can send IDs back in the same form that they received them.
+type jsonID int64
+
+func (id *jsonID) UnmarshalJSON(js []byte) error {
+	s := string(js)
+
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("body contains invalid ID %s", js)
+	}
+
+	*id = jsonID(i)
+	return nil
+}
+
 // The readString() helper returns a string value from the query string, or the provided
 // default value if no matching key could be found.
 func (app *application) readString(qs url.Values, key string, defaultValue string) string {
@@ -253,6 +652,85 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// The readBool() helper reads a boolean value from the query string, accepting any of
+// the values understood by strconv.ParseBool(), like "true", "false", "1" and "0". If
+// no matching key could be found it returns the provided default value. If the value
+// couldn't be converted, then we record an error message in the Validator instance.
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return defaultValue
+	}
+
+	return b
+}
+
+// The maximum length, in bytes, of the raw genres query string value.
+const maxGenresQueryLength = 1000
+
+// The validateGenresQuery() method checks that the genres query string value isn't
+// too long, and that it doesn't contain more than the configured number of genres.
+// This stops clients from forcing the database to compare against huge arrays.
+func (app *application) validateGenresQuery(v *validator.Validator, qs url.Values, genres []string) {
+	v.Check(len(qs.Get("genres")) <= maxGenresQueryLength, "genres", fmt.Sprintf("must not be more than %d bytes long", maxGenresQueryLength))
+	v.Check(len(genres) <= app.config.maxQueryGenres, "genres", fmt.Sprintf("must not contain more than %d values", app.config.maxQueryGenres))
+}
+
+// The readTime() helper reads a RFC3339 formatted timestamp from the query string.
+// Because a missing timestamp usually means "no restriction", it returns nil if no
+// matching key could be found. If the value couldn't be parsed, then we record an
+// error message in the provided Validator instance and also return nil.
+func (app *application) readTime(qs url.Values, key string, v *validator.Validator) *time.Time {
+	s := qs.Get(key)
+
+	if s == "" {
+		return nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		v.AddError(key, "must be a valid RFC3339 timestamp")
+		return nil
+	}
+
+	return &t
+}
+
+// The readPreferences() helper parses any Prefer request headers (as described in
+// RFC 7240) into a map of lower-cased preference names and values. A request can
+// send several preferences in a single comma-separated header, or across multiple
+// headers. Any parameters following a semicolon are ignored, as are empty entries,
+// so malformed or unrecognised preferences never cause an error. If the same
+// preference appears more than once, the first occurrence wins.
+func (app *application) readPreferences(r *http.Request) map[string]string {
+	preferences := make(map[string]string)
+
+	for _, header := range r.Header.Values("Prefer") {
+		for _, preference := range strings.Split(header, ",") {
+			token, _, _ := strings.Cut(preference, ";")
+			name, value, _ := strings.Cut(token, "=")
+
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+
+			if _, exists := preferences[name]; !exists {
+				preferences[name] = strings.ToLower(strings.Trim(strings.TrimSpace(value), `"`))
+			}
+		}
+	}
+
+	return preferences
+}
+
 // The background() helper accepts an arbitrary function as a parameter.
 func (app *application) background(fn func()) {
 	// Increment the WaitGroup counter.
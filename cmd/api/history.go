@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"greenlight.nicolasleigh.net/internal/data"
+	"greenlight.nicolasleigh.net/internal/validator"
+)
+
+// The showMovieVersionHandler returns the snapshot of a movie at a specific version,
+// as recorded in the movie audit trail.
+func (app *application) showMovieVersionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	params := httprouter.ParamsFromContext(r.Context())
+
+	version, err := strconv.ParseInt(params.ByName("version"), 10, 32)
+	if err != nil || version < 1 {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	snapshot, err := app.requestModels(r).MovieAudits.GetVersion(id, int32(version))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"snapshot": snapshot}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The movieDiffHandler returns the fields which changed between two versions of a
+// movie, given by the from and to query string parameters, along with their old and
+// new values. If either version doesn't exist for the movie, then a 404 Not Found
+// response is sent.
+func (app *application) movieDiffHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		From int
+		To   int
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.From = app.readInt(qs, "from", 0, v)
+	input.To = app.readInt(qs, "to", 0, v)
+
+	v.Check(input.From > 0, "from", "must be a positive version number")
+	v.Check(input.From <= math.MaxInt32, "from", "must not be greater than 2147483647")
+	v.Check(input.To > 0, "to", "must be a positive version number")
+	v.Check(input.To <= math.MaxInt32, "to", "must not be greater than 2147483647")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	from, err := app.requestModels(r).MovieAudits.GetVersion(id, int32(input.From))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	to, err := app.requestModels(r).MovieAudits.GetVersion(id, int32(input.To))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	diff := envelope{
+		"movie_id": id,
+		"from":     from.Version,
+		"to":       to.Version,
+		"changes":  data.DiffSnapshots(from, to),
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"diff": diff}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The verifyAuditChainHandler checks a range of the movie audit hash chain and reports
+// whether it's intact, along with the first broken link if it isn't. Large tables
+// can be verified in several requests by passing the returned next_id as from_id.
+func (app *application) verifyAuditChainHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		FromID int
+		Limit  int
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.FromID = app.readInt(qs, "from_id", 1, v)
+	input.Limit = app.readInt(qs, "limit", 10_000, v)
+
+	v.Check(input.FromID >= 1, "from_id", "must be greater than zero")
+	v.Check(input.Limit >= 1, "limit", "must be greater than zero")
+	v.Check(input.Limit <= 100_000, "limit", "must be a maximum of 100000")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	report, err := app.requestModels(r).MovieAudits.VerifyChain(int64(input.FromID), input.Limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"audit_chain": report}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
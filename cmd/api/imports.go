@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"greenlight.nicolasleigh.net/internal/data"
+	"greenlight.nicolasleigh.net/internal/validator"
+)
+
+// Valid rows from a CSV import are inserted in batches of importBatchSize movies, with
+// each batch in its own transaction. In strict mode the whole import runs in a single
+// transaction instead, so it gets a longer timeout. The upload itself can take up to
+// importUploadTimeout, so that large files can be sent over slow links.
+const (
+	importBatchSize     = 100
+	importBatchTimeout  = 10 * time.Second
+	importStrictTimeout = 60 * time.Second
+	importUploadTimeout = 5 * time.Minute
+	importMaxFailures   = 100
+)
+
+// The columns which must be present in the header row of a CSV import.
+var importColumns = []string{"title", "year", "runtime", "genres"}
+
+// Define an importFailure struct to hold the line number and error messages for a
+// CSV row which couldn't be imported.
+type importFailure struct {
+	Line   int               `json:"line"`
+	Errors map[string]string `json:"errors"`
+}
+
+// Define an importSummary struct to report the outcome of a CSV import. Only the first
+// importMaxFailures failures are included in the Failures slice, but Failed always
+// holds the total.
+type importSummary struct {
+	Inserted int             `json:"inserted"`
+	Skipped  int             `json:"skipped"`
+	Failed   int             `json:"failed"`
+	Failures []importFailure `json:"failures"`
+	// The number of valid rows without any genres which were given the default
+	// genre.
+	DefaultGenres int `json:"default_genres,omitempty"`
+}
+
+// The importMoviesCSVHandler streams a CSV file from the request body and inserts a
+// movie for each row. The header row maps the columns, which can appear in any
+// order. Rows matching an existing movie's title and year are skipped. Invalid rows
+// are reported in the response without stopping the import, unless ?strict=true is
+// set, in which case the first invalid row aborts the import and nothing is saved.
+//
+// If ?reindex=true is set, then a background task is started once the import has
+// finished, which rebuilds the movies indexes and refreshes the planner statistics.
+// The response includes the task ID, which can be used to check on its progress. As
+// with the analyze endpoint, reindexing in production also needs ?force=true, because
+// it locks the movies table.
+func (app *application) importMoviesCSVHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	strict := app.readBool(r.URL.Query(), "strict", false, v)
+	reindex := app.readBool(r.URL.Query(), "reindex", false, v)
+	force := app.readBool(r.URL.Query(), "force", false, v)
+
+	if reindex && app.config.env == "production" {
+		v.Check(force, "force", "must be true to reindex in production, as reindexing locks the movies table")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The upload and the import can take much longer than the server's read and
+	// write timeouts, so extend the deadlines for this request. The write deadline
+	// also covers the strict mode transaction, which is committed after the upload.
+	rc := http.NewResponseController(w)
+
+	err := rc.SetReadDeadline(time.Now().Add(importUploadTimeout))
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = rc.SetWriteDeadline(time.Now().Add(importUploadTimeout + importStrictTimeout + 10*time.Second))
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Limit the size of the request body. The CSV reader reads the body as it goes,
+	// so only the current row is held in memory.
+	r.Body = http.MaxBytesReader(w, r.Body, app.config.importMaxBytes)
+
+	reader := csv.NewReader(r.Body)
+	// We check the number of fields in each row ourselves, so that a row with the
+	// wrong number of fields is reported as a failure like any other invalid row.
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		app.badRequestResponse(w, r, csvReadError(err))
+		return
+	}
+
+	columns, err := csvColumns(header)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	summary := importSummary{Failures: []importFailure{}}
+
+	var batch *data.MovieBatch
+	pending := 0
+
+	// Make sure that any uncommitted batch is rolled back if we return early.
+	defer func() {
+		if batch != nil {
+			batch.Rollback()
+		}
+	}()
+
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		var failure *importFailure
+
+		var parseError *csv.ParseError
+		var maxBytesError *http.MaxBytesError
+
+		switch {
+		case errors.As(err, &maxBytesError):
+			app.badRequestResponse(w, r, csvReadError(err))
+			return
+		case errors.As(err, &parseError):
+			failure = &importFailure{Line: parseError.StartLine, Errors: map[string]string{"row": parseError.Err.Error()}}
+		case err != nil:
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		var movie *data.Movie
+
+		if failure == nil {
+			line, _ := reader.FieldPos(0)
+
+			var rowErrors map[string]string
+			var defaulted bool
+			movie, defaulted, rowErrors = parseMovieRecord(record, header, columns, app.config.defaultGenre)
+			if rowErrors != nil {
+				failure = &importFailure{Line: line, Errors: rowErrors}
+			}
+
+			if defaulted && failure == nil {
+				summary.DefaultGenres++
+				app.logger.Info("applied default genre", "request_id", app.contextGetRequestID(r), "genre", app.config.defaultGenre, "title", movie.Title, "line", line)
+			}
+		}
+
+		if failure != nil {
+			// In strict mode, the deferred rollback discards everything inserted so far.
+			if strict {
+				app.errorResponse(w, r, http.StatusUnprocessableEntity, failure)
+				return
+			}
+
+			summary.Failed++
+			if len(summary.Failures) < importMaxFailures {
+				summary.Failures = append(summary.Failures, *failure)
+			}
+			continue
+		}
+
+		if batch == nil {
+			timeout := importBatchTimeout
+			if strict {
+				timeout = importStrictTimeout
+			}
+
+			batch, err = app.requestModels(r).Movies.NewBatch(timeout)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		inserted, err := batch.Insert(movie)
+		if err != nil {
+			switch {
+			// In non-strict mode, a duplicate title is reported like any other invalid
+			// row. The batch rolled back just this insert, so it can carry on.
+			case errors.Is(err, data.ErrDuplicateTitle) && !strict:
+				line, _ := reader.FieldPos(0)
+
+				summary.Failed++
+				if len(summary.Failures) < importMaxFailures {
+					summary.Failures = append(summary.Failures, importFailure{Line: line, Errors: map[string]string{"title": duplicateTitleMessage}})
+				}
+				continue
+			case errors.Is(err, data.ErrDuplicateTitle):
+				app.conflictResponse(w, r, fmt.Sprintf("a movie titled %q already exists", movie.Title))
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if inserted {
+			summary.Inserted++
+		} else {
+			summary.Skipped++
+		}
+
+		// Commit each full batch, unless we're in strict mode where everything is
+		// committed together at the end.
+		pending++
+		if !strict && pending == importBatchSize {
+			err = batch.Commit()
+			batch = nil
+			pending = 0
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+	}
+
+	if batch != nil {
+		err = batch.Commit()
+		batch = nil
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// The imported movies aren't sent individually, as there may be a very large
+	// number of them. Clients can fetch them if they need to.
+	app.movieEvents.publish(moviesImportedEvent, envelope{"import": summary})
+
+	env := envelope{"import": summary}
+	if reindex {
+		env["task_id"] = app.startTask("reindex-movies", app.reindexMoviesTask)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The csvReadError() helper converts an error from reading the CSV body into a
+// plain-english error message for the client.
+func csvReadError(err error) error {
+	var maxBytesError *http.MaxBytesError
+
+	switch {
+	case errors.Is(err, io.EOF):
+		return errors.New("body must not be empty")
+	case errors.As(err, &maxBytesError):
+		return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
+	default:
+		return fmt.Errorf("body contains badly-formed CSV: %w", err)
+	}
+}
+
+// The csvColumns() helper maps the lower-cased names in the header row to their
+// position. It returns an error if a required column is missing, or if there are
+// unknown or duplicate columns.
+func csvColumns(header []string) (map[string]int, error) {
+	columns := make(map[string]int)
+
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		if !validator.PermittedValue(name, importColumns...) {
+			return nil, fmt.Errorf("header contains unknown column %q", name)
+		}
+		if _, exists := columns[name]; exists {
+			return nil, fmt.Errorf("header contains duplicate column %q", name)
+		}
+
+		columns[name] = i
+	}
+
+	for _, name := range importColumns {
+		if _, exists := columns[name]; !exists {
+			return nil, fmt.Errorf("header must contain a %q column", name)
+		}
+	}
+
+	return columns, nil
+}
+
+// The parseMovieRecord() helper converts a CSV row into a Movie and validates it. The
+// runtime can be given either as a number of minutes or in the "<runtime> mins"
+// format, and the genres are separated by commas within the field. If the genres
+// field is empty and defaultGenre isn't, then the movie is given the default genre
+// and the second return value is true. If the row is invalid, then it returns a map
+// of error messages instead.
+func parseMovieRecord(record, header []string, columns map[string]int, defaultGenre string) (*data.Movie, bool, map[string]string) {
+	v := validator.New()
+
+	if len(record) != len(header) {
+		v.AddError("row", fmt.Sprintf("must contain %d fields", len(header)))
+		return nil, false, v.Errors
+	}
+
+	movie := &data.Movie{
+		Title: strings.TrimSpace(record[columns["title"]]),
+	}
+
+	if s := strings.TrimSpace(record[columns["year"]]); s != "" {
+		year, err := strconv.ParseInt(s, 10, 32)
+		v.Check(err == nil, "year", "must be an integer value")
+		movie.Year = int32(year)
+	}
+
+	if s := strings.TrimSpace(strings.TrimSuffix(record[columns["runtime"]], " mins")); s != "" {
+		runtime, err := strconv.ParseInt(s, 10, 32)
+		v.Check(err == nil, "runtime", "must be an integer value")
+		movie.Runtime = data.Runtime(runtime)
+	}
+
+	if s := strings.TrimSpace(record[columns["genres"]]); s != "" {
+		movie.Genres = []string{}
+		for _, genre := range strings.Split(s, ",") {
+			movie.Genres = append(movie.Genres, strings.TrimSpace(genre))
+		}
+	}
+
+	defaulted := false
+	if len(movie.Genres) == 0 && defaultGenre != "" {
+		movie.Genres = []string{defaultGenre}
+		defaulted = true
+	}
+
+	if data.ValidateMovie(v, movie); !v.Valid() {
+		return nil, false, v.Errors
+	}
+
+	return movie, defaulted, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// The registerJobs() method adds the periodic background jobs to the scheduler.
+func (app *application) registerJobs() {
+	// Delete expired tokens, which can't be used any more, once an hour.
+	app.scheduler.Add("purge-expired-tokens", time.Hour, func() error {
+		deleted, err := app.models.Tokens.DeleteExpired()
+		if err != nil {
+			return err
+		}
+
+		app.logger.Info("purged expired tokens", "deleted", deleted)
+		return nil
+	})
+
+	// If the rate limiter buckets are stored in the database, then delete the ones
+	// which haven't been used for three minutes, once a minute. By then they will
+	// have refilled, so deleting them doesn't change how future requests are limited.
+	if app.config.limiter.store == "db" {
+		app.scheduler.Add("delete-stale-rate-limits", time.Minute, func() error {
+			return app.models.RateLimits.DeleteStale(3 * time.Minute)
+		})
+	}
+}
+
+// The listJobsHandler returns the status of each of the scheduled background jobs,
+// including when they last ran and whether they failed.
+func (app *application) listJobsHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"jobs": app.scheduler.Status()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
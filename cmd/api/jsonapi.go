@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"greenlight.nicolasleigh.net/internal/data"
+)
+
+// The media type for JSON:API documents, which is sent in the Content-Type header
+// when the -api-format flag is set to "jsonapi".
+const jsonAPIMediaType = "application/vnd.api+json"
+
+// A jsonAPIResource is a JSON:API resource object. The ID is always a string, and
+// the attributes hold the rest of the fields. The attributes are left out for
+// resource identifiers, like when only the movie IDs are asked for. Relationships
+// link the resource to others, like its similar movies.
+type jsonAPIResource struct {
+	Type          string                     `json:"type"`
+	ID            string                     `json:"id"`
+	Attributes    map[string]json.RawMessage `json:"attributes,omitempty"`
+	Relationships envelope                   `json:"relationships,omitempty"`
+}
+
+// The newMovieResource() function converts a movie to a JSON:API resource object.
+// Rather than listing the attributes again here, we encode the movie in the same way
+// as for the simple format and move everything except the ID into the attributes.
+// That way the attributes always match the fields of the simple format, including
+// the created_at field and the genre objects if they were asked for.
+func newMovieResource(movie *data.Movie, opts movieOptions) (jsonAPIResource, error) {
+	js, err := json.Marshal(movieResponse(movie, opts))
+	if err != nil {
+		return jsonAPIResource{}, err
+	}
+
+	var attributes map[string]json.RawMessage
+
+	err = json.Unmarshal(js, &attributes)
+	if err != nil {
+		return jsonAPIResource{}, err
+	}
+
+	delete(attributes, "id")
+
+	return jsonAPIResource{
+		Type:       "movies",
+		ID:         strconv.FormatInt(movie.ID, 10),
+		Attributes: attributes,
+	}, nil
+}
+
+// The jsonAPIPageLinks() function returns the JSON:API pagination links for a page of
+// results, keeping the rest of the query string. If the total number of records
+// wasn't counted, then there's no last link, and the next link is only included if
+// the page was full.
+func jsonAPIPageLinks(r *http.Request, metadata data.Metadata, count int) envelope {
+	links := envelope{"self": r.URL.RequestURI()}
+
+	// The metadata is empty if there were no records.
+	if metadata.CurrentPage == 0 {
+		return links
+	}
+
+	page := func(n int) string {
+		qs := r.URL.Query()
+		qs.Set("page", strconv.Itoa(n))
+		return r.URL.Path + "?" + qs.Encode()
+	}
+
+	links["first"] = page(metadata.FirstPage)
+
+	if metadata.CurrentPage > metadata.FirstPage {
+		links["prev"] = page(metadata.CurrentPage - 1)
+	}
+
+	if metadata.LastPage != 0 {
+		if metadata.CurrentPage < metadata.LastPage {
+			links["next"] = page(metadata.CurrentPage + 1)
+		}
+		links["last"] = page(metadata.LastPage)
+	} else if count == metadata.PageSize {
+		links["next"] = page(metadata.CurrentPage + 1)
+	}
+
+	return links
+}
+
+// The writeJSONAPI() helper sends a JSON:API document. It's like writeJSON(), but the
+// -envelope-keys and -json-string-ids settings don't apply, as the member names are
+// fixed by the specification and the IDs are already strings.
+func (app *application) writeJSONAPI(w http.ResponseWriter, status int, doc envelope, headers http.Header) error {
+	js, err := json.MarshalIndent(doc, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if location := responseLocation(w); location != nil {
+		js, err = rewriteJSON(js, jsonRewrite{location: location})
+		if err != nil {
+			return err
+		}
+	}
+
+	js = append(js, '\n')
+
+	w.Header().Set("Content-Type", jsonAPIMediaType)
+
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+
+	w.WriteHeader(status)
+	w.Write(js)
+
+	return nil
+}
+
+// The writeMovie() helper sends a single movie in the format set by the -api-format
+// flag. In the simple format it's sent as {"movie": ...}, and in the JSON:API format
+// it's sent as the primary data of the document. Any similar movies are sent as
+// "similar" in the simple format, and as a relationship with the movies in "included"
+// in the JSON:API format.
+func (app *application) writeMovie(w http.ResponseWriter, status int, movie *data.Movie, opts movieOptions, headers http.Header) error {
+	if app.config.apiFormat != "jsonapi" {
+		// return app.writeJSON(w, status, envelope{"movie": movieResponse(movie, opts)}, headers)
+		env := envelope{"movie": movieResponse(movie, opts)}
+		if opts.similar != nil {
+			env["similar"] = moviesResponse(opts.similar, opts)
+		}
+		return app.writeJSON(w, status, env, headers)
+	}
+
+	resource, err := newMovieResource(movie, opts)
+	if err != nil {
+		return err
+	}
+
+	doc := envelope{"data": resource}
+
+	if opts.similar != nil {
+		identifiers := make([]jsonAPIResource, len(opts.similar))
+		included := make([]jsonAPIResource, len(opts.similar))
+
+		for i, similar := range opts.similar {
+			included[i], err = newMovieResource(similar, opts)
+			if err != nil {
+				return err
+			}
+			identifiers[i] = jsonAPIResource{Type: included[i].Type, ID: included[i].ID}
+		}
+
+		resource.Relationships = envelope{"similar": envelope{"data": identifiers}}
+		doc["data"] = resource
+		doc["included"] = included
+	}
+
+	return app.writeJSONAPI(w, status, doc, headers)
+}
+
+// The writeMovies() helper is the same as writeMovie(), but for a list of movies. If
+// the metadata isn't nil, then it's sent as "metadata" in the simple format, and as
+// "meta" along with the pagination links in the JSON:API format.
+func (app *application) writeMovies(w http.ResponseWriter, r *http.Request, status int, movies []*data.Movie, metadata *data.Metadata, opts movieOptions, headers http.Header) error {
+	if app.config.apiFormat != "jsonapi" {
+		env := envelope{"movies": moviesResponse(movies, opts)}
+		if metadata != nil {
+			env["metadata"] = *metadata
+		}
+		return app.writeJSON(w, status, env, headers)
+	}
+
+	resources := make([]jsonAPIResource, len(movies))
+	for i, movie := range movies {
+		resource, err := newMovieResource(movie, opts)
+		if err != nil {
+			return err
+		}
+		resources[i] = resource
+	}
+
+	doc := envelope{"data": resources}
+	if metadata != nil {
+		doc["links"] = jsonAPIPageLinks(r, *metadata, len(movies))
+		doc["meta"] = *metadata
+	}
+
+	return app.writeJSONAPI(w, status, doc, headers)
+}
+
+// The writeMovieIDs() helper sends the IDs of a page of movies. In the JSON:API format
+// they're sent as resource identifiers, which are resource objects without any
+// attributes.
+func (app *application) writeMovieIDs(w http.ResponseWriter, r *http.Request, status int, ids []int64, metadata data.Metadata) error {
+	if app.config.apiFormat != "jsonapi" {
+		return app.writeJSON(w, status, envelope{"movie_ids": ids, "metadata": metadata}, nil)
+	}
+
+	resources := make([]jsonAPIResource, len(ids))
+	for i, id := range ids {
+		resources[i] = jsonAPIResource{Type: "movies", ID: strconv.FormatInt(id, 10)}
+	}
+
+	doc := envelope{
+		"data":  resources,
+		"links": jsonAPIPageLinks(r, metadata, len(ids)),
+		"meta":  metadata,
+	}
+
+	return app.writeJSONAPI(w, status, doc, nil)
+}
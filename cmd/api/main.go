@@ -7,18 +7,30 @@ import (
 	"flag"
 	"fmt"
 	"log/slog"
+	"net/netip"
+	"net/http"
+	"net/url"
 	"os"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	// Embed the time zone database, so that the tz query string parameter works even
+	// if the server doesn't have one installed.
+	_ "time/tzdata"
+
 	// Import the pq driver so that it can register itself with the database/sql
 	// package. Note that we alias this import to the blank identifier, to stop the Go
 	// compiler complaining that the package isn't being used.
-	_ "github.com/lib/pq"
+	// The connector is now created with pq.NewConnector(), so the import is no longer
+	// aliased.
+	"github.com/lib/pq"
 	"greenlight.nicolasleigh.net/internal/data"
 	"greenlight.nicolasleigh.net/internal/mailer"
+	"greenlight.nicolasleigh.net/internal/scheduler"
 	"greenlight.nicolasleigh.net/internal/vcs"
 )
 
@@ -51,6 +63,13 @@ type config struct {
 		maxOpenConns int
 		maxIdleConns int
 		maxIdleTime  time.Duration
+		// The maximum amount of time a connection may be reused for, so that
+		// connections are recycled periodically behind proxies like PgBouncer. Zero
+		// means that connections are reused forever.
+		maxLifetime time.Duration
+		// The application_name which is set on each connection, so that the
+		// connections can be identified in pg_stat_activity.
+		appName string
 	}
 	// Add a new limiter struct containing fields for the requests-per-second and burst
 	// values, and a boolean field which we can use to enable/disable rate limiting
@@ -59,6 +78,12 @@ type config struct {
 		rps     float64
 		burst   int
 		enabled bool
+		// The store for the token buckets. Either "memory" or "db".
+		store string
+		// Requests from clients in these networks are never rate limited.
+		exemptIPs []netip.Prefix
+		// How requests are grouped into buckets: "ip", "user" or "header:<name>".
+		key string
 	}
 	// Update the config struct to hold the SMTP server settings.
 	smtp struct {
@@ -67,11 +92,126 @@ type config struct {
 		username string
 		password string
 		sender   string
+		// The timeout for connecting to and sending to the SMTP server, and the number
+		// of times that a failed send is retried.
+		timeout time.Duration
+		retries int
 	}
 	// Add a cors struct and trustedOrigins field with the type []string.
 	cors struct {
 		trustedOrigins []string
 	}
+	// When skipActivation is true, newly registered users are activated immediately
+	// and granted the development permission set, so that no SMTP server is needed.
+	skipActivation bool
+	// The permission codes granted to new users when they register. The same set is
+	// re-applied by the reset permissions endpoint.
+	defaultPermissions []string
+	// Whether the application refuses to start if permission codes which it relies on
+	// are missing from the permissions table, rather than just logging a warning.
+	strictPermissions bool
+	// Whether users must have activated their account to use the read-only endpoints.
+	// Endpoints which change data always require an activated account.
+	readRequiresActivation bool
+	// The deadline for handling each request. The fallback is used when the client
+	// doesn't send an X-Request-Timeout header, and 0 means that there's no deadline.
+	// Client supplied timeouts are clamped to the max.
+	requestTimeout struct {
+		fallback time.Duration
+		max      time.Duration
+	}
+	// Whether requests without a User-Agent header are rejected.
+	requireUserAgent bool
+	// Whether requests for a path with a trailing slash are redirected to the path
+	// without it.
+	redirectTrailingSlash bool
+	// The maximum number of clients which can be connected to the movie event stream
+	// at once.
+	sseMaxClients int
+	// The path to a file of genre synonyms which replaces the embedded list.
+	genreSynonymsFile string
+	// The HTTP status code to send when a user tries to register with an email
+	// address that is already in use. Either 422 (the default) or 409.
+	duplicateEmailStatus int
+	// The algorithm used to hash newly created tokens.
+	tokenHash string
+	// The secret which shows the full details on the HTML status page outside of
+	// development.
+	statusSecret string
+	// The genre given to imported movies which don't have any genres, and to created
+	// movies when the client asks for it. It's empty if there's no default genre.
+	defaultGenre string
+	// The HMAC request signature settings. The routes are in the form "METHOD /path",
+	// matching the paths in the route registry, and only those routes require a
+	// signature. The window is how far the signed timestamp can be from the current
+	// time.
+	signature struct {
+		secret string
+		routes []string
+		window time.Duration
+	}
+	// The policy used to validate new passwords. Either "basic" or "strong".
+	passwordPolicy string
+	// Whether movie titles must be unique (ignoring case). This is enforced by a
+	// database trigger, which is turned on for the API's connections.
+	uniqueTitles bool
+	// Whether a movie's slug is regenerated when its title is updated.
+	regenerateSlugs bool
+	// The language of the base movie fields, sent in the Content-Language header when
+	// there's no translation for the client's preferred language.
+	defaultLanguage string
+	// The sort order used when listing movies if the client doesn't provide one.
+	moviesDefaultSort string
+	// How the title filter is matched when listing movies. Either "fulltext" or
+	// "like".
+	searchMode string
+	// A map of envelope key renames, like "movies" to "data". Keys which don't appear
+	// in the map are sent unchanged.
+	envelopeKeys map[string]string
+	// Limits on the nesting depth and array lengths of JSON request bodies. A value of
+	// 0 disables the limit.
+	json struct {
+		maxDepth       int
+		maxArrayLength int
+	}
+	// The format for the movie read endpoints. Either "simple" (the default envelope)
+	// or "jsonapi" (JSON:API documents).
+	apiFormat string
+	// How a movie list with no matching movies is sent. Either "array" (a 200 OK
+	// response with an empty array) or "no-content" (a 204 No Content response).
+	emptyList string
+	// The format for error responses. Either "simple" (the default {"error": ...}
+	// object) or "problem" (RFC 7807 Problem Details).
+	errorFormat string
+	// The default format for validation errors. Either "map" or "list".
+	validationErrors string
+	// The maximum size of the request body for CSV imports, in bytes.
+	importMaxBytes int64
+	// Whether ID fields are encoded as JSON strings rather than numbers.
+	jsonStringIDs bool
+	// The maximum number of values allowed in the genres query string parameter.
+	maxQueryGenres int
+	// The fraction of successful requests which are written to the access log,
+	// between 0 and 1. Requests which don't succeed are always logged.
+	logSampleRate float64
+	// Whether the Server-Timing response header is sent. It's off by default, as it
+	// reveals how long the database queries take.
+	serverTiming bool
+	// Add a debug struct containing the settings for logging request and response
+	// bodies.
+	debug struct {
+		logBodies      bool
+		logBodiesLimit int
+	}
+	// Add a secure struct containing the settings for the secureHeaders() middleware.
+	// The trustedProxies are the addresses of the reverse proxies whose
+	// X-Forwarded-Proto, X-Forwarded-For and X-Real-IP headers are believed.
+	secure struct {
+		hsts           bool
+		csp            string
+		httpsRedirect  bool
+		trustedProxies []netip.Prefix
+	}
 }
 
 // Define an application struct to hold the dependencies for our HTTP handlers, helpers,
@@ -89,6 +229,30 @@ type application struct {
 	models data.Models
 	mailer mailer.Mailer // Update the application struct to hold a new Mailer instance.
 	wg     sync.WaitGroup
+	// The number of requests which are currently being processed.
+	inFlight atomic.Int64
+	// The backgroundCtx context is cancelled when the application starts shutting
+	// down, so that background tasks can stop retrying and return promptly.
+	backgroundCtx    context.Context
+	cancelBackground context.CancelFunc
+	// Cache the user statistics briefly, as they're only used for dashboards.
+	userStats cachedValue[*data.UserStats]
+	// Cache the most recently added movies briefly, as they're requested often.
+	recentMovies cachedValue[[]*data.Movie]
+	// The routes which were registered by routes(), for the GET /v1/routes endpoint.
+	routeRegistry []routeInfo
+	// The scheduler runs the periodic background jobs.
+	scheduler *scheduler.Scheduler
+	// The movie events are published to the clients of the GET /v1/movies/events
+	// endpoint.
+	movieEvents *eventBroker
+	// The one-off background tasks, like reindexing after an import.
+	tasks *taskRegistry
+	// The time that the application started, for the uptime on the status page.
+	startedAt time.Time
+	// The function which picks the rate limiter bucket for a request, which is set
+	// by the -limiter-key flag.
+	limiterKey func(r *http.Request) string
 }
 
 func main() {
@@ -120,12 +284,19 @@ func main() {
 	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
 	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
 	flag.DurationVar(&cfg.db.maxIdleTime, "db-max-idle-time", 15*time.Minute, "PostgreSQL max connection idle time")
+	flag.DurationVar(&cfg.db.maxLifetime, "db-max-conn-lifetime", 0, "PostgreSQL max connection lifetime (0 = unlimited)")
+
+	// Read the application_name for the database connections. If it isn't set, then
+	// a default based on the environment and version is used (see below).
+	flag.StringVar(&cfg.db.appName, "db-app-name", "", "PostgreSQL application_name (default greenlight-<env>-<version>)")
 
 	// Create command line flags to read the setting values into the config struct.
 	// Notice that we use true as the default for the 'enabled' setting.
 	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	flag.StringVar(&cfg.limiter.store, "limiter-store", "memory", "Rate limiter store (memory|db)")
+	flag.StringVar(&cfg.limiter.key, "limiter-key", "ip", "Rate limiter key (ip|user|header:<name>)")
 
 	// Read the SMTP server configuration settings into the config struct, using the
 	// Mailtrap settings as the default values. IMPORTANT: If you're following along,
@@ -136,6 +307,8 @@ func main() {
 	flag.StringVar(&cfg.smtp.username, "smtp-username", "1800b43b02b3f4", "SMTP username")
 	flag.StringVar(&cfg.smtp.password, "smtp-password", "f73535518eac82", "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@greenlight.nicolasleigh.net>", "SMTP sender")
+	flag.DurationVar(&cfg.smtp.timeout, "smtp-timeout", 5*time.Second, "SMTP dial and send timeout")
+	flag.IntVar(&cfg.smtp.retries, "smtp-retries", 3, "Number of times to retry sending a failed email")
 
 	// Use the flag.Func() function to process the -cors-trusted-origins command line
 	// flag. In this we use the strings.Fields() function to split the flag value into a
@@ -148,6 +321,149 @@ func main() {
 		return nil
 	})
 
+	// Process the -limiter-exempt-ips flag, which contains space separated CIDR
+	// ranges (or single IP addresses) for trusted clients, like our monitoring
+	// systems, which should never be rate limited.
+	flag.Func("limiter-exempt-ips", "Client IPs or CIDR ranges exempt from rate limiting (space separated)", func(val string) error {
+		prefixes, err := parsePrefixes(val)
+		if err != nil {
+			return err
+		}
+		cfg.limiter.exemptIPs = prefixes
+		return nil
+	})
+
+	// Process the -default-permissions flag, which contains the space separated
+	// permission codes granted to newly registered users.
+	cfg.defaultPermissions = []string{"movies:read"}
+	flag.Func("default-permissions", `Permission codes granted to new users (space separated) (default "movies:read")`, func(val string) error {
+		cfg.defaultPermissions = strings.Fields(val)
+		return nil
+	})
+
+	// Process the -envelope-keys flag, which contains space separated from=to pairs
+	// such as "movie=data movies=data metadata=meta". Returning an error from the
+	// function makes flag.Parse() print the error and exit.
+	flag.Func("envelope-keys", "Response envelope key renames (space separated from=to pairs)", func(val string) error {
+		keys, err := parseEnvelopeKeys(val)
+		if err != nil {
+			return err
+		}
+		cfg.envelopeKeys = keys
+		return nil
+	})
+
+	// Read the skip-activation setting. This is intended for local development only,
+	// so it defaults to false.
+	flag.BoolVar(&cfg.skipActivation, "skip-activation", false, "Activate new users immediately and grant them write permissions (development only)")
+
+	// Read the algorithm used to hash new tokens.
+	flag.StringVar(&cfg.tokenHash, "token-hash", data.TokenHashSHA256, "Token hashing algorithm (sha256|sha512)")
+
+	// Read the status page secret. If it isn't set, then the status page details are
+	// only shown in development.
+	flag.StringVar(&cfg.statusSecret, "status-secret", "", "Secret for showing the status page details outside of development (secret query parameter)")
+
+	// Read whether missing permission codes stop the application from starting.
+	flag.BoolVar(&cfg.strictPermissions, "strict-permissions", false, "Refuse to start if required permission codes are missing from the database")
+
+	// Read whether the read-only endpoints require an activated account.
+	flag.BoolVar(&cfg.readRequiresActivation, "read-requires-activation", true, "Require an activated account for read-only endpoints")
+
+	// Read whether paths with a trailing slash are redirected. This is on by default,
+	// as clients are often confused by /v1/movies/ being a 404 when /v1/movies works.
+	flag.BoolVar(&cfg.redirectTrailingSlash, "redirect-trailing-slash", true, "Redirect paths with a trailing slash to the path without it (301 for GET/HEAD, 308 otherwise)")
+
+	// Read the request deadline settings. By default requests have no deadline unless
+	// the client sends an X-Request-Timeout header.
+	flag.DurationVar(&cfg.requestTimeout.fallback, "request-timeout", 0, "Deadline for requests without an X-Request-Timeout header (0 = none)")
+	flag.DurationVar(&cfg.requestTimeout.max, "request-timeout-max", 30*time.Second, "Maximum deadline a client can request with the X-Request-Timeout header")
+
+	// Read the default genre. By default movies without any genres are rejected.
+	flag.StringVar(&cfg.defaultGenre, "default-genre", "", "Genre for imported movies without genres, and for created movies with ?default_genre=true (empty = none)")
+
+	// Read the request signature settings. No routes require a signature by default.
+	flag.StringVar(&cfg.signature.secret, "signature-secret", "", "Shared secret for HMAC request signatures")
+	flag.DurationVar(&cfg.signature.window, "signature-window", 5*time.Minute, "Maximum difference between a signed timestamp and the current time")
+	flag.Func("signature-routes", `Routes which require an HMAC request signature (comma separated, like "POST /v1/movies/import")`, func(val string) error {
+		cfg.signature.routes = nil
+		for _, route := range strings.Split(val, ",") {
+			route = strings.Join(strings.Fields(route), " ")
+			if route == "" {
+				continue
+			}
+			if method, path, found := strings.Cut(route, " "); !found || method != strings.ToUpper(method) || !strings.HasPrefix(path, "/") {
+				return fmt.Errorf("invalid route %q: must be in the form \"METHOD /path\"", route)
+			}
+			cfg.signature.routes = append(cfg.signature.routes, route)
+		}
+		return nil
+	})
+
+	// Read whether requests without a User-Agent header are rejected.
+	flag.BoolVar(&cfg.requireUserAgent, "require-user-agent", false, "Reject requests without a User-Agent header (healthchecks are exempt)")
+
+	// Read the maximum number of movie event stream clients.
+	flag.IntVar(&cfg.sseMaxClients, "sse-max-clients", 100, "Maximum number of concurrent movie event stream clients")
+
+	// Read the path to the genre synonyms file. If it isn't set, the embedded list of
+	// synonyms is used.
+	flag.StringVar(&cfg.genreSynonymsFile, "genre-synonyms", "", "Path to a file of genre synonyms (synonym = genre per line) to use instead of the built-in list")
+
+	// Read the status code to use for duplicate email registrations.
+	flag.IntVar(&cfg.duplicateEmailStatus, "duplicate-email-status", http.StatusUnprocessableEntity, "HTTP status for duplicate email registrations (422|409)")
+
+	// Read the security header settings. HSTS and the HTTPS redirect are only useful
+	// when the API is served over TLS, so both are disabled by default.
+	flag.BoolVar(&cfg.secure.hsts, "hsts", false, "Send the Strict-Transport-Security header")
+	flag.StringVar(&cfg.secure.csp, "csp", "default-src 'none'; frame-ancestors 'none'", "Content-Security-Policy header value (empty to disable)")
+	flag.BoolVar(&cfg.secure.httpsRedirect, "https-redirect", false, "Redirect plain HTTP requests to HTTPS")
+	flag.Func("trusted-proxies", "Reverse proxy IPs or CIDR ranges whose forwarding headers are trusted (space separated)", func(val string) error {
+		prefixes, err := parsePrefixes(val)
+		if err != nil {
+			return err
+		}
+		cfg.secure.trustedProxies = prefixes
+		return nil
+	})
+
+	// Read the password validation policy for new and changed passwords.
+	flag.StringVar(&cfg.passwordPolicy, "password-policy", data.PasswordPolicyBasic, "Password validation policy (basic|strong)")
+
+	// Read the language of the base movie fields, which is sent when there's no
+	// translation for the client's preferred language.
+	flag.StringVar(&cfg.defaultLanguage, "default-language", "en", "Language of the base movie fields")
+
+	// Read the movie list and search settings.
+	flag.StringVar(&cfg.moviesDefaultSort, "movies-default-sort", "id", "Default sort for listing movies (e.g. id, -year, -created_at)")
+	flag.StringVar(&cfg.searchMode, "search-mode", data.SearchModeFullText, "Movie title search mode (fulltext|like)")
+	flag.IntVar(&cfg.maxQueryGenres, "max-query-genres", 20, "Maximum number of values in the genres query parameter")
+
+	// Read the movie title settings.
+	flag.BoolVar(&cfg.uniqueTitles, "unique-titles", false, "Reject movies with the same title as another movie (ignoring case)")
+	flag.BoolVar(&cfg.regenerateSlugs, "regenerate-slugs", false, "Regenerate movie slugs when titles are updated (breaks existing links)")
+
+	// Read the JSON request body limits. Both are disabled by default.
+	flag.IntVar(&cfg.json.maxDepth, "json-max-depth", 0, "Maximum nesting depth of JSON request bodies (0 = unlimited)")
+	flag.IntVar(&cfg.json.maxArrayLength, "json-max-array-length", 0, "Maximum number of elements in JSON request body arrays (0 = unlimited)")
+
+	// Read the response format settings.
+	flag.StringVar(&cfg.errorFormat, "error-format", "simple", "Error response format (simple|problem)")
+	flag.StringVar(&cfg.apiFormat, "api-format", "simple", "Response format for the movie read endpoints (simple|jsonapi)")
+	flag.StringVar(&cfg.emptyList, "empty-list", "array", "Response for movie lists with no matches (array|no-content)")
+	flag.StringVar(&cfg.validationErrors, "validation-errors", "map", "Default validation error format (map|list)")
+	flag.BoolVar(&cfg.jsonStringIDs, "json-string-ids", false, "Encode ID fields (id, *_id, *_ids) as JSON strings")
+
+	// Read the maximum request body size for CSV imports, which is larger than the
+	// limit for JSON bodies.
+	flag.Int64Var(&cfg.importMaxBytes, "import-max-bytes", 10_485_760, "Maximum request body size for CSV imports (bytes)")
+
+	// Read the logging and debugging settings.
+	flag.Float64Var(&cfg.logSampleRate, "log-sample-rate", 1, "Fraction of successful requests to write to the access log (0-1)")
+	flag.BoolVar(&cfg.serverTiming, "server-timing", false, "Send the Server-Timing response header with the database and total time")
+	flag.BoolVar(&cfg.debug.logBodies, "debug-log-bodies", false, "Log request and response bodies at DEBUG level (may expose personal data)")
+	flag.IntVar(&cfg.debug.logBodiesLimit, "debug-log-bodies-limit", 4096, "Maximum number of bytes of each body to log")
+
 	// Create a new version boolean flag with the default value of false.
   displayVersion := flag.Bool("version", false, "Display version and exit") 
 
@@ -162,7 +478,209 @@ func main() {
 
 	// Initialize a new structured logger which writes log entries to the standard out
 	// stream.
-	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	// logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	// If body logging is enabled, lower the log level to DEBUG so that the bodies
+	// are actually written to the log.
+	var logOptions *slog.HandlerOptions
+	if cfg.debug.logBodies {
+		logOptions = &slog.HandlerOptions{Level: slog.LevelDebug}
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, logOptions))
+
+	if cfg.debug.logBodies {
+		logger.Warn("logging request and response bodies; do not use this setting in production", "limit", cfg.debug.logBodiesLimit)
+	}
+
+	// Check that the access log sample rate is a fraction.
+	if cfg.logSampleRate < 0 || cfg.logSampleRate > 1 {
+		logger.Error("invalid -log-sample-rate value: must be between 0 and 1", "value", cfg.logSampleRate)
+		os.Exit(1)
+	}
+
+	// Check that the token hashing algorithm is supported.
+	if !slices.Contains(data.TokenHashAlgorithms(), cfg.tokenHash) {
+		logger.Error("invalid -token-hash value: must be one of "+strings.Join(data.TokenHashAlgorithms(), ", "), "value", cfg.tokenHash)
+		os.Exit(1)
+	}
+
+	// Behind a reverse proxy which terminates TLS, the HTTPS redirect only works if
+	// the proxy is in -trusted-proxies, as otherwise every request looks like plain
+	// HTTP and is redirected again.
+	if cfg.secure.httpsRedirect && len(cfg.secure.trustedProxies) == 0 {
+		logger.Warn("-https-redirect is set without -trusted-proxies; requests are only treated as secure if the application terminates TLS itself")
+	}
+
+	// Check that the rate limiter store is supported.
+	if cfg.limiter.store != "memory" && cfg.limiter.store != "db" {
+		logger.Error("invalid -limiter-store value: must be memory or db", "value", cfg.limiter.store)
+		os.Exit(1)
+	}
+
+	// Check that the rate limiter key strategy is supported, and get the function
+	// which extracts the key from each request.
+	limiterKey, err := limiterKeyFunc(cfg.limiter.key, cfg.secure.trustedProxies)
+	if err != nil {
+		logger.Error("invalid -limiter-key value: "+err.Error(), "value", cfg.limiter.key)
+		os.Exit(1)
+	}
+	if strings.HasPrefix(cfg.limiter.key, "header:") {
+		logger.Warn("rate limiting by a request header; the header must be set by a trusted proxy, or clients can pick their own buckets", "value", cfg.limiter.key)
+	}
+
+	// Check that the validation error format is supported.
+	if cfg.validationErrors != "map" && cfg.validationErrors != "list" {
+		logger.Error("invalid -validation-errors value: must be map or list", "value", cfg.validationErrors)
+		os.Exit(1)
+	}
+
+	// Check the SMTP timeout and retry settings.
+	if cfg.smtp.timeout <= 0 {
+		logger.Error("invalid -smtp-timeout value: must be greater than zero", "value", cfg.smtp.timeout)
+		os.Exit(1)
+	}
+	if cfg.smtp.retries < 0 || cfg.smtp.retries > 10 {
+		logger.Error("invalid -smtp-retries value: must be between 0 and 10", "value", cfg.smtp.retries)
+		os.Exit(1)
+	}
+
+	// Check that the genres query limit is positive.
+	if cfg.maxQueryGenres < 1 {
+		logger.Error("invalid -max-query-genres value: must be at least 1", "value", cfg.maxQueryGenres)
+		os.Exit(1)
+	}
+
+	// Check that the default language is a valid language tag.
+	cfg.defaultLanguage = strings.ToLower(cfg.defaultLanguage)
+	if !data.LanguageRX.MatchString(cfg.defaultLanguage) {
+		logger.Error("invalid -default-language value: must be a language tag like en or en-gb", "value", cfg.defaultLanguage)
+		os.Exit(1)
+	}
+
+	// Check that the JSON limits aren't negative.
+	if cfg.json.maxDepth < 0 || cfg.json.maxArrayLength < 0 {
+		logger.Error("invalid -json-max-depth or -json-max-array-length value: must not be negative", "max_depth", cfg.json.maxDepth, "max_array_length", cfg.json.maxArrayLength)
+		os.Exit(1)
+	}
+
+	// Check that the API format is supported.
+	if cfg.apiFormat != "simple" && cfg.apiFormat != "jsonapi" {
+		logger.Error("invalid -api-format value: must be simple or jsonapi", "value", cfg.apiFormat)
+		os.Exit(1)
+	}
+
+	// Check that the empty list response is supported.
+	if cfg.emptyList != "array" && cfg.emptyList != "no-content" {
+		logger.Error("invalid -empty-list value: must be array or no-content", "value", cfg.emptyList)
+		os.Exit(1)
+	}
+
+	// Check that the error format is supported.
+	if cfg.errorFormat != "simple" && cfg.errorFormat != "problem" {
+		logger.Error("invalid -error-format value: must be simple or problem", "value", cfg.errorFormat)
+		os.Exit(1)
+	}
+
+	// Check that the default movie sort is one of the supported sort values, and log
+	// the value in use so that it's clear how unsorted listings are ordered.
+	if !slices.Contains(movieSortSafelist, cfg.moviesDefaultSort) {
+		logger.Error("invalid -movies-default-sort value: must be one of "+strings.Join(movieSortSafelist, ", "), "value", cfg.moviesDefaultSort)
+		os.Exit(1)
+	}
+	// The relevance sort needs a title to search for, which most requests won't have.
+	if strings.TrimPrefix(cfg.moviesDefaultSort, "-") == "relevance" {
+		logger.Error("invalid -movies-default-sort value: relevance can only be used with a title search", "value", cfg.moviesDefaultSort)
+		os.Exit(1)
+	}
+	logger.Info("default movie sort", "sort", cfg.moviesDefaultSort)
+
+	// Check that the title search mode is supported.
+	if !slices.Contains(data.SearchModes(), cfg.searchMode) {
+		logger.Error("invalid -search-mode value: must be one of "+strings.Join(data.SearchModes(), ", "), "value", cfg.searchMode)
+		os.Exit(1)
+	}
+
+	// Check that the password policy is supported.
+	if !slices.Contains(data.PasswordPolicies(), cfg.passwordPolicy) {
+		logger.Error("invalid -password-policy value: must be one of "+strings.Join(data.PasswordPolicies(), ", "), "value", cfg.passwordPolicy)
+		os.Exit(1)
+	}
+
+	// Check that the duplicate email status is one of the two supported values.
+	if cfg.duplicateEmailStatus != http.StatusUnprocessableEntity && cfg.duplicateEmailStatus != http.StatusConflict {
+		logger.Error("invalid -duplicate-email-status value: must be 422 or 409", "value", cfg.duplicateEmailStatus)
+		os.Exit(1)
+	}
+
+	// Check that every default permission is a known permission code.
+	for _, code := range cfg.defaultPermissions {
+		if !slices.Contains(data.PermissionCodes, code) {
+			logger.Error("invalid -default-permissions value: unknown permission code", "value", code)
+			os.Exit(1)
+		}
+	}
+
+	// Make it very obvious in the logs if activation is being bypassed.
+	if cfg.skipActivation {
+		logger.Warn("SKIPPING USER ACTIVATION: new users will be activated immediately and granted write permissions; do not use this setting in production", "env", cfg.env)
+	}
+
+	// Load the genre synonyms from the file, if one was given.
+	if cfg.genreSynonymsFile != "" {
+		synonyms, err := loadGenreSynonyms(cfg.genreSynonymsFile)
+		if err != nil {
+			logger.Error("invalid -genre-synonyms file: "+err.Error(), "path", cfg.genreSynonymsFile)
+			os.Exit(1)
+		}
+		data.SetGenreSynonyms(synonyms)
+		logger.Info("loaded genre synonyms", "path", cfg.genreSynonymsFile, "count", len(synonyms))
+	}
+
+	// Check the request deadline settings. The fallback can't be longer than the
+	// maximum that clients are allowed to ask for.
+	if cfg.requestTimeout.max < time.Millisecond {
+		logger.Error("invalid -request-timeout-max value: must be at least 1ms", "value", cfg.requestTimeout.max)
+		os.Exit(1)
+	}
+	if cfg.requestTimeout.fallback < 0 || cfg.requestTimeout.fallback > cfg.requestTimeout.max {
+		logger.Error("invalid -request-timeout value: must be between 0 and -request-timeout-max", "value", cfg.requestTimeout.fallback)
+		os.Exit(1)
+	}
+
+	// Check that the default genre is one of the canonical genres, and use its
+	// canonical form. This is done after the genre synonyms are loaded, so that a
+	// synonym can be used.
+	if cfg.defaultGenre != "" {
+		genre, ok := data.CanonicalGenre(cfg.defaultGenre)
+		if !ok {
+			logger.Error("invalid -default-genre value: must be one of "+strings.Join(data.Genres, ", "), "value", cfg.defaultGenre)
+			os.Exit(1)
+		}
+		cfg.defaultGenre = genre
+	}
+
+	// Check the request signature settings. Routes can't require a signature unless
+	// there's a secret to check it with.
+	if len(cfg.signature.routes) > 0 && cfg.signature.secret == "" {
+		logger.Error("invalid -signature-routes value: -signature-secret must also be set")
+		os.Exit(1)
+	}
+	if cfg.signature.window < time.Second {
+		logger.Error("invalid -signature-window value: must be at least 1s", "value", cfg.signature.window)
+		os.Exit(1)
+	}
+
+	// Check that the event stream client limit is sensible.
+	if cfg.sseMaxClients < 1 {
+		logger.Error("invalid -sse-max-clients value: must be at least 1", "value", cfg.sseMaxClients)
+		os.Exit(1)
+	}
+
+	// Derive the application_name for the database connections from the environment
+	// and version, unless one was given explicitly.
+	if cfg.db.appName == "" {
+		cfg.db.appName = fmt.Sprintf("greenlight-%s-%s", cfg.env, version)
+	}
 
 	// Call the openDB() helper function (see below) to create the connection pool,
 	// passing in the config struct. If this returns an error, we log it and exit the
@@ -179,7 +697,18 @@ func main() {
 
 	// Also log a message to say that the connection pool has been successfully
 	// established.
-	logger.Info("database connection pool established")
+	// logger.Info("database connection pool established")
+	// logger.Info("database connection pool established", "application_name", cfg.db.appName)
+
+	// Include the effective pool settings, so that it's clear from the logs how the
+	// connections are being managed.
+	logger.Info("database connection pool established",
+		"application_name", cfg.db.appName,
+		"max_open_conns", cfg.db.maxOpenConns,
+		"max_idle_conns", cfg.db.maxIdleConns,
+		"max_idle_time", cfg.db.maxIdleTime.String(),
+		"max_conn_lifetime", cfg.db.maxLifetime.String(),
+	)
 
 	// Publish a new "version" variable in the expvar handler containing our application
 	// version number (currently the constant "1.0.0").
@@ -208,13 +737,36 @@ func main() {
 
 	// Initialize a new Mailer instance using the settings from the command line
 	// flags, and add it to the application struct.
+	// Configure the token model to hash new tokens with the chosen algorithm.
+	models := data.NewModels(db)
+	models.Tokens.HashAlgorithm = cfg.tokenHash
+	models.Movies.RegenerateSlugs = cfg.regenerateSlugs
+	models.Movies.SearchMode = cfg.searchMode
+
+	backgroundCtx, cancelBackground := context.WithCancel(context.Background())
+
 	app := &application{
 		config: cfg,
 		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		models: models,
+		// mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		mailer:           mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender, cfg.smtp.timeout, cfg.smtp.retries),
+		backgroundCtx:    backgroundCtx,
+		cancelBackground: cancelBackground,
+		scheduler:        scheduler.New(logger),
+		movieEvents:      newEventBroker(cfg.sseMaxClients),
+		tasks:            newTaskRegistry(),
+		startedAt:        time.Now(),
+		limiterKey:       limiterKey,
 	}
 
+	// Register the periodic background jobs, and start the scheduler in the background
+	// so that it's stopped (and waited for) when the application shuts down.
+	app.registerJobs()
+	app.background(func() {
+		app.scheduler.Run(app.backgroundCtx)
+	})
+
 	/*
 		// Declare a new servemux and add a /v1/healthcheck route which dispatches requests
 		// to the healthcheckHandler method (which we will create in a moment).
@@ -259,11 +811,52 @@ func main() {
 func openDB(cfg config) (*sql.DB, error) {
 	// Use sql.Open() to create an empty connection pool, using the DSN from the config
 	// struct.
-	db, err := sql.Open("postgres", cfg.db.dsn)
+	// db, err := sql.Open("postgres", cfg.db.dsn)
+
+	// Add the application_name to the DSN, so that DBAs can see which service and
+	// version each connection belongs to.
+	dsn, err := dsnWithAppName(cfg.db.dsn, cfg.db.appName)
+	if err != nil {
+		return nil, err
+	}
+
+	// With -unique-titles, turn on the unique title check for every connection. The
+	// setting is sent when the connection starts, so it also applies to the queries
+	// run inside transactions.
+	if cfg.uniqueTitles {
+		dsn, err = dsnWithParam(dsn, "greenlight.unique_titles", "on")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Use UTC for every connection, so that the timestamps read from the database are
+	// already in UTC and writeJSON() only needs to convert them if the client asks
+	// for another time zone.
+	dsn, err = dsnWithParam(dsn, "timezone", "UTC")
+	if err != nil {
+		return nil, err
+	}
+
+	// db, err := sql.Open("postgres", dsn)
+	// if err != nil {
+	//   return nil, err
+	// }
+
+	// With -server-timing, wrap the connections so that the time spent on the
+	// database can be added up for each request.
+	connector, err := pq.NewConnector(dsn)
 	if err != nil {
 		return nil, err
 	}
 
+	var db *sql.DB
+	if cfg.serverTiming {
+		db = sql.OpenDB(data.NewTimingConnector(connector))
+	} else {
+		db = sql.OpenDB(connector)
+	}
+
 	// Set the maximum number of open (in-use + idle) connections in the pool. Note that
 	// passing a value less than or equal to 0 will mean there is no limit.
 	db.SetMaxOpenConns(cfg.db.maxOpenConns)
@@ -276,6 +869,11 @@ func openDB(cfg config) (*sql.DB, error) {
 	// than or equal to 0 will mean that connections are not closed due to their idle time.
 	db.SetConnMaxIdleTime(cfg.db.maxIdleTime)
 
+	// Set the maximum lifetime for connections in the pool. Connections older than this
+	// are closed before being reused. Again, passing a duration less than or equal to 0
+	// will mean that connections are not closed due to their age.
+	db.SetConnMaxLifetime(cfg.db.maxLifetime)
+
 	// Create a context with a 5-second timeout deadline.
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -294,3 +892,51 @@ func openDB(cfg config) (*sql.DB, error) {
 	// Return the sql.DB connection pool.
 	return db, nil
 }
+
+// The dsnWithAppName() function sets the application_name parameter in a PostgreSQL
+// DSN, replacing any value which is already there. If the name is empty, then the DSN
+// is returned unchanged.
+func dsnWithAppName(dsn, name string) (string, error) {
+	if name == "" {
+		return dsn, nil
+	}
+
+	return dsnWithParam(dsn, "application_name", name)
+}
+
+// The dsnWithParam() function sets a parameter in a PostgreSQL DSN, replacing any
+// value which is already there. Both the URL form (postgres://...) and the key=value
+// form of DSN are supported. Parameters which the driver doesn't recognize are sent
+// to the server as settings when the connection starts.
+func dsnWithParam(dsn, key, value string) (string, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", fmt.Errorf("invalid db-dsn: %w", err)
+		}
+
+		q := u.Query()
+		q.Set(key, value)
+		u.RawQuery = q.Encode()
+
+		return u.String(), nil
+	}
+
+	// In the key=value form, values are quoted with single quotes, and any single
+	// quotes or backslashes in them are escaped with a backslash. When the same key
+	// appears more than once, the last value is used, so it's enough to append it.
+	escaped := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+
+	return strings.TrimSpace(dsn + " " + key + "='" + escaped + "'"), nil
+}
+
+// The loadGenreSynonyms() function reads the genre synonyms from a file.
+func loadGenreSynonyms(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return data.ParseGenreSynonyms(f)
+}
@@ -1,15 +1,30 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"expvar"
 	"fmt"
+	"io"
+	"math"
+	mathrand "math/rand/v2"
 	"net/http"
+	"net/netip"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/julienschmidt/httprouter"
 	"github.com/tomasen/realip"
 	"golang.org/x/time/rate"
 	"greenlight.nicolasleigh.net/internal/data"
@@ -40,6 +55,41 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
+// The secureHeaders() middleware adds security-related headers to every response,
+// and optionally redirects plain HTTP requests to their HTTPS equivalent. The
+// Strict-Transport-Security header is only sent on HTTPS responses, as browsers
+// ignore it over plain HTTP.
+func (app *application) secureHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A request is considered secure if the application terminated TLS itself, or
+		// if a reverse proxy in front of us (like Caddy) terminated TLS and told us so
+		// via the X-Forwarded-Proto header. The header is only believed if the request
+		// came from one of the -trusted-proxies, as anyone else could set it. Checking
+		// r.TLS first means that we never redirect requests which arrived directly over
+		// HTTPS, so there's no risk of a redirect loop.
+		secure := r.TLS != nil || (app.fromTrustedProxy(r) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https"))
+
+		if app.config.secure.httpsRedirect && !secure {
+			target := "https://" + r.Host + r.URL.RequestURI()
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("X-Frame-Options", "DENY")
+
+		if app.config.secure.csp != "" {
+			w.Header().Set("Content-Security-Policy", app.config.secure.csp)
+		}
+
+		if app.config.secure.hsts && secure {
+			w.Header().Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 /*
 // Global Rate Limiting
 func (app *application) rateLimit(next http.Handler) http.Handler {
@@ -110,7 +160,38 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 */
 
 // IP-based Rate Limiting - Deleting old limiters
+// func (app *application) rateLimit(next http.Handler) http.Handler {
+
+// Count the requests which skip the rate limiter because they come from an exempt
+// client. They are still counted by the metrics() middleware as normal, but this
+// lets us see how much of the traffic is from trusted clients.
+var totalRateLimitExemptRequests = expvar.NewInt("total_rate_limit_exempt_requests")
+
+// The rateLimit() middleware limits the requests using the -limiter-key strategy. It
+// runs before authenticate(), so when limiting by user it limits by IP address
+// instead, and the per-user limit is added after authenticate() by rateLimitUser().
+// That way requests with bad credentials are still limited.
 func (app *application) rateLimit(next http.Handler) http.Handler {
+	key := app.limiterKey
+	if app.config.limiter.key == "user" {
+		key = app.clientIP
+	}
+
+	return app.limitRequests(next, key, true)
+}
+
+// The rateLimitUser() middleware adds the per-user limit when limiting by user. It
+// must run after authenticate(). Anonymous requests aren't limited again, as the IP
+// limit in rateLimit() already covers them.
+func (app *application) rateLimitUser(next http.Handler) http.Handler {
+	return app.limitRequests(next, app.limiterKey, false)
+}
+
+// The limitRequests() method returns middleware which keeps a token bucket for each
+// key given by limiterKey. Requests with an empty key aren't limited. Requests from
+// exempt clients are only counted in the exempt requests metric if countExempt is
+// true, so that they aren't counted twice when there are two limiters.
+func (app *application) limitRequests(next http.Handler, limiterKey func(r *http.Request) string, countExempt bool) http.Handler {
 	// Define a client struct to hold the rate limiter and last seen time for each
 	// client.
 	type client struct {
@@ -136,17 +217,24 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 
 			// Loop through all clients. If they haven't been seen within the last three
 			// minutes, delete the corresponding entry from the map.
-			for ip, client := range clients {
+			for key, client := range clients {
 				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
+					delete(clients, key)
 				}
 			}
 
 			// Importantly, unlock the mutex when the cleanup is complete.
 			mu.Unlock()
+
+			// The stale buckets in the database (if they're stored there) are removed
+			// by a scheduled job, which is registered in main().
 		}
 	}()
 
+	// Record whether the database store is currently unavailable, so that we only log
+	// when the limiter starts and stops failing open, rather than on every request.
+	var degraded atomic.Bool
+
 	/*
 	  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 	    ip, _, err := net.SplitHostPort(r.RemoteAddr)
@@ -187,39 +275,130 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 			// }
 
       // Use the realip.FromRequest() function to get the client's real IP address.
-      ip := realip.FromRequest(r)  
+      // ip := realip.FromRequest(r)  
 
-			mu.Lock()
+			// Use the clientIP() helper instead, which only believes the forwarding
+			// headers from -trusted-proxies, so that clients can't claim to be exempt.
+			ip := app.clientIP(r)
 
-			if _, found := clients[ip]; !found {
-				clients[ip] = &client{
-					// Use the requests-per-second and burst values from the config
-					// struct.
-					limiter: rate.NewLimiter(rate.Limit(app.config.limiter.rps), app.config.limiter.burst),
+			// Skip the rate limiter entirely for trusted clients, like health probes
+			// and partner integrations.
+			if app.limiterExempt(ip) {
+				if countExempt {
+					totalRateLimitExemptRequests.Add(1)
 				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Pick the bucket for the request. The exemptions are still by IP address,
+			// whatever the key is.
+			key := limiterKey(r)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
 			}
 
-			clients[ip].lastSeen = time.Now()
+			var (
+				allowed bool
+				tokens  float64
+			)
+
+			switch app.config.limiter.store {
+			case "db":
+				// Take a token from the client's bucket in the database, so that the
+				// limit is shared across all instances of the application. If the
+				// database is unavailable we fail open and allow the request, as it's
+				// better to briefly stop limiting than to reject every request.
+				var err error
+				allowed, tokens, err = app.requestModels(r).RateLimits.Take(key, app.config.limiter.rps, app.config.limiter.burst)
+				if err != nil {
+					if !degraded.Swap(true) {
+						app.logger.Warn("rate limit store unavailable, allowing requests", "error", err.Error())
+					}
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				if degraded.Swap(false) {
+					app.logger.Info("rate limit store available again")
+				}
+
+			default:
+				mu.Lock()
+
+				if _, found := clients[key]; !found {
+					clients[key] = &client{
+						// Use the requests-per-second and burst values from the config
+						// struct.
+						limiter: rate.NewLimiter(rate.Limit(app.config.limiter.rps), app.config.limiter.burst),
+					}
+				}
+
+				clients[key].lastSeen = time.Now()
+
+				// Read the number of tokens left in the bucket straight after calling
+				// Allow(), while we still hold the lock, so that the rate limit headers
+				// reflect the state of the limiter for this request.
+				allowed = clients[key].limiter.Allow()
+				tokens = clients[key].limiter.Tokens()
 
-			if !clients[ip].limiter.Allow() {
 				mu.Unlock()
+			}
+
+			app.setRateLimitHeaders(w, tokens)
+
+			if !allowed {
+				// Let the client know how many seconds it should wait until a token
+				// will be available again.
+				w.Header().Set("Retry-After", strconv.Itoa(app.secondsUntilTokens(tokens, 1)))
 				app.rateLimitExceededResponse(w, r)
 				return
 			}
-
-			mu.Unlock()
 		}
 
 		next.ServeHTTP(w, r)
 	})
 }
 
+// The setRateLimitHeaders() method adds the X-RateLimit-* headers to the response,
+// based on the number of tokens currently available in the client's bucket. The
+// limit is the bucket size (burst), the remaining count is the number of whole
+// tokens left (which is never reported as negative), and the reset value is the
+// number of seconds until the bucket will be completely full again.
+func (app *application) setRateLimitHeaders(w http.ResponseWriter, tokens float64) {
+	remaining := int(math.Max(0, math.Floor(tokens)))
+
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(app.config.limiter.burst))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(app.secondsUntilTokens(tokens, float64(app.config.limiter.burst))))
+}
+
+// The secondsUntilTokens() method returns the number of whole seconds (rounded up)
+// until the bucket refills from the given number of tokens to the target number,
+// based on the configured requests-per-second refill rate.
+func (app *application) secondsUntilTokens(tokens, target float64) int {
+	if tokens >= target || app.config.limiter.rps <= 0 {
+		return 0
+	}
+
+	return int(math.Ceil((target - tokens) / app.config.limiter.rps))
+}
+
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Add the "Vary: Authorization" header to the response. This indicates to any
 		// caches that the response may vary based on the value of the Authorization
 		// header in the request.
 		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "X-API-Key")
+
+		// If the request contains an X-API-Key header, authenticate the request using
+		// the API key instead of a bearer token.
+		if r.Header.Get("X-API-Key") != "" {
+			app.authenticateAPIKey(next, w, r)
+			return
+		}
 
 		// Retrieve the value of the Authorization header from the request. This will
 		// return the empty string "" if there is no such header found.
@@ -264,7 +443,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// again calling the invalidAuthenticationTokenResponse() helper if no
 		// matching record was found. IMPORTANT: Notice that we are using
 		// ScopeAuthentication as the first parameter here.
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, err := app.requestModels(r).Users.GetForToken(data.ScopeAuthentication, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -285,6 +464,47 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 	})
 }
 
+// The authenticateAPIKey() method looks up the user associated with the API key in
+// the X-API-Key header, and adds both the user and the API key to the request
+// context before calling the next handler in the chain.
+func (app *application) authenticateAPIKey(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	keyPlaintext := r.Header.Get("X-API-Key")
+
+	v := validator.New()
+
+	if data.ValidateAPIKeyPlaintext(v, keyPlaintext); !v.Valid() {
+		app.invalidAPIKeyResponse(w, r)
+		return
+	}
+
+	key, err := app.requestModels(r).APIKeys.GetForPlaintext(keyPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAPIKeyResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.requestModels(r).Users.Get(key.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAPIKeyResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetAPIKey(r, key)
+
+	next.ServeHTTP(w, r)
+}
+
 /*
 func (app *application) requireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
   return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -348,12 +568,23 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 // Note that the first parameter for the middleware function is the permission code
 // that we require the user to have.
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
-	fn := func(w http.ResponseWriter, r *http.Request) {
+	fn := app.checkPermission(code, next)
+
+	// Wrap this with the requireActivatedUser() middleware before returning it.
+	return app.requireActivatedUser(fn)
+}
+
+// The checkPermission() helper returns a handler which checks that the user has the
+// permission, and calls next if they do. It doesn't check that the request is
+// authenticated, so it must always be wrapped by requirePermission() or
+// requireReadPermission() rather than used directly.
+func (app *application) checkPermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		// Retrieve the user from the request context.
 		user := app.contextGetUser(r)
 
 		// Get the slice of permissions for the user.
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		permissions, err := app.requestModels(r).Permissions.GetAllForUser(user.ID)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -366,13 +597,36 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 			return
 		}
 
+		// If the request was authenticated with an API key, then the key itself must
+		// also have been granted the permission. This means that a key can never do
+		// more than the user it belongs to.
+		if key := app.contextGetAPIKey(r); key != nil && !key.Permissions.Include(code) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
 		// Otherwise they have the required permission so we call the next handler in
 		// the chain.
 		next.ServeHTTP(w, r)
 	}
+}
 
-	// Wrap this with the requireActivatedUser() middleware before returning it.
-	return app.requireActivatedUser(fn)
+// The requireReadPermission() middleware is the same as requirePermission(), but for
+// read-only endpoints, where the user only needs to be activated if the
+// -read-requires-activation flag is set.
+func (app *application) requireReadPermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	return app.requireActivatedUserForReads(app.checkPermission(code, next))
+}
+
+// The requireActivatedUserForReads() middleware is used on read-only endpoints. It
+// checks that the user is activated if the -read-requires-activation flag is set, and
+// otherwise only that they are authenticated.
+func (app *application) requireActivatedUserForReads(next http.HandlerFunc) http.HandlerFunc {
+	if app.config.readRequiresActivation {
+		return app.requireActivatedUser(next)
+	}
+
+	return app.requireAuthenticatedUser(next)
 }
 
 /*
@@ -435,7 +689,12 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 						// Set the necessary preflight response headers, as discussed
 						// previously.
 						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+						// w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+
+						// Allow the Content-Encoding header too, so that browsers can
+						// send gzipped request bodies, and the X-Request-Timeout header
+						// so that they can set a deadline.
+						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Content-Encoding, X-Request-Timeout")
 
 						// Write the headers along with a 200 OK status and return from
 						// the middleware with no further action.
@@ -550,3 +809,766 @@ func (app *application) metrics(next http.Handler) http.Handler {
 		totalProcessingTimeMicroseconds.Add(duration)
 	})
 }
+
+// The apiVersion() middleware looks at the first segment of the request path. If it
+// looks like an API version (a "v" followed by digits), then it must be one of the
+// supported apiVersions, otherwise we send a 404 Not Found response. Supported
+// versions are stored in the request context. Other paths are passed on unchanged.
+func (app *application) apiVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		segment, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+		if isVersionSegment(segment) {
+			if !slices.Contains(apiVersions, segment) {
+				app.notFoundResponse(w, r)
+				return
+			}
+
+			r = app.contextSetAPIVersion(r, segment)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The isVersionSegment() helper reports whether a path segment is in the format of
+// an API version, like "v1" or "v12".
+func isVersionSegment(segment string) bool {
+	digits, found := strings.CutPrefix(segment, "v")
+	if !found || digits == "" {
+		return false
+	}
+
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// The limiterExempt() helper reports whether the client IP address is in one of the
+// -limiter-exempt-ips ranges.
+func (app *application) limiterExempt(ip string) bool {
+	if len(app.config.limiter.exemptIPs) == 0 {
+		return false
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, prefix := range app.config.limiter.exemptIPs {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The fromTrustedProxy() helper reports whether the request came directly from one
+// of the -trusted-proxies.
+func (app *application) fromTrustedProxy(r *http.Request) bool {
+	return fromTrustedProxy(r, app.config.secure.trustedProxies)
+}
+
+// The clientIP() helper returns the IP address of the client which made the request,
+// as described for the clientIP() function.
+func (app *application) clientIP(r *http.Request) string {
+	return clientIP(r, app.config.secure.trustedProxies)
+}
+
+// The fromTrustedProxy() function reports whether the request came directly from one
+// of the trusted proxies. It uses the address of the connection, rather than
+// realip.FromRequest(), because the forwarding headers can be set by the client.
+func fromTrustedProxy(r *http.Request, trustedProxies []netip.Prefix) bool {
+	if len(trustedProxies) == 0 {
+		return false
+	}
+
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := addrPort.Addr().Unmap()
+
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The clientIP() function returns the IP address of the client which made the
+// request. The X-Forwarded-For and X-Real-IP headers are only believed, using
+// realip.FromRequest(), if the request came from one of the trusted proxies. Otherwise
+// anyone could pick their own address, to get a new rate limit bucket or to pass as
+// one of the -limiter-exempt-ips, so the address of the connection is used instead.
+func clientIP(r *http.Request, trustedProxies []netip.Prefix) string {
+	if fromTrustedProxy(r, trustedProxies) {
+		return realip.FromRequest(r)
+	}
+
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return addrPort.Addr().Unmap().String()
+}
+
+// The limiterKeyFunc() function returns the function which the rate limiter uses to
+// pick the bucket for a request, for the given -limiter-key value. The supported
+// strategies are:
+//
+//   - "ip" limits each client IP address. This is the default.
+//   - "user" limits each client IP address before authentication, and then each
+//     authenticated user, across all of their tokens and API keys. The returned
+//     function gives the per-user key, which is empty for anonymous requests, and
+//     routes() adds the rateLimitUser() middleware after authenticate() for it.
+//   - "header:<name>" limits by the value of the named request header, like
+//     "header:X-Client-Id". Requests without the header are limited by IP address.
+//     The value is hashed, so that secrets like API keys aren't kept in the buckets.
+//     As clients could otherwise get a new bucket just by changing the value, this
+//     must only be used behind a trusted proxy which sets the header itself.
+//
+// The user and header keys are prefixed, so that they can't collide with an IP
+// address or with each other. IP addresses are found with clientIP(), using the
+// trustedProxies.
+func limiterKeyFunc(value string, trustedProxies []netip.Prefix) (func(r *http.Request) string, error) {
+	ip := func(r *http.Request) string {
+		return clientIP(r, trustedProxies)
+	}
+
+	switch {
+	case value == "ip":
+		return ip, nil
+
+	case value == "user":
+		return func(r *http.Request) string {
+			user, ok := r.Context().Value(userContextKey).(*data.User)
+			if !ok || user.IsAnonymous() {
+				return ""
+			}
+			return "user:" + strconv.FormatInt(user.ID, 10)
+		}, nil
+
+	case strings.HasPrefix(value, "header:"):
+		name := strings.TrimPrefix(value, "header:")
+		if name == "" || strings.ContainsAny(name, " \t:") {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		name = http.CanonicalHeaderKey(name)
+
+		return func(r *http.Request) string {
+			header := r.Header.Get(name)
+			if header == "" {
+				return ip(r)
+			}
+			hash := sha256.Sum256([]byte(header))
+			return "header:" + name + ":" + hex.EncodeToString(hash[:])
+		}, nil
+
+	default:
+		return nil, errors.New("must be ip, user or header:<name>")
+	}
+}
+
+// The trackInFlight() middleware keeps count of the requests which are currently
+// being processed, so that the number still draining can be logged during a graceful
+// shutdown. The counter is atomic, so it's safe to update from every request without
+// any locking.
+func (app *application) trackInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.inFlight.Add(1)
+		defer app.inFlight.Add(-1)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The requestID() middleware makes sure that every request has an ID, which is
+// included in the logs and sent back in the X-Request-Id response header so that
+// problems can be correlated. If the client (or a proxy in front of us) sent a
+// sensible X-Request-Id header we reuse it, otherwise we generate a random ID.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+
+		if !validRequestID(id) {
+			randomBytes := make([]byte, 16)
+
+			_, err := rand.Read(randomBytes)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			id = hex.EncodeToString(randomBytes)
+		}
+
+		w.Header().Set("X-Request-Id", id)
+
+		r = app.contextSetRequestID(r, id)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The logRequest() middleware writes an access log entry for each request once it has
+// been handled. With a -log-sample-rate below 1, only that fraction of the successful
+// (2xx) responses are logged, chosen at random, while every other response is still
+// logged so that errors are never missed. It runs inside the requestID() middleware,
+// so every request gets an ID whether or not it's logged, and outside recoverPanic(),
+// so requests which panic are logged with their 500 status.
+func (app *application) logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		mw := newMetricsResponseWriter(w)
+
+		next.ServeHTTP(mw, r)
+
+		success := mw.statusCode >= 200 && mw.statusCode < 300
+		if success && app.config.logSampleRate < 1 && mathrand.Float64() >= app.config.logSampleRate {
+			return
+		}
+
+		app.logger.Info("request",
+			"request_id", app.contextGetRequestID(r),
+			"ip", app.clientIP(r),
+			"method", r.Method,
+			"uri", redactURI(r),
+			"status", mw.statusCode,
+			"duration", time.Since(start),
+		)
+	})
+}
+
+// The validRequestID() helper reports whether a request ID sent by the client is safe
+// to reuse: it must be between 1 and 128 characters long, and only contain printable
+// ASCII characters other than spaces.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// The limitedBuffer type is an io.Writer which keeps up to limit bytes of the data
+// written to it, and silently discards the rest. It's used to capture the start of
+// request and response bodies for logging without holding the whole body in memory.
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (lb *limitedBuffer) Write(p []byte) (int, error) {
+	remaining := lb.limit - lb.buf.Len()
+
+	if len(p) > remaining {
+		lb.buf.Write(p[:max(remaining, 0)])
+		lb.truncated = true
+	} else {
+		lb.buf.Write(p)
+	}
+
+	return len(p), nil
+}
+
+// The bodyCaptureResponseWriter type wraps an existing http.ResponseWriter, copying
+// the start of the response body into a limitedBuffer and recording the status code.
+type bodyCaptureResponseWriter struct {
+	http.ResponseWriter
+	body       *limitedBuffer
+	statusCode int
+}
+
+func (bw *bodyCaptureResponseWriter) WriteHeader(statusCode int) {
+	if bw.statusCode == 0 {
+		bw.statusCode = statusCode
+	}
+	bw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (bw *bodyCaptureResponseWriter) Write(b []byte) (int, error) {
+	if bw.statusCode == 0 {
+		bw.statusCode = http.StatusOK
+	}
+	bw.body.Write(b)
+	return bw.ResponseWriter.Write(b)
+}
+
+func (bw *bodyCaptureResponseWriter) Unwrap() http.ResponseWriter {
+	return bw.ResponseWriter
+}
+
+// The query string parameters which hold secrets, like the status page secret, and
+// so have their values redacted in the logs.
+var sensitiveQueryParams = []string{"secret"}
+
+// The redactURI() helper returns the request URI for a log entry, with the values of
+// any sensitive query string parameters replaced by "[REDACTED]".
+func redactURI(r *http.Request) string {
+	query := r.URL.Query()
+	redacted := false
+
+	for _, name := range sensitiveQueryParams {
+		if query.Has(name) {
+			query.Set(name, "[REDACTED]")
+			redacted = true
+		}
+	}
+
+	if !redacted {
+		return r.URL.RequestURI()
+	}
+
+	u := *r.URL
+	u.RawQuery = query.Encode()
+	return u.RequestURI()
+}
+
+// The sensitiveFieldRX regular expression matches JSON string values for keys which
+// look sensitive, like "password", "token", "authentication_token" and "key". The
+// first group captures the key so that it can be kept while the value is replaced.
+var sensitiveFieldRX = regexp.MustCompile(`("(?i:[^"]*(?:password|token|secret)[^"]*|key|[^"]*_key)"\s*:\s*)"(?:[^"\\]|\\.)*"?`)
+
+// The redactBody() helper replaces the values of sensitive fields in a (possibly
+// truncated) JSON body with "[REDACTED]".
+func redactBody(body []byte) string {
+	return sensitiveFieldRX.ReplaceAllString(string(body), `$1"[REDACTED]"`)
+}
+
+// The logBodies() middleware logs the request and response bodies at the DEBUG level,
+// truncated to -debug-log-bodies-limit bytes and with sensitive fields redacted. The
+// request body is captured as the handler reads it, so the handler still sees the
+// whole body. Because bodies can contain personal data, this middleware is only
+// added to the chain when the -debug-log-bodies flag is set.
+func (app *application) logBodies(next http.Handler) http.Handler {
+	if !app.config.debug.logBodies {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestBody := &limitedBuffer{limit: app.config.debug.logBodiesLimit}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r.Body, requestBody), r.Body}
+
+		bw := &bodyCaptureResponseWriter{
+			ResponseWriter: w,
+			body:           &limitedBuffer{limit: app.config.debug.logBodiesLimit},
+		}
+
+		next.ServeHTTP(bw, r)
+
+		requestID := app.contextGetRequestID(r)
+
+		app.logger.Debug("request body",
+			"request_id", requestID,
+			"method", r.Method,
+			"uri", redactURI(r),
+			"body", redactBody(requestBody.buf.Bytes()),
+			"truncated", requestBody.truncated,
+		)
+
+		app.logger.Debug("response body",
+			"request_id", requestID,
+			"status", bw.statusCode,
+			"body", redactBody(bw.body.buf.Bytes()),
+			"truncated", bw.body.truncated,
+		)
+	})
+}
+
+// The decompressRequest() middleware transparently decompresses request bodies which
+// are sent with a "Content-Encoding: gzip" header, so that handlers always read the
+// uncompressed body. Because the body is replaced before any handler runs, the
+// http.MaxBytesReader() limits applied by readJSON() and the import handlers are
+// enforced on the decompressed stream rather than the compressed size, which
+// protects against zip bombs. Requests using any other encoding are rejected with a
+// 415 Unsupported Media Type response.
+func (app *application) decompressRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+		case "", "identity":
+			next.ServeHTTP(w, r)
+
+		case "gzip", "x-gzip":
+			// Creating the gzip.Reader reads the gzip header, so a body which isn't
+			// gzipped at all is caught here.
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				app.badRequestResponse(w, r, errors.New("body is not valid gzip data"))
+				return
+			}
+
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{zr, r.Body}
+
+			// The body is no longer encoded, and its length isn't known in advance.
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+
+			next.ServeHTTP(w, r)
+
+		default:
+			app.unsupportedMediaTypeResponse(w, r, "the request body must be uncompressed or use the gzip content encoding")
+		}
+	})
+}
+
+// The requireUserAgent() middleware rejects requests which don't have a User-Agent
+// header with a 400 Bad Request response, if the -require-user-agent flag is set.
+// Legitimate clients send one, so this is a cheap way to turn away some bots. The
+// healthcheck endpoints are exempt, so that probes which don't send the header still
+// work.
+func (app *application) requireUserAgent(next http.Handler) http.Handler {
+	if !app.config.requireUserAgent {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") == "" && !isHealthcheckPath(r.URL.Path) {
+			app.logger.Debug("rejected request without user agent",
+				"request_id", app.contextGetRequestID(r),
+				"ip", app.clientIP(r),
+				"method", r.Method,
+				"uri", redactURI(r),
+			)
+			app.badRequestResponse(w, r, errors.New("the User-Agent header must be provided"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The isHealthcheckPath() function reports whether the path is the healthcheck
+// endpoint for one of the supported API versions.
+func isHealthcheckPath(path string) bool {
+	for _, version := range apiVersions {
+		if path == "/"+version+"/healthcheck" {
+			return true
+		}
+	}
+	return false
+}
+
+// The requestTimeout() middleware sets a deadline on the request context, which the
+// models use as the parent context for their queries. Clients can send their own
+// budget in milliseconds in the X-Request-Timeout header, which is clamped to the
+// -request-timeout-max value. Otherwise the -request-timeout value is used, and if
+// that's 0 then no deadline is set. The long-lived endpoints are exempt, as they're
+// expected to run for longer than any request timeout.
+func (app *application) requestTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isLongLivedPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		timeout := app.config.requestTimeout.fallback
+
+		if header := r.Header.Get("X-Request-Timeout"); header != "" {
+			ms, err := strconv.ParseInt(header, 10, 64)
+			if err != nil || ms < 1 {
+				app.badRequestResponse(w, r, errors.New("the X-Request-Timeout header must be a positive integer number of milliseconds"))
+				return
+			}
+
+			// Compare in milliseconds before converting, so that very large values
+			// can't overflow the time.Duration.
+			timeout = app.config.requestTimeout.max
+			if ms < timeout.Milliseconds() {
+				timeout = time.Duration(ms) * time.Millisecond
+			}
+		}
+
+		if timeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+
+			r = r.WithContext(ctx)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The longLivedPaths are the endpoints, without the API version prefix, which hold
+// the connection open for a long time: the movie event stream, CSV imports and the
+// ANALYZE maintenance task. The event stream runs until the client disconnects, and
+// the others are bounded by the -import-max-bytes limit and data.MaintenanceTimeout.
+var longLivedPaths = []string{"/movies/events", "/movies/import.csv", "/admin/maintenance/analyze"}
+
+// The isLongLivedPath() function reports whether the path is one of the long-lived
+// endpoints for one of the supported API versions.
+func isLongLivedPath(path string) bool {
+	for _, version := range apiVersions {
+		for _, longLived := range longLivedPaths {
+			if path == "/"+version+longLived {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The redirectTrailingSlash() middleware redirects requests for a path with a trailing
+// slash, like /v1/movies/, to the same path without it, if that path has a route for
+// the request method. GET and HEAD requests are redirected with 301 Moved Permanently,
+// and other methods with 308 Permanent Redirect so that clients repeat the method and
+// body. Any other requests are passed on to the router as normal, so they still get
+// our custom 404 and 405 responses. It replaces httprouter's own trailing slash
+// redirect, which uses 307 Temporary Redirect for methods other than GET, and can be
+// turned off with -redirect-trailing-slash=false, in which case paths with a trailing
+// slash get a 404 Not Found response.
+func (app *application) redirectTrailingSlash(router *httprouter.Router) http.Handler {
+	router.RedirectTrailingSlash = false
+
+	if !app.config.redirectTrailingSlash {
+		return router
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+
+		if len(path) > 1 && strings.HasSuffix(path, "/") {
+			trimmed := strings.TrimRight(path, "/")
+
+			if handle, _, _ := router.Lookup(r.Method, trimmed); handle != nil {
+				code := http.StatusPermanentRedirect
+				if r.Method == http.MethodGet || r.Method == http.MethodHead {
+					code = http.StatusMovedPermanently
+				}
+
+				u := *r.URL
+				u.Path = trimmed
+				u.RawPath = ""
+
+				http.Redirect(w, r, u.RequestURI(), code)
+				return
+			}
+		}
+
+		router.ServeHTTP(w, r)
+	})
+}
+
+// The default maximum size of the body of a signed request, for routes which don't
+// set their own limit. It's the same as the limit in readJSON().
+const maxSignedBodyBytes = 1_048_576
+
+// The requireSignature() middleware checks the HMAC signature of a request, for the
+// routes in the -signature-routes flag. The client sends the current Unix time in the
+// X-Signature-Timestamp header, and the hex encoded HMAC-SHA256 signature in the
+// X-Signature header, using the -signature-secret value as the key. The signed
+// string is the timestamp, the request method, the request URI (the path and query
+// string, as sent) and the request body, joined with "." characters. For example:
+//
+//	1718000000.POST./v1/movies/import?mode=strict.{"movies": [...]}
+//
+// Requests with a timestamp outside of the -signature-window are rejected, so that a
+// captured request can't be replayed later, and signing the method and URI means a
+// signature can't be reused for a different route either. The body is read
+// into memory to check the signature, and then replaced so that the handler can
+// still decode it, so the body is limited to maxBytes, which should be the route's
+// own body limit. Note that for gzipped requests the signature is of the
+// uncompressed body.
+func (app *application) requireSignature(next http.HandlerFunc, maxBytes int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		timestamp := r.Header.Get("X-Signature-Timestamp")
+
+		seconds, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			app.invalidSignatureResponse(w, r)
+			return
+		}
+
+		age := time.Since(time.Unix(seconds, 0))
+		if age > app.config.signature.window || age < -app.config.signature.window {
+			app.invalidSignatureResponse(w, r)
+			return
+		}
+
+		signature, err := hex.DecodeString(r.Header.Get("X-Signature"))
+		if err != nil || len(signature) == 0 {
+			app.invalidSignatureResponse(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBytes))
+		if err != nil {
+			var maxBytesError *http.MaxBytesError
+
+			switch {
+			case errors.As(err, &maxBytesError):
+				app.badRequestResponse(w, r, fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit))
+			default:
+				app.badRequestResponse(w, r, err)
+			}
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		if !hmac.Equal(signature, signRequest(app.config.signature.secret, timestamp, r.Method, r.URL.RequestURI(), body)) {
+			app.invalidSignatureResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// The signRequest() function returns the HMAC-SHA256 signature of a request, in the
+// format described by requireSignature().
+func signRequest(secret, timestamp, method, requestURI string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write([]byte(method))
+	mac.Write([]byte("."))
+	mac.Write([]byte(requestURI))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// The serverTiming() middleware sends a Server-Timing response header, which browser
+// developer tools show alongside the request, with the time spent on the database and
+// the total time. The header has to be set before the response headers are written,
+// so the times are taken at that point rather than when the handler returns. The db
+// time is always included, as 0 if there were no queries, so that the header has the
+// same shape on every response. It's only added to the chain when the -server-timing
+// flag is set.
+func (app *application) serverTiming(next http.Handler) http.Handler {
+	if !app.config.serverTiming {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, timer := data.WithQueryTimer(r.Context())
+
+		tw := &serverTimingResponseWriter{
+			ResponseWriter: w,
+			start:          time.Now(),
+			timer:          timer,
+		}
+
+		next.ServeHTTP(tw, r.WithContext(ctx))
+	})
+}
+
+// The serverTimingResponseWriter type wraps an existing http.ResponseWriter, setting
+// the Server-Timing header just before the response headers are written.
+type serverTimingResponseWriter struct {
+	http.ResponseWriter
+	start         time.Time
+	timer         *data.QueryTimer
+	headerWritten bool
+}
+
+func (tw *serverTimingResponseWriter) setHeader() {
+	if tw.headerWritten {
+		return
+	}
+	tw.headerWritten = true
+
+	// The durations are in milliseconds, as the specification requires.
+	milliseconds := func(d time.Duration) string {
+		return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 1, 64)
+	}
+
+	tw.Header().Set("Server-Timing", fmt.Sprintf(`db;dur=%s;desc="%d queries", total;dur=%s`,
+		milliseconds(tw.timer.Duration()), tw.timer.Queries(), milliseconds(time.Since(tw.start))))
+}
+
+func (tw *serverTimingResponseWriter) WriteHeader(statusCode int) {
+	tw.setHeader()
+	tw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (tw *serverTimingResponseWriter) Write(b []byte) (int, error) {
+	tw.setHeader()
+	return tw.ResponseWriter.Write(b)
+}
+
+func (tw *serverTimingResponseWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// The timezone() middleware reads the optional tz query string parameter, which is
+// the IANA name of the time zone (like "Europe/London") that the client wants the
+// timestamps in the response to be in. It's checked up front, so that an invalid
+// name gets a 422 Unprocessable Entity response whichever endpoint it was sent to.
+// The location is passed on to writeJSON() with the response writer, because
+// writeJSON() doesn't have the request. Without tz, timestamps are sent in UTC, as
+// that's the time zone of the database connections.
+func (app *application) timezone(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("tz")
+		if name == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The "Local" name means the server's own time zone, which the client can't
+		// know, so it's rejected along with the names which don't exist.
+		location, err := time.LoadLocation(name)
+		if err != nil || name == "Local" {
+			app.failedValidationResponse(w, r, map[string]string{"tz": "must be a valid IANA time zone name"})
+			return
+		}
+
+		next.ServeHTTP(&timezoneResponseWriter{ResponseWriter: w, location: location}, r)
+	})
+}
+
+// The timezoneResponseWriter type wraps an existing http.ResponseWriter to carry the
+// time zone for the timestamps in the response.
+type timezoneResponseWriter struct {
+	http.ResponseWriter
+	location *time.Location
+}
+
+func (tw *timezoneResponseWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// The responseLocation() helper returns the time zone for the timestamps in a
+// response, looking through any other wrappers around the response writer. It's nil
+// if the client didn't ask for a zone, in which case the timestamps are sent as they
+// are, which is UTC as the database connections use the UTC time zone.
+func responseLocation(w http.ResponseWriter) *time.Location {
+	for {
+		switch rw := w.(type) {
+		case *timezoneResponseWriter:
+			return rw.location
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
@@ -4,7 +4,13 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/julienschmidt/httprouter"
 	"greenlight.nicolasleigh.net/internal/data"
 	"greenlight.nicolasleigh.net/internal/validator"
 )
@@ -91,6 +97,20 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	// Initialize a new Validator.
 	v := validator.New()
 
+	// If the client asks for it with ?default_genre=true, a movie without any genres is
+	// given the -default-genre genre. Otherwise at least one genre is required as usual.
+	defaultGenre := app.readBool(r.URL.Query(), "default_genre", false, v)
+	v.Check(!defaultGenre || app.config.defaultGenre != "", "default_genre", "must not be true as there is no default genre")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if defaultGenre && len(movie.Genres) == 0 {
+		movie.Genres = []string{app.config.defaultGenre}
+		app.logger.Info("applied default genre", "request_id", app.contextGetRequestID(r), "genre", app.config.defaultGenre, "title", movie.Title)
+	}
+
 	// Call the ValidateMovie() function and return a response containing the errors if
 	// any of the checks fail.
 	if data.ValidateMovie(v, movie); !v.Valid() {
@@ -98,15 +118,48 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// In dedupe mode, an existing movie with the same title and year is returned
+	// instead of creating a duplicate, for clients which use a create-or-get flow.
+	dedupe := app.readBool(r.URL.Query(), "dedupe", false, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	// Call the Insert() method on our movies model, passing in a pointer to the
 	// validated movie struct. This will create a record in the database and update the
 	// movie struct with the system-generated information.
-	err = app.models.Movies.Insert(movie)
+	// err = app.requestModels(r).Movies.Insert(movie)
+
+	// Use InsertOrGet() instead in dedupe mode, which fills in the movie struct with
+	// the existing movie if there is one.
+	created := true
+	if dedupe {
+		created, err = app.requestModels(r).Movies.InsertOrGet(movie)
+	} else {
+		err = app.requestModels(r).Movies.Insert(movie)
+	}
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrDuplicateTitle):
+			app.duplicateTitleResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
+	// Let the event stream clients know about the new movie.
+	if created {
+		app.movieEvents.publish(movieCreatedEvent, envelope{"movie": movie})
+	}
+
+	// Send 201 Created for a new movie, or 200 OK if an existing movie was returned.
+	status := http.StatusCreated
+	if !created {
+		status = http.StatusOK
+	}
+
 	// When sending a HTTP response, we want to include a Location header to let the
 	// client know which URL they can find the newly-created resource at. We make an
 	// empty http.Header map and then use the Set() method to add a new Location header,
@@ -117,9 +170,33 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	// Dump the contents of the input struct in a HTTP response.
 	// fmt.Fprintf(w, "%+v\n", input)
 
+	// Honour a "Prefer: return=minimal" or "Prefer: return=representation" request
+	// header, and let the client know which one was applied. For return=minimal we
+	// send the status and headers only, with an empty body. Any other value for the
+	// return preference is ignored.
+	switch preference := app.readPreferences(r)["return"]; preference {
+	case "minimal":
+		headers.Set("Preference-Applied", "return=minimal")
+		for key, value := range headers {
+			w.Header()[key] = value
+		}
+		w.WriteHeader(status)
+		return
+	case "representation":
+		headers.Set("Preference-Applied", "return=representation")
+	}
+
 	// Write a JSON response with a 201 Created status code, the movie data in the
 	// response body, and the Location header.
-	err = app.writeJSON(w, http.StatusCreated, envelope{"movie": movie}, headers)
+	// err = app.writeJSON(w, http.StatusCreated, envelope{"movie": movie}, headers)
+
+	// In dedupe mode, also tell the client whether the movie was created.
+	env := envelope{"movie": movie}
+	if dedupe {
+		env["created"] = created
+	}
+
+	err = app.writeJSON(w, status, env, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -185,10 +262,28 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 	// 	Version:   1,
 	// }
 
+	// Read the include_timestamps query string parameter.
+	v := validator.New()
+
+	includeTimestamps := app.readIncludeTimestamps(r.URL.Query(), v)
+
+	// Read the expand query string parameter, which can ask for the genres to be sent
+	// as objects from the genres table, rather than as strings.
+	// expand := app.readExpand(r.URL.Query(), v, movieExpansions...)
+
+	// The expand parameter can also ask for the similar movies to be included, which
+	// saves the client from making another request for them.
+	expand := app.readExpand(r.URL.Query(), v, showMovieExpansions...)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	// Call the Get() method to fetch the data for a specific movie. We also need to
 	// use the errors.Is() function to check if it returns a data.ErrRecordNotFound
 	// error, in which case we send a 404 Not Found response to the client.
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.requestModels(r).Movies.Get(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -202,9 +297,60 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 	// Encode the struct to JSON and send it as the HTTP response.
 	// err = app.writeJSON(w, http.StatusOK, movie, nil)
 
+	// Use the translation of the movie for the client's preferred language, if there
+	// is one. Otherwise the base fields are sent in the default language. The Vary
+	// header is added to the response directly, as the headers passed to writeJSON()
+	// replace any values already set, and the authenticate() and enableCORS()
+	// middleware have added their own Vary values.
+	w.Header().Add("Vary", "Accept-Language")
+
+	headers := make(http.Header)
+	headers.Set("Content-Language", app.config.defaultLanguage)
+
+	langs := parseAcceptLanguage(r.Header.Get("Accept-Language"))
+
+	translation, err := app.requestModels(r).MovieTranslations.GetForLanguages(movie.ID, langs)
+	switch {
+	case err == nil:
+		movie.ApplyTranslation(translation)
+		headers.Set("Content-Language", translation.Lang)
+	case errors.Is(err, data.ErrRecordNotFound):
+		// There's no suitable translation, so send the base fields.
+	default:
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	opts := movieOptions{includeTimestamps: includeTimestamps}
+
+	if slices.Contains(expand, "similar") {
+		opts.similar, err = app.requestModels(r).Movies.GetSimilar(movie, similarMoviesCount)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// The expanded genres need to cover the similar movies as well, so they're loaded
+	// once those are known.
+	if slices.Contains(expand, "genres") {
+		opts.genres, err = app.loadGenres(r, append([]*data.Movie{movie}, opts.similar...)...)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
 	// Create an envelope{"movie": movie} instance and pass it to writeJSON(), instead
 	// of passing the plain movie struct.
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	// err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	// err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, headers)
+	// err = app.writeJSON(w, http.StatusOK, envelope{"movie": movieResponse(movie, includeTimestamps)}, headers)
+
+	// Use the writeMovie() helper, so that the movie is sent in the configured API
+	// format.
+	// err = app.writeMovie(w, http.StatusOK, movie, includeTimestamps, headers)
+	err = app.writeMovie(w, http.StatusOK, movie, opts, headers)
 	if err != nil {
 		// app.logger.Error(err.Error())
 		// http.Error(w, "The server encountered a problem and could not process your request", http.StatusInternalServerError)
@@ -214,6 +360,59 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// The putMovieTranslationHandler adds or replaces the translation of a movie's title
+// and overview for a single language.
+func (app *application) putMovieTranslationHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	params := httprouter.ParamsFromContext(r.Context())
+
+	var input struct {
+		Title    string `json:"title"`
+		Overview string `json:"overview"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	translation := &data.MovieTranslation{
+		MovieID:  id,
+		Lang:     strings.ToLower(params.ByName("lang")),
+		Title:    input.Title,
+		Overview: input.Overview,
+	}
+
+	v := validator.New()
+
+	if data.ValidateMovieTranslation(v, translation); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.requestModels(r).MovieTranslations.Upsert(translation)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"translation": translation}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
 func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Request) {
 	// Extract the movie ID from the URL.
 	id, err := app.readIDParam(r)
@@ -224,7 +423,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 
 	// Fetch the existing movie record from the database, sending a 404 Not Found
 	// response to the client if we couldn't find a matching record.
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.requestModels(r).Movies.Get(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -244,11 +443,16 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	// }
 
 	// Use pointers for the Title, Year and Runtime fields.
+	//
+	// Clients which queue up edits while offline can also send the time that they
+	// made the edit as client_updated_at. If the movie has been updated since then,
+	// the edit is stale and is rejected, even if the version still matches.
 	var input struct {
-		Title   *string       `json:"title"`
-		Year    *int32        `json:"year"`
-		Runtime *data.Runtime `json:"runtime"`
-		Genres  []string      `json:"genres"`
+		Title           *string       `json:"title"`
+		Year            *int32        `json:"year"`
+		Runtime         *data.Runtime `json:"runtime"`
+		Genres          []string      `json:"genres"`
+		ClientUpdatedAt *time.Time    `json:"client_updated_at"`
 	}
 
 	// Read the JSON request body data into the input struct.
@@ -289,17 +493,35 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 
 	// Validate the updated movie record, sending the client a 422 Unprocessable Entity
 	// response if any checks fail.
+	// Also check that the client_updated_at time, if there is one, isn't in the
+	// future.
+	//
+	// The genres are only validated if the client changed them, so that movies with
+	// legacy genres can still have their other fields updated.
 	v := validator.New()
-	if data.ValidateMovie(v, movie); !v.Valid() {
+	data.ValidateMovieUpdate(v, movie, input.Genres != nil)
+	if input.ClientUpdatedAt != nil {
+		v.Check(!input.ClientUpdatedAt.After(time.Now()), "client_updated_at", "must not be in the future")
+	}
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
+	// If the movie was updated after the client made its edit, then reject the edit
+	// with a 409 Conflict. The updated_at column stores microseconds, the same
+	// precision as the updated_at timestamps sent to the client, so they can be
+	// compared directly.
+	if input.ClientUpdatedAt != nil && movie.UpdatedAt.After(*input.ClientUpdatedAt) {
+		app.conflictResponse(w, r, "the movie has been updated since client_updated_at")
+		return
+	}
+
 	// Pass the updated movie record to our new Update() method.
 
 	// Intercept any ErrEditConflict error and call the new editConflictResponse()
 	// helper.
-	err = app.models.Movies.Update(movie)
+	err = app.requestModels(r).Movies.Update(movie)
 	// if err != nil {
 	//   app.serverErrorResponse(w, r, err)
 	//   return
@@ -309,12 +531,16 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateTitle):
+			app.duplicateTitleResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
+	app.movieEvents.publish(movieUpdatedEvent, envelope{"movie": movie})
+
 	// Write the updated movie record in a JSON response.
 	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
 	if err != nil {
@@ -332,7 +558,7 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 
 	// Delete the movie from the database, sending a 404 Not Found response to the
 	// client if there isn't a matching record.
-	err = app.models.Movies.Delete(id)
+	err = app.requestModels(r).Movies.Delete(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -343,6 +569,8 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	app.movieEvents.publish(movieDeletedEvent, envelope{"id": id})
+
 	// Return a 200 OK status code along with a success message.
 	err = app.writeJSON(w, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil)
 	if err != nil {
@@ -350,18 +578,95 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 }
 
+// movieSortSafelist holds the supported sort values for listMoviesHandler. The
+// -movies-default-sort flag is also checked against it at startup.
+//
+// The relevance sort values order the movies by how well they match the title
+// search, so they can only be used along with a title.
+var movieSortSafelist = []string{"id", "title", "year", "runtime", "created_at", "relevance", "-id", "-title", "-year", "-runtime", "-created_at", "-relevance"}
+
+// The validateMovieSort() helper checks that the relevance sort is only used when
+// there's a title to search for, and only with the full-text search mode. The like
+// search mode matches substrings, which the full-text rank can't score.
+func validateMovieSort(v *validator.Validator, sort, title, searchMode string) {
+	if strings.TrimPrefix(sort, "-") == "relevance" {
+		v.Check(title != "", "sort", "must not be relevance without a title")
+		v.Check(searchMode == data.SearchModeFullText, "sort", "must not be relevance with the like search mode")
+	}
+}
+
+// The readMovieListFilters() helper reads the filters, pagination and sort values for
+// a movie list from the query string, and validates them. It's shared by all of the
+// endpoints which take the movie list filters, so that they always accept the same
+// parameters.
+func (app *application) readMovieListFilters(qs url.Values, v *validator.Validator) data.MovieListFilters {
+	var filters data.MovieListFilters
+
+	// Use our helpers to extract the title and genres query string values, falling back
+	// to defaults of an empty string and an empty slice respectively if they are not
+	// provided by the client.
+	filters.Title = app.readString(qs, "title", "")
+	filters.Genres = app.readCSV(qs, "genres", []string{})
+	app.validateGenresQuery(v, qs, filters.Genres)
+
+	// Read the tags filter. Like genres, only the movies with all of the tags match.
+	filters.Tags = app.readCSV(qs, "tags", []string{})
+	v.Check(len(filters.Tags) <= data.MaxMovieTags, "tags", fmt.Sprintf("must not contain more than %d values", data.MaxMovieTags))
+
+	// Read the optional created_from and created_to timestamps, which restrict the
+	// results to movies added within a date range. If both are provided, check that
+	// they describe a sensible range.
+	filters.CreatedFrom = app.readTime(qs, "created_from", v)
+	filters.CreatedTo = app.readTime(qs, "created_to", v)
+	if filters.CreatedFrom != nil && filters.CreatedTo != nil {
+		v.Check(!filters.CreatedFrom.After(*filters.CreatedTo), "created_to", "must not be before created_from")
+	}
+
+	// Read the updated_since timestamp, which incremental sync clients use to fetch
+	// only the movies which have changed since their last sync. The results are
+	// always ordered by updated_at and id, so it can't be combined with the sort
+	// parameter. Clients continue from the updated_at and id of the last movie they
+	// received, passing the id as updated_since_id, so that movies updated in the
+	// same instant aren't skipped.
+	filters.UpdatedSince = app.readTime(qs, "updated_since", v)
+	filters.UpdatedAfterID = int64(app.readInt(qs, "updated_since_id", 0, v))
+	if filters.UpdatedSince != nil {
+		v.Check(!qs.Has("sort"), "sort", "must not be provided with updated_since")
+	}
+	v.Check(filters.UpdatedAfterID >= 0, "updated_since_id", "must not be negative")
+	if qs.Has("updated_since_id") {
+		v.Check(filters.UpdatedSince != nil, "updated_since_id", "must be provided with updated_since")
+	}
+
+	// Read the with_count value, which lets the client skip counting the total number
+	// of matching records. It defaults to true.
+	filters.WithCount = app.readBool(qs, "with_count", true, v)
+
+	// Read the page, page_size and sort values, using the -movies-default-sort value
+	// if the client doesn't provide a sort value.
+	filters.Page = app.readInt(qs, "page", 1, v)
+	filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	filters.Sort = app.readString(qs, "sort", app.config.moviesDefaultSort)
+	filters.SortSafelist = movieSortSafelist
+	validateMovieSort(v, filters.Sort, filters.Title, app.config.searchMode)
+
+	data.ValidateFilters(v, filters.Filters)
+
+	return filters
+}
+
 func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request) {
 	// To keep things consistent with our other handlers, we'll define an input struct
 	// to hold the expected values from the request query string.
 
 	// Embed the new Filters struct.
+	// Embed the MovieListFilters struct instead, which holds the filters, pagination
+	// and sort values shared with the other movie list endpoints.
 	var input struct {
-		Title  string
-		Genres []string
-		// Page     int
-		// PageSize int
-		// Sort     string
-		data.Filters
+		IncludeTimestamps bool
+		Fields            string
+		Expand            []string
+		data.MovieListFilters
 	}
 
 	// Initialize a new Validator instance.
@@ -370,42 +675,26 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	// Call r.URL.Query() to get the url.Values map containing the query string data.
 	qs := r.URL.Query()
 
-	// Use our helpers to extract the title and genres query string values, falling back
-	// to defaults of an empty string and an empty slice respectively if they are not
-	// provided by the client.
-	input.Title = app.readString(qs, "title", "")
-	input.Genres = app.readCSV(qs, "genres", []string{})
-
-	// Get the page and page_size query string values as integers. Notice that we set
-	// the default page value to 1 and default page_size to 20, and that we pass the
-	// validator instance as the final argument here.
-	// input.Page = app.readInt(qs, "page", 1, v)
-	// input.PageSize = app.readInt(qs, "page_size", 20, v)
+	// Read the filters with the same helper as the other movie list endpoints, so
+	// that they always accept the same parameters.
+	input.MovieListFilters = app.readMovieListFilters(qs, v)
 
-	// Read the page and page_size query string values into the embedded struct.
-	input.Filters.Page = app.readInt(qs, "page", 1, v)
-	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	// Read the include_timestamps value, which adds the created_at and updated_at
+	// timestamps to the movie data. Sync clients need the updated_at timestamps to
+	// continue from, so it defaults to true when updated_since is provided.
+	input.IncludeTimestamps = app.readBool(qs, "include_timestamps", input.UpdatedSince != nil, v)
 
-	// Extract the sort query string value, falling back to "id" if it is not provided
-	// by the client (which will imply a ascending sort on movie ID).
-	// input.Sort = app.readString(qs, "sort", "id")
+	// Read the fields value. The only supported value is "id", which returns just the
+	// IDs of the matching movies, for clients which fetch the movies separately.
+	input.Fields = app.readString(qs, "fields", "")
+	v.Check(validator.PermittedValue(input.Fields, "", "id"), "fields", "must be id if provided")
 
-	// Read the sort query string value into the embedded struct.
-	input.Filters.Sort = app.readString(qs, "sort", "id")
-
-	// Add the supported sort values for this endpoint to the sort safelist.
-	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	// Read the expand value, which can ask for the genres to be sent as objects.
+	input.Expand = app.readExpand(qs, v, movieExpansions...)
 
 	// Check the Validator instance for any errors and use the failedValidationResponse()
 	// helper to send the client a response if necessary.
-	// if !v.Valid() {
-	//   app.failedValidationResponse(w, r, v.Errors)
-	//   return
-	// }
-
-	// Execute the validation checks on the Filters struct and send a response
-	// containing the errors if necessary.
-	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
@@ -418,7 +707,29 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	// movies, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
 
 	// Accept the metadata struct as a return value.
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	// movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.CreatedFrom, input.CreatedTo, input.Filters)
+
+	// If only the IDs were asked for, use the lighter GetAllIDs() query, which has the
+	// same filtering, sorting and pagination.
+	if input.Fields == "id" {
+		ids, metadata, err := app.requestModels(r).Movies.GetAllIDs(input.MovieListFilters)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if len(ids) == 0 && app.sendEmptyListNoContent(w, r, metadata, input.Filters.Page) {
+			return
+		}
+
+		err = app.writeMovieIDs(w, r, http.StatusOK, ids, metadata)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	movies, metadata, err := app.requestModels(r).Movies.GetAll(input.MovieListFilters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -428,8 +739,578 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	// err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies}, nil)
 
 	// Include the metadata in the response envelope.
-	err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil)
+	// err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil)
+	// err = app.writeJSON(w, http.StatusOK, envelope{"movies": moviesResponse(movies, input.IncludeTimestamps), "metadata": metadata}, nil)
+
+	// If there are no matching movies, the client may have asked for a 204 No Content
+	// response rather than an empty array.
+	if len(movies) == 0 && app.sendEmptyListNoContent(w, r, metadata, input.Filters.Page) {
+		return
+	}
+
+	opts := movieOptions{includeTimestamps: input.IncludeTimestamps}
+
+	if slices.Contains(input.Expand, "genres") {
+		opts.genres, err = app.loadGenres(r, movies...)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// Use the writeMovies() helper, so that the movies are sent in the configured API
+	// format.
+	// err = app.writeMovies(w, r, http.StatusOK, movies, &metadata, input.IncludeTimestamps, nil)
+	err = app.writeMovies(w, r, http.StatusOK, movies, &metadata, opts, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The sendEmptyListNoContent() helper sends a 204 No Content response for a movie list
+// with no matches, if that's what the -empty-list flag or the client asks for, and
+// returns true if it did. A "Prefer: empty-list=no-content" or "Prefer:
+// empty-list=array" request header overrides the flag. The list only counts as having
+// no matches if the count found no records, or if the count was skipped and the first
+// page is empty; an empty page past the end of the list is still sent as normal.
+func (app *application) sendEmptyListNoContent(w http.ResponseWriter, r *http.Request, metadata data.Metadata, page int) bool {
+	// The total_records value is only set if the list was counted.
+	counted := metadata.TotalRecords > 0 || metadata.Empty()
+
+	if counted && !metadata.Empty() || !counted && page != 1 {
+		return false
+	}
+
+	mode := app.config.emptyList
+
+	switch preference := app.readPreferences(r)["empty-list"]; preference {
+	case "array", "no-content":
+		mode = preference
+		w.Header().Set("Preference-Applied", "empty-list="+preference)
+	}
+
+	if mode != "no-content" {
+		return false
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// The moviePaginationHandler returns the pagination metadata for a movie list query
+// without fetching any of the movies, so that clients can show a pager before they
+// load the first page. It takes the same filters as listMoviesHandler, and the
+// metadata is always for the first page.
+func (app *application) moviePaginationHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	filters := app.readMovieListFilters(r.URL.Query(), v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The metadata is always for the first page.
+	filters.Page = 1
+
+	metadata, err := app.requestModels(r).Movies.GetMetadata(filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The movieFacetsHandler returns the number of movies in each of the requested genres,
+// for use in things like filter sidebars.
+func (app *application) movieFacetsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Genres []string
+		Top    int
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Genres = app.readCSV(qs, "genres", []string{})
+	app.validateGenresQuery(v, qs, input.Genres)
+	input.Top = app.readInt(qs, "top", 0, v)
+
+	v.Check(len(input.Genres) >= 1, "genres", "must contain at least 1 genre")
+	v.Check(len(input.Genres) <= len(data.Genres), "genres", fmt.Sprintf("must not contain more than %d genres", len(data.Genres)))
+	v.Check(validator.Unique(input.Genres), "genres", "must not contain duplicate values")
+	for _, genre := range input.Genres {
+		v.Check(validator.PermittedValue(genre, data.Genres...), "genres", fmt.Sprintf("unsupported genre %q", genre))
+	}
+
+	v.Check(input.Top >= 0, "top", "must not be negative")
+	v.Check(input.Top <= 10, "top", "must be a maximum of 10")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	facets, err := app.requestModels(r).Movies.Facets(input.Genres, input.Top)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"facets": facets}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The randomMoviesHandler returns a small number of randomly selected movies.
+func (app *application) randomMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	count := app.readInt(r.URL.Query(), "count", 5, v)
+	includeTimestamps := app.readIncludeTimestamps(r.URL.Query(), v)
+
+	v.Check(count > 0, "count", "must be greater than zero")
+	v.Check(count <= 20, "count", "must be a maximum of 20")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movies, err := app.requestModels(r).Movies.GetRandom(count)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeMovies(w, r, http.StatusOK, movies, nil, movieOptions{includeTimestamps: includeTimestamps}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The suffix added to the title of a duplicated movie.
+const duplicateTitleSuffix = " (copy)"
+
+// The duplicateMovieHandler creates a new movie with the same details as an existing
+// one, so that editors can quickly add similar entries. The new movie gets " (copy)"
+// appended to its title, and its own ID, slug, created_at time and version.
+func (app *application) duplicateMovieHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	source, err := app.requestModels(r).Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Shorten the original title if necessary, so that the title with the suffix still
+	// fits within the 500 byte limit. We trim whole runes so that the title remains
+	// valid UTF-8.
+	title := []rune(source.Title)
+	for len(string(title))+len(duplicateTitleSuffix) > 500 {
+		title = title[:len(title)-1]
+	}
+
+	movie := &data.Movie{
+		Title:   string(title) + duplicateTitleSuffix,
+		Year:    source.Year,
+		Runtime: source.Runtime,
+		Genres:  source.Genres,
+	}
+
+	// Insert() sets the new ID, slug, created_at time and version (which starts at 1).
+	err = app.requestModels(r).Movies.Insert(movie)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateTitle):
+			app.duplicateTitleResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.movieEvents.publish(movieCreatedEvent, envelope{"movie": movie})
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"movie": movie}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The maximum number of movies returned by recentMoviesHandler, and the length of
+// time that the recent movies are cached for.
+const (
+	maxRecentMovies = 50
+	recentMoviesTTL = 10 * time.Second
+)
+
+// The recentMoviesHandler returns the most recently added movies, newest first. As
+// this is requested often, we cache the maxRecentMovies most recent movies briefly
+// and return the first count of them, so that every count shares the same cache.
+func (app *application) recentMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	count := app.readInt(r.URL.Query(), "count", 10, v)
+	includeTimestamps := app.readIncludeTimestamps(r.URL.Query(), v)
+
+	v.Check(count > 0, "count", "must be greater than zero")
+	v.Check(count <= maxRecentMovies, "count", fmt.Sprintf("must be a maximum of %d", maxRecentMovies))
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movies, err := app.recentMovies.get(recentMoviesTTL, func() ([]*data.Movie, error) {
+		return app.models.Movies.GetRecent(maxRecentMovies)
+	})
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeMovies(w, r, http.StatusOK, movies[:min(count, len(movies))], nil, movieOptions{includeTimestamps: includeTimestamps}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The limits for the movies by year endpoint. A response has at most
+// maxMoviesByYearGroups years, with at most maxMoviesPerYear movies in each.
+const (
+	maxMoviesByYearGroups = 50
+	maxMoviesPerYear      = 20
+)
+
+// The moviesByYearHandler returns movies grouped by their release year, for timeline
+// views. The movies in each year are ordered by title. It supports the same title
+// and genres filters as listMoviesHandler, along with a year_from and year_to range
+// and a per_year limit. If there are more than maxMoviesByYearGroups years with
+// matching movies, then only the earliest ones are returned, and clients can fetch
+// the rest by moving year_from on past the last year they received.
+func (app *application) moviesByYearHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	title := app.readString(qs, "title", "")
+	genres := app.readCSV(qs, "genres", []string{})
+	app.validateGenresQuery(v, qs, genres)
+
+	yearFrom := app.readInt(qs, "year_from", 1888, v)
+	yearTo := app.readInt(qs, "year_to", time.Now().Year(), v)
+	perYear := app.readInt(qs, "per_year", 10, v)
+	includeTimestamps := app.readIncludeTimestamps(qs, v)
+
+	v.Check(yearFrom >= 1888, "year_from", "must be greater than 1888")
+	v.Check(yearTo <= time.Now().Year(), "year_to", "must not be in the future")
+	v.Check(yearFrom <= yearTo, "year_to", "must not be before year_from")
+	v.Check(perYear > 0, "per_year", "must be greater than zero")
+	v.Check(perYear <= maxMoviesPerYear, "per_year", fmt.Sprintf("must be a maximum of %d", maxMoviesPerYear))
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movies, err := app.requestModels(r).Movies.GetByYear(title, genres, yearFrom, yearTo, perYear, maxMoviesByYearGroups)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Group the movies under their year. The movies are already in order, so each
+	// group stays ordered by title. The keys are strings as they become JSON object
+	// keys, which encoding/json sorts, so the years are in order too.
+	years := make(map[string]any)
+	for i := 0; i < len(movies); {
+		j := i
+		for j < len(movies) && movies[j].Year == movies[i].Year {
+			j++
+		}
+		years[strconv.Itoa(int(movies[i].Year))] = moviesResponse(movies[i:j], movieOptions{includeTimestamps: includeTimestamps})
+		i = j
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"years": years}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showMovieBySlugHandler fetches a movie using the slug in the URL, rather than
+// its numeric ID.
+func (app *application) showMovieBySlugHandler(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	v := validator.New()
+
+	includeTimestamps := app.readIncludeTimestamps(r.URL.Query(), v)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movie, err := app.requestModels(r).Movies.GetBySlug(params.ByName("slug"))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeMovie(w, http.StatusOK, movie, movieOptions{includeTimestamps: includeTimestamps}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateManyMoviesHandler applies partial updates to several movies at once. Each
+// item in the request body holds a movie ID, an optional expected version, and the
+// changes to make, which work in the same way as for updateMovieHandler. All of the
+// updates are saved in a single transaction, so if any item fails then nothing is
+// changed and the index of the failing item is included in the error response.
+func (app *application) updateManyMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	var input []struct {
+		ID      jsonID `json:"id"`
+		Version *int32 `json:"version"`
+		Changes struct {
+			Title   *string       `json:"title"`
+			Year    *int32        `json:"year"`
+			Runtime *data.Runtime `json:"runtime"`
+			Genres  []string      `json:"genres"`
+		} `json:"changes"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(len(input) >= 1, "body", "must contain at least 1 item")
+	v.Check(len(input) <= 100, "body", "must not contain more than 100 items")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movies := make([]*data.Movie, len(input))
+	seen := make(map[int64]bool, len(input))
+
+	for i, item := range input {
+		id := int64(item.ID)
+
+		// Each movie can only appear once, as the second update would always fail the
+		// version check.
+		if seen[id] {
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, envelope{"index": i, "errors": map[string]string{"id": "must not be duplicated"}})
+			return
+		}
+		seen[id] = true
+
+		movie, err := app.requestModels(r).Movies.Get(id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.errorResponse(w, r, http.StatusNotFound, envelope{"index": i, "message": "the requested resource could not be found"})
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		// If the client included the version that it expects the movie to have, check
+		// it now so that we can fail early.
+		if item.Version != nil && *item.Version != movie.Version {
+			app.errorResponse(w, r, http.StatusConflict, envelope{"index": i, "message": "unable to update the record due to an edit conflict, please try again"})
+			return
+		}
+
+		if item.Changes.Title != nil {
+			movie.Title = *item.Changes.Title
+		}
+		if item.Changes.Year != nil {
+			movie.Year = *item.Changes.Year
+		}
+		if item.Changes.Runtime != nil {
+			movie.Runtime = *item.Changes.Runtime
+		}
+		if item.Changes.Genres != nil {
+			movie.Genres = item.Changes.Genres
+		}
+
+		v := validator.New()
+		if data.ValidateMovieUpdate(v, movie, item.Changes.Genres != nil); !v.Valid() {
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, envelope{"index": i, "errors": v.Errors})
+			return
+		}
+
+		movies[i] = movie
+	}
+
+	err = app.requestModels(r).Movies.UpdateMany(movies)
+	if err != nil {
+		var batchItemError *data.BatchItemError
+
+		switch {
+		case errors.As(err, &batchItemError) && errors.Is(err, data.ErrEditConflict):
+			app.errorResponse(w, r, http.StatusConflict, envelope{"index": batchItemError.Index, "message": "unable to update the record due to an edit conflict, please try again"})
+		case errors.As(err, &batchItemError) && errors.Is(err, data.ErrDuplicateTitle):
+			app.errorResponse(w, r, http.StatusConflict, envelope{"index": batchItemError.Index, "message": duplicateTitleMessage})
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	for _, movie := range movies {
+		app.movieEvents.publish(movieUpdatedEvent, envelope{"movie": movie})
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readIncludeTimestamps() helper reads the include_timestamps query string
+// parameter, which asks for the timestamps that are normally hidden (created_at and
+// updated_at) to be included in the movie data. It defaults to false.
+func (app *application) readIncludeTimestamps(qs url.Values, v *validator.Validator) bool {
+	return app.readBool(qs, "include_timestamps", false, v)
+}
+
+// The movieExpansions are the values supported by the expand query string parameter.
+var movieExpansions = []string{"genres"}
+
+// The showMovieExpansions are the values supported by the expand query string
+// parameter when showing a single movie. As well as the genres, the movies which are
+// similar to it can be included in the response.
+var showMovieExpansions = []string{"genres", "similar"}
+
+// The number of similar movies which are included with expand=similar.
+const similarMoviesCount = 5
+
+// The readExpand() helper reads the expand query string parameter, which is a comma
+// separated list of the related data to include in full, and checks that each value
+// is one of the given expansions.
+func (app *application) readExpand(qs url.Values, v *validator.Validator, expansions ...string) []string {
+	expand := app.readCSV(qs, "expand", []string{})
+
+	for _, value := range expand {
+		v.Check(validator.PermittedValue(value, expansions...), "expand", fmt.Sprintf("must only contain the values %s", strings.Join(expansions, ", ")))
+	}
+
+	// Each expansion can add queries to the request, so don't let them be repeated.
+	v.Check(validator.Unique(expand), "expand", "must not contain duplicate values")
+
+	return expand
+}
+
+// The movieOptions struct holds the query string options which change how movies are
+// encoded in responses. If genres isn't nil, then the movies' genres are sent as the
+// objects in the map, rather than as strings. If similar isn't nil, then the similar
+// movies are sent alongside a single movie.
+type movieOptions struct {
+	includeTimestamps bool
+	genres            map[string]*data.Genre
+	similar           []*data.Movie
+}
+
+// The loadGenres() method returns the genres reference data for all of the genres of
+// the given movies, for use in movieOptions.
+func (app *application) loadGenres(r *http.Request, movies ...*data.Movie) (map[string]*data.Genre, error) {
+	var names []string
+	for _, movie := range movies {
+		for _, name := range movie.Genres {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+
+	return app.requestModels(r).Genres.GetByNames(names)
+}
+
+// The movieResponse() helper returns the value to send in a response for a movie,
+// including the hidden timestamps if includeTimestamps is true.
+// func movieResponse(movie *data.Movie, includeTimestamps bool) any {
+// 	if includeTimestamps {
+// 		return movie.WithTimestamps()
+// 	}
+// 	return movie
+// }
+
+// The movieResponse() helper returns the value to send in a response for a movie,
+// shaped according to the options. Genres which are missing from the genres table
+// are sent with just their name.
+func movieResponse(movie *data.Movie, opts movieOptions) any {
+	if opts.genres != nil {
+		expanded := data.MovieWithGenres{
+			Movie:  movie,
+			Genres: make([]*data.Genre, len(movie.Genres)),
+		}
+
+		for i, name := range movie.Genres {
+			genre, ok := opts.genres[name]
+			if !ok {
+				genre = &data.Genre{Name: name}
+			}
+			expanded.Genres[i] = genre
+		}
+
+		if opts.includeTimestamps {
+			expanded.CreatedAt = &movie.CreatedAt
+			expanded.UpdatedAt = &movie.UpdatedAt
+		}
+
+		return expanded
+	}
+
+	if opts.includeTimestamps {
+		return movie.WithTimestamps()
+	}
+	return movie
+}
+
+// The moviesResponse() helper is the same as movieResponse(), but for a slice of
+// movies.
+func moviesResponse(movies []*data.Movie, opts movieOptions) any {
+	if !opts.includeTimestamps && opts.genres == nil {
+		return movies
+	}
+
+	wrapped := make([]any, len(movies))
+	for i, movie := range movies {
+		wrapped[i] = movieResponse(movie, opts)
 	}
+	return wrapped
 }
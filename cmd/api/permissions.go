@@ -0,0 +1,321 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"greenlight.nicolasleigh.net/internal/data"
+	"greenlight.nicolasleigh.net/internal/validator"
+)
+
+func (app *application) bulkUpdatePermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the user IDs, along with the permission codes to grant and revoke, from the
+	// request body.
+	var input struct {
+		UserIDs []jsonID `json:"user_ids"`
+		Grant   []string `json:"grant"`
+		Revoke  []string `json:"revoke"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	userIDs := make([]int64, len(input.UserIDs))
+	for i, id := range input.UserIDs {
+		userIDs[i] = int64(id)
+	}
+
+	v := validator.New()
+
+	v.Check(len(input.UserIDs) >= 1, "user_ids", "must contain at least 1 user ID")
+	v.Check(len(input.UserIDs) <= 1000, "user_ids", "must not contain more than 1000 user IDs")
+	v.Check(validator.Unique(userIDs), "user_ids", "must not contain duplicate values")
+	for _, id := range userIDs {
+		v.Check(id > 0, "user_ids", "must only contain positive integers")
+	}
+
+	v.Check(len(input.Grant)+len(input.Revoke) >= 1, "grant", "must contain at least 1 permission if revoke is empty")
+	v.Check(validator.Unique(input.Grant), "grant", "must not contain duplicate values")
+	v.Check(validator.Unique(input.Revoke), "revoke", "must not contain duplicate values")
+
+	// Check that every permission code is in the permissions table, which includes
+	// any permissions added with the sync endpoint as well as the built-in ones, and
+	// that no code appears in both lists.
+	codes, err := app.requestModels(r).Permissions.GetAllCodes()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	for _, code := range input.Grant {
+		v.Check(validator.PermittedValue(code, codes...), "grant", fmt.Sprintf("contains unknown permission %q", code))
+	}
+	for _, code := range input.Revoke {
+		v.Check(validator.PermittedValue(code, codes...), "revoke", fmt.Sprintf("contains unknown permission %q", code))
+		v.Check(!data.Permissions(input.Grant).Include(code), "revoke", fmt.Sprintf("must not contain %q as it is also being granted", code))
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Apply the changes. If any of the users don't exist, then nothing is changed and
+	// we report the unknown IDs back to the client.
+	result, err := app.requestModels(r).Permissions.BulkUpdate(userIDs, input.Grant, input.Revoke)
+	if err != nil {
+		var unknownUsersError *data.UnknownUsersError
+
+		switch {
+		case errors.As(err, &unknownUsersError):
+			v.AddError("user_ids", fmt.Sprintf("no matching users found for IDs %v", unknownUsersError.IDs))
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": result}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) resetPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	// Replace the user's permissions with the default set that new users are given
+	// when they register.
+	permissions, err := app.requestModels(r).Permissions.ResetForUser(id, app.config.defaultPermissions...)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showCurrentUserPermissionsHandler returns the permission codes that the current
+// user can actually use, so that clients can decide which parts of their UI to show.
+// These match the checks made by the middleware in routes(): a user who hasn't
+// activated their account can only use the movies:read permission, and only if the
+// -read-requires-activation flag is false. A request authenticated with an API key is
+// also limited to the permissions of the key.
+func (app *application) showCurrentUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	codes, err := app.requestModels(r).Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	key := app.contextGetAPIKey(r)
+
+	permissions := data.Permissions{}
+
+	for _, code := range codes {
+		if !user.Activated && (code != "movies:read" || app.config.readRequiresActivation) {
+			continue
+		}
+
+		if key == nil || key.Permissions.Include(code) {
+			permissions = append(permissions, code)
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The syncPermissionsHandler makes the permissions table match the JSON array of
+// permission codes in the request body, so that the permission catalogue can be
+// managed without writing a migration. Codes in the table which aren't in the array
+// are reported, but they're only deleted if the prune query string parameter is true.
+// The codes which the application relies on can never be pruned.
+func (app *application) syncPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	var codes []string
+
+	err := app.readJSON(w, r, &codes)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	prune := app.readBool(r.URL.Query(), "prune", false, v)
+
+	if data.ValidatePermissionCodes(v, codes); v.Valid() && prune {
+		for _, code := range app.requiredPermissions() {
+			v.Check(slices.Contains(codes, code), "codes", fmt.Sprintf("must contain %q, which is required by the application", code))
+		}
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	result, err := app.requestModels(r).Permissions.Sync(codes, prune)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"sync": result}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The requiredPermissions() method returns the permission codes which the application
+// relies on. These are the codes in the data.PermissionCodes safelist, along with any
+// other codes required by the routes, so it must be called after routes().
+func (app *application) requiredPermissions() []string {
+	required := slices.Clone(data.PermissionCodes)
+	for _, route := range app.routeRegistry {
+		if route.Permission != "" && !slices.Contains(required, route.Permission) {
+			required = append(required, route.Permission)
+		}
+	}
+	return required
+}
+
+// The checkPermissions() method checks that every permission code which the
+// application relies on exists in the permissions table, so it must be called after
+// routes(). If any are missing, which usually means that a migration hasn't been run,
+// then the users who should have them would be refused access. By default we just log
+// a warning, but if the -strict-permissions flag is set then an error listing the
+// missing codes is returned instead.
+func (app *application) checkPermissions() error {
+	required := app.requiredPermissions()
+
+	codes, err := app.models.Permissions.GetAllCodes()
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, code := range required {
+		if !slices.Contains(codes, code) {
+			missing = append(missing, code)
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	if app.config.strictPermissions {
+		return fmt.Errorf("missing permission codes in the permissions table: %s", strings.Join(missing, ", "))
+	}
+
+	app.logger.Warn("missing permission codes in the permissions table", "missing", missing)
+	return nil
+}
+
+// The hasPermission() method reports whether the user making the request has been
+// granted the permission. If the request was authenticated with an API key, then the
+// key must also have been granted it, in the same way as in requirePermission().
+func (app *application) hasPermission(r *http.Request, code string) (bool, error) {
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() {
+		return false, nil
+	}
+
+	permissions, err := app.requestModels(r).Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return false, err
+	}
+
+	if !permissions.Include(code) {
+		return false, nil
+	}
+
+	if key := app.contextGetAPIKey(r); key != nil && !key.Permissions.Include(code) {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// The movieCapabilities map the fields of the GET /v1/users/me/capabilities response
+// to the routes which they describe.
+var movieCapabilities = []struct {
+	name   string
+	method string
+	path   string
+}{
+	{"can_create_movie", http.MethodPost, "/v1/movies"},
+	{"can_edit_movie", http.MethodPatch, "/v1/movies/:id"},
+	{"can_delete_movie", http.MethodDelete, "/v1/movies/:id"},
+}
+
+// The showCurrentUserCapabilitiesHandler tells the current user which of the movie
+// write endpoints they can use, so that clients can decide which buttons to show.
+// Rather than repeating the rules, each capability is worked out from the route
+// registry entry for its endpoint, which records the checks that the route's
+// middleware makes. So if a route's requirements change, the capability changes
+// with it. Everything is false for the anonymous user.
+func (app *application) showCurrentUserCapabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	capabilities := envelope{}
+	for _, capability := range movieCapabilities {
+		capabilities[capability.name] = false
+	}
+
+	if !user.IsAnonymous() {
+		codes, err := app.requestModels(r).Permissions.GetAllForUser(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		key := app.contextGetAPIKey(r)
+
+		for _, capability := range movieCapabilities {
+			i := slices.IndexFunc(app.routeRegistry, func(info routeInfo) bool {
+				return info.Method == capability.method && info.Path == capability.path
+			})
+			if i < 0 {
+				continue
+			}
+
+			info := app.routeRegistry[i]
+
+			allowed := !info.Activated || user.Activated
+			if info.Permission != "" {
+				allowed = allowed && codes.Include(info.Permission) && (key == nil || key.Permissions.Include(info.Permission))
+			}
+
+			capabilities[capability.name] = allowed
+		}
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"capabilities": capabilities}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -2,15 +2,245 @@ package main
 
 import (
 	"expvar"
+	"fmt"
 	"net/http"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
 )
 
+// The staticSegments() helper works around a limitation in httprouter, which doesn't
+// allow a static path segment (like /v1/movies/facets) and a named parameter (like
+// /v1/movies/:id) to be registered at the same position for the same method. It
+// returns a handler which checks the value of the named parameter against the keys
+// in the handlers map, and calls the matching handler if there is one. Otherwise, it
+// calls the fallback handler as normal.
+func (app *application) staticSegments(param string, handlers map[string]http.HandlerFunc, fallback http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := httprouter.ParamsFromContext(r.Context())
+
+		if handler, ok := handlers[params.ByName(param)]; ok {
+			handler(w, r)
+			return
+		}
+
+		fallback(w, r)
+	}
+}
+
+// apiVersions lists the versions of the API which are currently supported. Each one
+// should have a matching route group in routes().
+var apiVersions = []string{"v1"}
+
+// Define a routeInfo struct to describe a registered route for the GET /v1/routes
+// endpoint. The Authenticated and Activated fields record whether the route requires
+// an authenticated or activated user, and Permission holds the permission code that
+// the route requires (if any).
+type routeInfo struct {
+	Method        string `json:"method"`
+	Path          string `json:"path"`
+	Handler       string `json:"handler"`
+	Permission    string `json:"permission,omitempty"`
+	Authenticated bool   `json:"authenticated"`
+	Activated     bool   `json:"activated"`
+	Signed        bool   `json:"signed"`
+}
+
+// Define a route type which pairs a handler, wrapped in any authentication and
+// permission checks, with the description of those checks for the route registry.
+// Routes with listed set to false aren't included in the registry. The maxBodyBytes
+// field is the largest request body the handler accepts, which requireSignature()
+// uses when the route is signed. If it's 0, the readJSON() limit is assumed.
+type route struct {
+	handler      http.HandlerFunc
+	info         routeInfo
+	listed       bool
+	maxBodyBytes int64
+}
+
+// The withMaxBodyBytes() method returns a copy of the route with the given request
+// body limit, for handlers which accept larger bodies than readJSON().
+func (r route) withMaxBodyBytes(n int64) route {
+	r.maxBodyBytes = n
+	return r
+}
+
+// The publicRoute() method returns a route for a handler which anyone can use.
+func (app *application) publicRoute(next http.HandlerFunc) route {
+	return route{
+		handler: next,
+		info:    routeInfo{Handler: handlerName(next)},
+		listed:  true,
+	}
+}
+
+// The authenticatedRoute() method returns a route for a handler which requires an
+// authenticated (but not necessarily activated) user.
+func (app *application) authenticatedRoute(next http.HandlerFunc) route {
+	return route{
+		handler: app.requireAuthenticatedUser(next),
+		info:    routeInfo{Handler: handlerName(next), Authenticated: true},
+		listed:  true,
+	}
+}
+
+// The readRoute() method returns a route for a read-only handler which requires the
+// given permission. Activation is only required if the -read-requires-activation
+// flag is set.
+func (app *application) readRoute(code string, next http.HandlerFunc) route {
+	return route{
+		handler: app.requireReadPermission(code, next),
+		info: routeInfo{
+			Handler:       handlerName(next),
+			Permission:    code,
+			Authenticated: true,
+			Activated:     app.config.readRequiresActivation,
+		},
+		listed: true,
+	}
+}
+
+// The activatedRoute() method returns a route for a handler which requires an
+// activated user with the given permission. It's used for the endpoints which change
+// data and for all of the admin endpoints.
+func (app *application) activatedRoute(code string, next http.HandlerFunc) route {
+	return route{
+		handler: app.requirePermission(code, next),
+		info: routeInfo{
+			Handler:       handlerName(next),
+			Permission:    code,
+			Authenticated: true,
+			Activated:     true,
+		},
+		listed: true,
+	}
+}
+
+// The signedRoute() method wraps a route with the requireSignature() middleware if
+// it's one of the routes in the -signature-routes flag. Otherwise the route is
+// returned unchanged.
+func (app *application) signedRoute(method, path string, r route) route {
+	if !slices.Contains(app.config.signature.routes, method+" "+path) {
+		return r
+	}
+
+	maxBytes := r.maxBodyBytes
+	if maxBytes == 0 {
+		maxBytes = maxSignedBodyBytes
+	}
+
+	r.handler = app.requireSignature(r.handler, maxBytes)
+	r.info.Signed = true
+	return r
+}
+
+// The checkSignedRoutes() method checks that every route in the -signature-routes
+// flag matched a registered route, so that a typo doesn't silently leave a route
+// without signature checks. It must be called after routes().
+func (app *application) checkSignedRoutes() error {
+	for _, signed := range app.config.signature.routes {
+		found := slices.ContainsFunc(app.routeRegistry, func(info routeInfo) bool {
+			return info.Signed && info.Method+" "+info.Path == signed
+		})
+		if !found {
+			return fmt.Errorf("invalid -signature-routes value: no route matches %q", signed)
+		}
+	}
+	return nil
+}
+
+// The unlistedRoute() function returns a route which isn't included in the registry.
+// It's used for the fallback handlers which only send error responses.
+func unlistedRoute(next http.HandlerFunc) route {
+	return route{handler: next}
+}
+
+// The handlerName() function returns the name of a handler function, like
+// "listMoviesHandler", using the runtime information for the function. The package
+// path, receiver type and the "-fm" suffix added to method values are removed.
+func handlerName(handler http.HandlerFunc) string {
+	fn := runtime.FuncForPC(reflect.ValueOf(handler).Pointer())
+	if fn == nil {
+		return ""
+	}
+
+	name := fn.Name()
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+
+	return strings.TrimSuffix(name, "-fm")
+}
+
+// The registerRoute() method adds a route to the registry which is returned by the
+// GET /v1/routes endpoint.
+func (app *application) registerRoute(method, path string, r route) {
+	if !r.listed {
+		return
+	}
+
+	info := r.info
+	info.Method = method
+	info.Path = path
+	app.routeRegistry = append(app.routeRegistry, info)
+}
+
+// Define a routeGroup type which registers routes on a router with a common API
+// version prefix. The paths passed to its methods are relative to the version, so
+// for example "/movies" in the v1 group is registered as "/v1/movies".
+type routeGroup struct {
+	app     *application
+	router  *httprouter.Router
+	version string
+}
+
+// The routeGroup() method returns a new routeGroup for the given API version.
+func (app *application) routeGroup(router *httprouter.Router, version string) routeGroup {
+	return routeGroup{app: app, router: router, version: version}
+}
+
+// HandlerFunc() registers a handler function for the given method and version-relative
+// path. The handler is added to the route registry as a public route, so it should
+// only be used for handlers which don't need any authentication.
+func (g routeGroup) HandlerFunc(method, path string, handler http.HandlerFunc) {
+	g.Handle(method, path, g.app.publicRoute(handler))
+}
+
+// Handle() registers a route for the given method and version-relative path, and adds
+// it to the route registry.
+func (g routeGroup) Handle(method, path string, r route) {
+	r = g.app.signedRoute(method, "/"+g.version+path, r)
+	g.router.HandlerFunc(method, "/"+g.version+path, r.handler)
+	g.app.registerRoute(method, "/"+g.version+path, r)
+}
+
+// HandleSegments() registers a route using the staticSegments() helper. Each of the
+// segments is added to the route registry separately, with the named parameter in
+// the path replaced by the static segment, so that the registry shows the paths that
+// clients actually use.
+func (g routeGroup) HandleSegments(method, path, param string, segments map[string]route, fallback route) {
+	handlers := make(map[string]http.HandlerFunc, len(segments))
+	for segment, r := range segments {
+		r = g.app.signedRoute(method, "/"+g.version+strings.Replace(path, ":"+param, segment, 1), r)
+		handlers[segment] = r.handler
+		g.app.registerRoute(method, "/"+g.version+strings.Replace(path, ":"+param, segment, 1), r)
+	}
+
+	fallback = g.app.signedRoute(method, "/"+g.version+path, fallback)
+	g.router.HandlerFunc(method, "/"+g.version+path, g.app.staticSegments(param, handlers, fallback.handler))
+	g.app.registerRoute(method, "/"+g.version+path, fallback)
+}
+
 func (app *application) routes() http.Handler {
 	// Initialize a new httprouter router instance.
 	router := httprouter.New()
 
+	// Clear the route registry, so that it only contains the routes registered below.
+	app.routeRegistry = nil
+
 	// Convert the notFoundResponse() helper to a http.Handler using the
 	// http.HandlerFunc() adapter, and then set it as the custom error handler for 404
 	// Not Found responses.
@@ -20,11 +250,16 @@ func (app *application) routes() http.Handler {
 	// it as the custom error handler for 405 Method Not Allowed responses.
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 
+	// Create a route group for version 1 of the API. Routes registered on the group
+	// are automatically prefixed with /v1, so adding a new version later only means
+	// creating another group.
+	v1 := app.routeGroup(router, "v1")
+
 	// Register the relevant methods, URL patterns and handler functions for our
 	// endpoints using the HandlerFunc() method. Note that http.MethodGet and
 	// http.MethodPost are constants which equate to the strings "GET" and "POST"
 	// respectively.
-	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	v1.HandlerFunc(http.MethodGet, "/healthcheck", app.healthcheckHandler)
 
 	/*
 		// Add the route for the GET /v1/movies endpoint.
@@ -49,24 +284,106 @@ func (app *application) routes() http.Handler {
 	  router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requireActivatedUser(app.deleteMovieHandler))
 	*/
 
-	// Use the requirePermission() middleware on each of the /v1/movies** endpoints,
-	// passing in the required permission code as the first parameter.
-	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermission("movies:read", app.listMoviesHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission("movies:write", app.createMovieHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission("movies:read", app.showMovieHandler))
-	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movies:write", app.updateMovieHandler))
-	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.deleteMovieHandler))
+	// Register the remaining routes using the Handle() method, so that the checks that
+	// each route is wrapped in are recorded in the route registry along with it. The
+	// readRoute() and activatedRoute() helpers wrap the handler in the
+	// requireReadPermission() and requirePermission() middleware respectively, which
+	// check the permission and whether the user needs to be activated.
+	v1.Handle(http.MethodGet, "/movies", app.readRoute("movies:read", app.listMoviesHandler))
+	v1.Handle(http.MethodPost, "/movies", app.activatedRoute("movies:write", app.createMovieHandler))
+	// Other POST requests to /v1/movies/:id aren't supported.
+	v1.HandleSegments(http.MethodPost, "/movies/:id", "id", map[string]route{
+		"import.csv": app.activatedRoute("admin:write", app.importMoviesCSVHandler).withMaxBodyBytes(app.config.importMaxBytes),
+	}, unlistedRoute(app.methodNotAllowedResponse))
+	v1.Handle(http.MethodPost, "/movies/:id/duplicate", app.activatedRoute("movies:write", app.duplicateMovieHandler))
+	v1.HandleSegments(http.MethodGet, "/movies/:id", "id", map[string]route{
+		"facets":     app.readRoute("movies:read", app.movieFacetsHandler),
+		"random":     app.readRoute("movies:read", app.randomMoviesHandler),
+		"recent":     app.readRoute("movies:read", app.recentMoviesHandler),
+		"events":     app.readRoute("movies:read", app.movieEventsHandler),
+		"by-year":    app.readRoute("movies:read", app.moviesByYearHandler),
+		"pagination": app.readRoute("movies:read", app.moviePaginationHandler),
+	}, app.readRoute("movies:read", app.showMovieHandler))
+	// The GET /v1/movies/:id/diff route shares its position with the :slug parameter
+	// too, so requests which aren't for a slug are dispatched on the second segment
+	// instead. As the dispatch is nested, the diff route is added to the registry
+	// separately.
+	movieDiff := app.readRoute("movies:read", app.movieDiffHandler)
+	v1.HandleSegments(http.MethodGet, "/movies/:id/:slug", "id", map[string]route{
+		"slug": app.readRoute("movies:read", app.showMovieBySlugHandler),
+	}, unlistedRoute(app.staticSegments("slug", map[string]http.HandlerFunc{
+		"diff": movieDiff.handler,
+	}, app.notFoundResponse)))
+	app.registerRoute(http.MethodGet, "/v1/movies/:id/diff", movieDiff)
+	// Likewise, the history route is registered with the :slug parameter name.
+	v1.HandleSegments(http.MethodGet, "/movies/:id/:slug/:version", "slug", map[string]route{
+		"history": app.readRoute("movies:read", app.showMovieVersionHandler),
+	}, unlistedRoute(app.notFoundResponse))
+	v1.Handle(http.MethodPatch, "/movies", app.activatedRoute("movies:write", app.updateManyMoviesHandler))
+	v1.Handle(http.MethodPatch, "/movies/:id", app.activatedRoute("movies:write", app.updateMovieHandler))
+	v1.Handle(http.MethodPatch, "/movies/:id/genres", app.activatedRoute("movies:write", app.patchMovieGenresHandler))
+	v1.Handle(http.MethodDelete, "/movies/:id", app.activatedRoute("movies:write", app.deleteMovieHandler))
+	v1.Handle(http.MethodPut, "/movies/:id/translations/:lang", app.activatedRoute("movies:write", app.putMovieTranslationHandler))
+	v1.Handle(http.MethodPost, "/movies/:id/tags", app.activatedRoute("movies:write", app.addMovieTagsHandler))
+	v1.Handle(http.MethodDelete, "/movies/:id/tags/:tag", app.activatedRoute("movies:write", app.removeMovieTagHandler))
+
+	v1.Handle(http.MethodGet, "/genres", app.readRoute("movies:read", app.listGenresHandler))
+	v1.Handle(http.MethodPost, "/genres/validate", app.readRoute("movies:read", app.validateGenresHandler))
+	v1.Handle(http.MethodGet, "/genres/synonyms", app.readRoute("movies:read", app.genreSynonymsHandler))
+
+	v1.HandlerFunc(http.MethodPost, "/users", app.registerUserHandler)
+	v1.HandlerFunc(http.MethodPut, "/users/activated", app.activateUserHandler)
+	// The POST /v1/users/activate-bulk route shares its position with the :id
+	// parameter of the permissions reset route below, so it's dispatched via the
+	// staticSegments() helper.
+	v1.HandleSegments(http.MethodPost, "/users/:id", "id", map[string]route{
+		"activate-bulk": app.activatedRoute("admin:write", app.bulkActivateUsersHandler),
+	}, unlistedRoute(app.notFoundResponse))
+	v1.Handle(http.MethodPost, "/users/:id/permissions/reset", app.activatedRoute("admin:write", app.resetPermissionsHandler))
+	v1.Handle(http.MethodGet, "/users/me/permissions", app.authenticatedRoute(app.showCurrentUserPermissionsHandler))
+	// Anonymous users can check their capabilities too, which are all false.
+	v1.Handle(http.MethodGet, "/users/me/capabilities", app.publicRoute(app.showCurrentUserCapabilitiesHandler))
+	// Users can rotate their own credentials with "me" as the ID, and admins can
+	// rotate the credentials of any other user.
+	v1.HandleSegments(http.MethodPost, "/users/:id/rotate-credentials", "id", map[string]route{
+		"me": app.authenticatedRoute(app.rotateCredentialsHandler),
+	}, app.activatedRoute("admin:write", app.rotateUserCredentialsHandler))
+	v1.Handle(http.MethodGet, "/users/stats", app.activatedRoute("admin:read", app.userStatsHandler))
 
-	// Add the route for the POST /v1/users endpoint.
-	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
-	// Add the route for the PUT /v1/users/activated endpoint.
-	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	v1.HandlerFunc(http.MethodPost, "/tokens/authentication", app.createAuthenticationTokenHandler)
+	v1.HandlerFunc(http.MethodGet, "/tokens/authentication/status", app.authenticationTokenStatusHandler)
 
-	// Add the route for the POST /v1/tokens/authentication endpoint.
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	v1.Handle(http.MethodPost, "/api-keys", app.activatedRoute("admin:write", app.createAPIKeyHandler))
+	v1.Handle(http.MethodDelete, "/api-keys/:id", app.activatedRoute("admin:write", app.deleteAPIKeyHandler))
+
+	v1.Handle(http.MethodPost, "/permissions/bulk", app.activatedRoute("admin:write", app.bulkUpdatePermissionsHandler))
+
+	// The email previews are restricted to users with the admin:read permission in
+	// every environment, as staging servers are often reachable by more people than
+	// the developers.
+	v1.Handle(http.MethodGet, "/admin/email-preview", app.activatedRoute("admin:read", app.emailPreviewHandler))
+
+	v1.Handle(http.MethodPost, "/admin/maintenance/analyze", app.activatedRoute("admin:write", app.analyzeHandler))
+	v1.Handle(http.MethodGet, "/admin/jobs", app.activatedRoute("admin:read", app.listJobsHandler))
+	v1.Handle(http.MethodGet, "/admin/db-stats", app.activatedRoute("admin:read", app.dbStatsHandler))
+	v1.Handle(http.MethodGet, "/admin/movies/explain", app.activatedRoute("admin:read", app.explainMoviesHandler))
+	v1.Handle(http.MethodGet, "/admin/tasks/:id", app.activatedRoute("admin:read", app.showTaskHandler))
+	v1.Handle(http.MethodPost, "/admin/permissions/sync", app.activatedRoute("admin:write", app.syncPermissionsHandler))
+	v1.Handle(http.MethodGet, "/admin/audit/verify", app.activatedRoute("admin:read", app.verifyAuditChainHandler))
+	v1.Handle(http.MethodGet, "/admin/tokens", app.activatedRoute("admin:read", app.listTokensHandler))
+
+	// Add the route for listing all of the registered routes.
+	v1.Handle(http.MethodGet, "/routes", app.activatedRoute("admin:read", app.listRoutesHandler))
 
 	// Register a new GET /debug/vars endpoint pointing to the expvar handler.
 	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
+	app.registerRoute(http.MethodGet, "/debug/vars", route{info: routeInfo{Handler: "expvar.Handler"}, listed: true})
+
+	// Register the HTML status page. Like /debug/vars, it isn't part of a versioned
+	// API.
+	statusPage := app.publicRoute(app.statusPageHandler)
+	router.HandlerFunc(http.MethodGet, "/status", statusPage.handler)
+	app.registerRoute(http.MethodGet, "/status", statusPage)
 
 	// Return the httprouter instance.
 	// return router
@@ -84,5 +401,54 @@ func (app *application) routes() http.Handler {
 	// return app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router))))
 
 	// Use the new metrics() middleware at the start of the chain.
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+	// return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+
+	// Add the secureHeaders() middleware, before the CORS checks so that any HTTPS
+	// redirect happens as early as possible.
+	// return app.metrics(app.recoverPanic(app.secureHeaders(app.enableCORS(app.rateLimit(app.authenticate(router))))))
+
+	// Add the apiVersion() middleware, which records the API version of the request
+	// and rejects unknown versions before any further work is done.
+	// return app.metrics(app.recoverPanic(app.secureHeaders(app.apiVersion(app.enableCORS(app.rateLimit(app.authenticate(router)))))))
+
+	// Give each request an ID straight after the panic recovery, so that the ID is
+	// available everywhere else, and add the (optional) body logging after it.
+	// return app.metrics(app.recoverPanic(app.requestID(app.logBodies(app.secureHeaders(app.apiVersion(app.enableCORS(app.rateLimit(app.authenticate(router)))))))))
+
+	// Count the in-flight requests right at the start of the chain, so that every
+	// request is included for the whole time that it's being processed.
+	// return app.trackInFlight(app.metrics(app.recoverPanic(app.requestID(app.logBodies(app.secureHeaders(app.apiVersion(app.enableCORS(app.rateLimit(app.authenticate(router))))))))))
+
+	// Decompress gzipped request bodies before the body logging, so that the logged
+	// request bodies are readable.
+	// return app.trackInFlight(app.metrics(app.recoverPanic(app.requestID(app.decompressRequest(app.logBodies(app.secureHeaders(app.apiVersion(app.enableCORS(app.rateLimit(app.authenticate(router)))))))))))
+
+	// Reject requests without a User-Agent header (if enabled) straight after the
+	// panic recovery and request ID, so that they're turned away before any other
+	// work is done, including the rate limiting. The access log is written inside
+	// the request ID middleware, so that every entry includes the ID. Trailing slash
+	// redirects happen last, just before the router.
+	// return app.trackInFlight(app.metrics(app.recoverPanic(app.requestID(app.logRequest(app.requestTimeout(app.requireUserAgent(app.decompressRequest(app.logBodies(app.secureHeaders(app.apiVersion(app.enableCORS(app.rateLimit(app.authenticate(app.redirectTrailingSlash(router)))))))))))))))
+
+	// Add the serverTiming() middleware outside everything except the in-flight count
+	// and metrics, so that the total time covers as much of the request as possible.
+	// return app.trackInFlight(app.metrics(app.serverTiming(app.recoverPanic(app.requestID(app.logRequest(app.requestTimeout(app.requireUserAgent(app.decompressRequest(app.logBodies(app.secureHeaders(app.apiVersion(app.enableCORS(app.rateLimit(app.authenticate(app.redirectTrailingSlash(router))))))))))))))))
+
+	// The timezone() middleware goes just outside the router, so that its response
+	// writer is the one which the handlers are given.
+	// return app.trackInFlight(app.metrics(app.serverTiming(app.recoverPanic(app.requestID(app.logRequest(app.requestTimeout(app.requireUserAgent(app.decompressRequest(app.logBodies(app.secureHeaders(app.apiVersion(app.enableCORS(app.rateLimit(app.authenticate(app.timezone(app.redirectTrailingSlash(router)))))))))))))))))
+
+	// Rate limiting by user needs the user from authenticate(), so in that case the
+	// per-user limit is added after it. The IP limit in rateLimit() still runs first,
+	// so that requests with bad credentials are limited too.
+	limited := app.rateLimit(app.authenticate(app.timezone(app.redirectTrailingSlash(router))))
+	if app.config.limiter.key == "user" {
+		limited = app.rateLimit(app.authenticate(app.rateLimitUser(app.timezone(app.redirectTrailingSlash(router)))))
+	}
+
+	// return app.trackInFlight(app.metrics(app.serverTiming(app.recoverPanic(app.requestID(app.logRequest(app.requestTimeout(app.requireUserAgent(app.decompressRequest(app.logBodies(app.secureHeaders(app.apiVersion(app.enableCORS(limited)))))))))))))
+
+	// The recoverPanic() middleware goes inside logRequest(), so that the 500 response
+	// it sends for a panic still gets an access log entry.
+	return app.trackInFlight(app.metrics(app.serverTiming(app.requestID(app.logRequest(app.recoverPanic(app.requestTimeout(app.requireUserAgent(app.decompressRequest(app.logBodies(app.secureHeaders(app.apiVersion(app.enableCORS(limited)))))))))))))
 }
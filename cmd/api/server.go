@@ -14,15 +14,33 @@ import (
 
 func (app *application) serve() error {
 	// Declare a HTTP server using the same settings as in our main() function.
+	// Build the routes first, so that the permission codes which they require are in
+	// the route registry for the permissions check.
+	handler := app.routes()
+
+	err := app.checkPermissions()
+	if err != nil {
+		return err
+	}
+
+	err = app.checkSignedRoutes()
+	if err != nil {
+		return err
+	}
+
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%d", app.config.port),
-		Handler:      app.routes(),
+		Handler:      handler,
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		ErrorLog:     slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
 	}
 
+	// Disconnect the event stream clients as soon as the shutdown starts, as their
+	// requests would otherwise never finish.
+	srv.RegisterOnShutdown(app.movieEvents.close)
+
 	// Create a shutdownError channel. We will use this to receive any errors returned
 	// by the graceful Shutdown() function.
 	shutdownError := make(chan error)
@@ -47,7 +65,11 @@ func (app *application) serve() error {
 		// app.logger.Info("caught signal", "signal", s.String())
 
 		// Update the log entry to say "shutting down server" instead of "caught signal".
-		app.logger.Info("shutting down server", "signal", s.String())
+		// app.logger.Info("shutting down server", "signal", s.String())
+
+		// Include the number of requests which are still being processed, so that
+		// operators can see how much work there is left to drain.
+		app.logger.Info("shutting down server", "signal", s.String(), "in_flight", app.inFlight.Load())
 
 		// Create a context with a 30-second timeout.
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -62,7 +84,18 @@ func (app *application) serve() error {
 
 		// Call Shutdown() on the server like before, but now we only send on the
 		// shutdownError channel if it returns an error.
+		// While Shutdown() waits for the in-flight requests to complete, log how many
+		// are left once a second so that the progress is visible.
+		done := make(chan struct{})
+		go app.logInFlight(done, time.Second)
+
 		err := srv.Shutdown(ctx)
+		close(done)
+
+		// Log the final state. If the timeout elapsed then there may still be some
+		// requests in flight.
+		app.logger.Info("finished draining requests", "in_flight", app.inFlight.Load(), "timed_out", errors.Is(err, context.DeadlineExceeded))
+
 		if err != nil {
 			shutdownError <- err
 		}
@@ -78,6 +111,9 @@ func (app *application) serve() error {
 		// blocking until the background goroutines have finished. Then we return nil on
 		// the shutdownError channel, to indicate that the shutdown completed without
 		// any issues.
+		// Cancel the background context first, so that background tasks which are
+		// waiting to retry something give up rather than delaying the shutdown.
+		app.cancelBackground()
 		app.wg.Wait()
 		shutdownError <- nil
 	}()
@@ -93,7 +129,7 @@ func (app *application) serve() error {
 	// good thing and an indication that the graceful shutdown has started. So we check
 	// specifically for this, only returning the error if it is NOT
 	// http.ErrServerClosed.
-	err := srv.ListenAndServe()
+	err = srv.ListenAndServe()
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
@@ -112,3 +148,19 @@ func (app *application) serve() error {
 
 	return nil
 }
+
+// The logInFlight() method logs the number of in-flight requests every interval
+// until the done channel is closed.
+func (app *application) logInFlight(done <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			app.logger.Info("waiting for in-flight requests", "in_flight", app.inFlight.Load())
+		}
+	}
+}
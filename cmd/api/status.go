@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/subtle"
+	"embed"
+	"expvar"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+// Embed the templates directory, which holds the HTML status page, so that the
+// binary doesn't need any external files.
+
+//go:embed "templates"
+var templateFS embed.FS
+
+// Parse the status page template when the application starts, so that a mistake in
+// the template is caught straight away rather than on the first request.
+var statusTemplate = template.Must(template.ParseFS(templateFS, "templates/status.tmpl"))
+
+// The number of seconds between refreshes of the status page.
+const statusRefreshSeconds = 10
+
+// Define a statusPage struct to hold the data for the status page template. Details
+// is nil when the details shouldn't be shown to the client.
+type statusPage struct {
+	Status            string
+	DatabaseAvailable bool
+	CheckedAt         time.Time
+	Refresh           int
+	Details           *statusDetails
+}
+
+// Define a statusDetails struct to hold the parts of the status page which are only
+// shown in development, or to clients who provide the -status-secret value.
+type statusDetails struct {
+	Version          string
+	Environment      string
+	Uptime           time.Duration
+	RequestsReceived int64
+	ResponsesSent    int64
+	InFlight         int64
+	OpenConnections  int
+}
+
+// The statusPageHandler serves a small HTML page for on-call engineers, showing
+// whether the API and its database are available. The version, environment, uptime
+// and request counts are only included in development, or if the secret query string
+// parameter matches the -status-secret flag.
+func (app *application) statusPageHandler(w http.ResponseWriter, r *http.Request) {
+	page := statusPage{
+		Status:            "available",
+		DatabaseAvailable: true,
+		CheckedAt:         time.Now(),
+		Refresh:           statusRefreshSeconds,
+	}
+
+	err := app.requestModels(r).Maintenance.Ping()
+	if err != nil {
+		app.logger.Warn("status page database check failed", "error", err.Error())
+		page.Status = "degraded"
+		page.DatabaseAvailable = false
+	}
+
+	if app.showStatusDetails(r) {
+		page.Details = &statusDetails{
+			Version:          version,
+			Environment:      app.config.env,
+			Uptime:           time.Since(app.startedAt).Round(time.Second),
+			RequestsReceived: expvarInt("total_requests_received"),
+			ResponsesSent:    expvarInt("total_responses_sent"),
+			InFlight:         app.inFlight.Load(),
+			OpenConnections:  app.requestModels(r).Maintenance.PoolStats().OpenConnections,
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+
+	// The default Content-Security-Policy set by the secureHeaders() middleware blocks
+	// everything, including the inline styles on the page, so relax it to allow them.
+	if w.Header().Get("Content-Security-Policy") != "" {
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; frame-ancestors 'none'")
+	}
+
+	// Send a 503 if the database is unavailable, so that the page can also be used by
+	// simple uptime checkers.
+	status := http.StatusOK
+	if !page.DatabaseAvailable {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.WriteHeader(status)
+
+	err = statusTemplate.Execute(w, page)
+	if err != nil {
+		// The headers have already been sent, so all we can do is log the error.
+		app.logger.Error("failed to render status page", "error", err.Error())
+	}
+}
+
+// The showStatusDetails() method reports whether the status page details can be shown
+// to the client. They're always shown in development. Otherwise they're only shown if
+// the -status-secret flag is set and the secret query string parameter matches it.
+func (app *application) showStatusDetails(r *http.Request) bool {
+	if app.config.env == "development" {
+		return true
+	}
+
+	if app.config.statusSecret == "" {
+		return false
+	}
+
+	secret := r.URL.Query().Get("secret")
+
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(app.config.statusSecret)) == 1
+}
+
+// The expvarInt() helper returns the value of a published expvar integer, or 0 if it
+// hasn't been published.
+func expvarInt(name string) int64 {
+	v, ok := expvar.Get(name).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"greenlight.nicolasleigh.net/internal/data"
+	"greenlight.nicolasleigh.net/internal/validator"
+)
+
+// The addMovieTagsHandler adds the tags in the request body to a movie. Tags which
+// the movie already has are ignored, so adding the same tags twice has the same
+// effect as adding them once.
+func (app *application) addMovieTagsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Tags []string `json:"tags"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	for i, tag := range input.Tags {
+		input.Tags[i] = strings.TrimSpace(tag)
+	}
+
+	v := validator.New()
+
+	v.Check(len(input.Tags) >= 1, "tags", "must contain at least 1 tag")
+	if data.ValidateTags(v, input.Tags); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movie, err := app.requestModels(r).Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	tags := slices.Clone(movie.Tags)
+	for _, tag := range input.Tags {
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+
+	// Only save the tags if any of them are new, so that the version isn't changed
+	// when nothing has.
+	if len(tags) > len(movie.Tags) {
+		v.Check(len(tags) <= data.MaxMovieTags, "tags", fmt.Sprintf("must not take the movie over %d tags", data.MaxMovieTags))
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		movie.Tags = tags
+
+		if !app.saveMovieTags(w, r, movie) {
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The removeMovieTagHandler removes a single tag from a movie. If the movie doesn't
+// have the tag, then a 404 Not Found response is sent.
+func (app *application) removeMovieTagHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	tag := httprouter.ParamsFromContext(r.Context()).ByName("tag")
+
+	movie, err := app.requestModels(r).Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !slices.Contains(movie.Tags, tag) {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	movie.Tags = slices.DeleteFunc(slices.Clone(movie.Tags), func(t string) bool {
+		return t == tag
+	})
+
+	if !app.saveMovieTags(w, r, movie) {
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The saveMovieTags() helper saves the tags of a movie and publishes the update
+// event. If saving fails, then it sends the error response and returns false.
+func (app *application) saveMovieTags(w http.ResponseWriter, r *http.Request, movie *data.Movie) bool {
+	err := app.requestModels(r).Movies.UpdateTags(movie)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return false
+	}
+
+	app.movieEvents.publish(movieUpdatedEvent, envelope{"movie": movie})
+	return true
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// The statuses of a background task.
+const (
+	taskPending   = "pending"
+	taskRunning   = "running"
+	taskCompleted = "completed"
+	taskFailed    = "failed"
+)
+
+// The maximum number of tasks which are remembered. Once there are more, the oldest
+// finished tasks are forgotten.
+const maxTasks = 100
+
+// Define a task struct to describe a one-off background task, like the reindex after
+// a CSV import, for the admin endpoint. Progress holds a short description of what
+// the task is currently doing, and Error is only set if the task failed.
+type task struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Status     string     `json:"status"`
+	Progress   string     `json:"progress,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// Define a taskRegistry type to keep track of the background tasks in memory, so the
+// task state is lost when the application restarts. The tasks are run one at a time,
+// so that two imports in quick succession don't reindex the same table at once.
+type taskRegistry struct {
+	mu     sync.Mutex
+	run    sync.Mutex
+	nextID int64
+	tasks  map[int64]*task
+}
+
+func newTaskRegistry() *taskRegistry {
+	return &taskRegistry{tasks: make(map[int64]*task)}
+}
+
+// The add() method records a new pending task and returns its ID.
+func (tr *taskRegistry) add(name string) int64 {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	tr.nextID++
+	tr.tasks[tr.nextID] = &task{
+		ID:        tr.nextID,
+		Name:      name,
+		Status:    taskPending,
+		CreatedAt: time.Now(),
+	}
+
+	// The IDs are sequential, so the lowest IDs belong to the oldest tasks. Tasks
+	// which haven't finished yet are never forgotten.
+	if len(tr.tasks) > maxTasks {
+		ids := make([]int64, 0, len(tr.tasks))
+		for id := range tr.tasks {
+			ids = append(ids, id)
+		}
+		slices.Sort(ids)
+
+		for _, id := range ids {
+			if len(tr.tasks) <= maxTasks {
+				break
+			}
+			if t := tr.tasks[id]; t.Status == taskCompleted || t.Status == taskFailed {
+				delete(tr.tasks, id)
+			}
+		}
+	}
+
+	return tr.nextID
+}
+
+// The update() method calls fn with the task, while holding the lock.
+func (tr *taskRegistry) update(id int64, fn func(t *task)) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if t, ok := tr.tasks[id]; ok {
+		fn(t)
+	}
+}
+
+// The get() method returns a copy of the task with the given ID. If there's no such
+// task, then it returns false as the second value.
+func (tr *taskRegistry) get(id int64) (task, bool) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	t, ok := tr.tasks[id]
+	if !ok {
+		return task{}, false
+	}
+	return *t, true
+}
+
+// The startTask() method runs fn as a background task, using the background() helper,
+// and returns the task ID straight away. The fn function is passed a progress function
+// which it can call to update the task's progress description.
+func (app *application) startTask(name string, fn func(progress func(string)) error) int64 {
+	id := app.tasks.add(name)
+
+	app.background(func() {
+		app.tasks.run.Lock()
+		defer app.tasks.run.Unlock()
+
+		start := time.Now()
+		app.tasks.update(id, func(t *task) {
+			t.Status = taskRunning
+			t.StartedAt = &start
+		})
+
+		app.logger.Info("started task", "task_id", id, "name", name)
+
+		err := fn(func(progress string) {
+			app.tasks.update(id, func(t *task) {
+				t.Progress = progress
+			})
+		})
+
+		finish := time.Now()
+		app.tasks.update(id, func(t *task) {
+			t.FinishedAt = &finish
+			if err != nil {
+				t.Status = taskFailed
+				t.Error = err.Error()
+				return
+			}
+			t.Status = taskCompleted
+			t.Progress = ""
+		})
+
+		if err != nil {
+			app.logger.Error("task failed", "task_id", id, "name", name, "error", err.Error())
+			return
+		}
+
+		app.logger.Info("completed task", "task_id", id, "name", name, "duration", finish.Sub(start).String())
+	})
+
+	return id
+}
+
+// The reindexMoviesTask() method rebuilds the indexes on the movies table one at a
+// time and then refreshes its planner statistics. Rebuilding the indexes separately
+// means that each one is only locked while it's being rebuilt, rather than all of
+// them for the whole task. The queries use the background context, so the task is
+// cancelled if the application shuts down.
+func (app *application) reindexMoviesTask(progress func(string)) error {
+	maintenance := app.models.WithContext(app.backgroundCtx).Maintenance
+
+	indexes, err := maintenance.ListIndexes("movies")
+	if err != nil {
+		return err
+	}
+
+	for i, index := range indexes {
+		progress(fmt.Sprintf("reindexing %s (%d of %d)", index, i+1, len(indexes)))
+
+		err := maintenance.ReindexIndex(index)
+		if err != nil {
+			return err
+		}
+
+		app.logger.Info("reindexed index", "index", index, "done", i+1, "total", len(indexes))
+	}
+
+	progress("analyzing movies")
+
+	return maintenance.AnalyzeTable("movies")
+}
+
+// The showTaskHandler returns the status of a background task.
+func (app *application) showTaskHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	t, ok := app.tasks.get(id)
+	if !ok {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"task": t}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strings"
 	"time"
 
 	"greenlight.nicolasleigh.net/internal/data"
@@ -34,7 +35,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	// Lookup the user record based on the email address. If no matching user was
 	// found, then we call the app.invalidCredentialsResponse() helper to send a 401
 	// Unauthorized response to the client (we will create this helper in a moment).
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.requestModels(r).Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -61,7 +62,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 
 	// Otherwise, if the password is correct, we generate a new token with a 24-hour
 	// expiry time and the scope 'authentication'.
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	token, err := app.requestModels(r).Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -74,3 +75,193 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// The authenticationTokenStatusHandler reports on the bearer token used to make the
+// request: its scope, when it expires, and whether the user's account is activated.
+// It doesn't change anything, so clients can use it as a cheap check that their token
+// is still valid. Invalid and expired tokens have already been rejected with a 401 by
+// the authenticate() middleware by the time this handler is called.
+func (app *application) authenticationTokenStatusHandler(w http.ResponseWriter, r *http.Request) {
+	// This endpoint only makes sense for requests authenticated with a bearer token,
+	// so reject anonymous requests and those authenticated with an API key.
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() || app.contextGetAPIKey(r) != nil {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	plaintext, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	// Look up the token again to find its expiry time. If it has expired since the
+	// middleware checked it, then we treat it as invalid.
+	token, err := app.requestModels(r).Tokens.GetForPlaintext(data.ScopeAuthentication, plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Only include the details of the token that are safe to share. In particular,
+	// the plaintext token and its hash are never included.
+	status := envelope{
+		"scope":     token.Scope,
+		"expiry":    token.Expiry,
+		"user_id":   token.UserID,
+		"activated": user.Activated,
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"token_status": status}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The rotateCredentialsHandler signs the current user out everywhere, by deleting all
+// of their authentication tokens and API keys, and then sends them a new
+// authentication token. The user's current password must be provided, so that a
+// stolen token can't be used to lock the user out.
+func (app *application) rotateCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidatePasswordPlaintext(v, input.Password)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	token, revoked, err := app.requestModels(r).Tokens.RotateForUser(user.ID, 24*time.Hour)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.Info("rotated credentials", "user_id", user.ID, "by_user_id", user.ID, "request_id", app.contextGetRequestID(r), "tokens_deleted", revoked.Tokens, "api_keys_deleted", revoked.APIKeys)
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token, "revoked": revoked}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The rotateUserCredentialsHandler is the admin version of rotateCredentialsHandler,
+// for signing another user out everywhere. It deletes all of the user's
+// authentication tokens and API keys, but doesn't create a new token, as that should
+// only ever be sent to the user themselves. They can sign in again with their
+// password.
+func (app *application) rotateUserCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	_, err = app.requestModels(r).Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	_, revoked, err := app.requestModels(r).Tokens.RotateForUser(id, 0)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	admin := app.contextGetUser(r)
+
+	app.logger.Info("rotated credentials", "user_id", id, "by_user_id", admin.ID, "request_id", app.contextGetRequestID(r), "tokens_deleted", revoked.Tokens, "api_keys_deleted", revoked.APIKeys)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"revoked": revoked}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listTokensHandler returns a page of the tokens which haven't expired, for
+// auditing by administrators. The results can be filtered by scope and user ID.
+// The token holders' email addresses are masked for viewers without the
+// users:read:pii permission.
+func (app *application) listTokensHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Scope  string
+		UserID int
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Scope = app.readString(qs, "scope", "")
+	v.Check(validator.PermittedValue(input.Scope, "", data.ScopeActivation, data.ScopeAuthentication), "scope", "must be activation or authentication")
+
+	input.UserID = app.readInt(qs, "user_id", 0, v)
+	v.Check(input.UserID >= 0, "user_id", "must be a positive integer")
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	input.Filters.Sort = app.readString(qs, "sort", "-created_at")
+	input.Filters.SortSafelist = []string{"created_at", "expiry", "user_id", "scope", "-created_at", "-expiry", "-user_id", "-scope"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	tokens, metadata, err := app.requestModels(r).Tokens.GetAll(input.Scope, int64(input.UserID), input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The email addresses of the token holders are masked unless the viewer has the
+	// users:read:pii permission.
+	pii, err := app.hasPermission(r, "users:read:pii")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !pii {
+		for _, token := range tokens {
+			token.UserEmail = data.MaskEmail(token.UserEmail)
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"tokens": tokens, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
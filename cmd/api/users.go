@@ -2,13 +2,18 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"slices"
 	"time"
 
 	"greenlight.nicolasleigh.net/internal/data"
 	"greenlight.nicolasleigh.net/internal/validator"
 )
 
+// The length of time that the user statistics are cached for.
+const userStatsTTL = 30 * time.Second
+
 func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
 	// Create an anonymous struct to hold the expected data from the request body.
 	var input struct {
@@ -25,13 +30,13 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	// Copy the data from the request body into a new User struct. Notice also that we
-	// set the Activated field to false, which isn't strictly necessary because the
-	// Activated field will have the zero-value of false by default. But setting this
-	// explicitly helps to make our intentions clear to anyone reading the code.
+	// set the Activated field explicitly. This is false unless activation is being
+	// skipped for local development, in which case the user is activated straight
+	// away.
 	user := &data.User{
 		Name:      input.Name,
 		Email:     input.Email,
-		Activated: false,
+		Activated: app.config.skipActivation,
 	}
 
 	// Use the Password.Set() method to generate and store the hashed and plaintext
@@ -44,21 +49,32 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 
 	v := validator.New()
 
-	// Validate the user struct and return the error messages to the client if any of
+	// Validate the user struct, and check the plaintext password against the
+	// configured password policy. Return the error messages to the client if any of
 	// the checks fail.
-	if data.ValidateUser(v, user); !v.Valid() {
+	data.ValidateUser(v, user)
+	data.ValidatePasswordForPolicy(v, input.Password, app.config.passwordPolicy)
+
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
 	// Insert the user data into the database.
-	err = app.models.Users.Insert(user)
+	err = app.requestModels(r).Users.Insert(user)
 	if err != nil {
 		switch {
 		// If we get a ErrDuplicateEmail error, use the v.AddError() method to manually
 		// add a message to the validator instance, and then call our
 		// failedValidationResponse() helper.
+		//
+		// Alternatively, if the application is configured to treat duplicate emails as
+		// a conflict, then send a 409 Conflict response instead.
 		case errors.Is(err, data.ErrDuplicateEmail):
+			if app.config.duplicateEmailStatus == http.StatusConflict {
+				app.conflictResponse(w, r, "a user with this email address already exists")
+				return
+			}
 			v.AddError("email", "a user with this email address already exists")
 			app.failedValidationResponse(w, r, v.Errors)
 		default:
@@ -67,8 +83,36 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// If we're skipping activation, then the user was inserted as already activated
+	// above. Grant them the default permissions along with both the read and write
+	// movie permissions, so that they can use all of the movie endpoints straight
+	// away, and send the response without generating
+	// an activation token or sending a welcome email.
+	if app.config.skipActivation {
+		codes := slices.Clone(app.config.defaultPermissions)
+		for _, code := range []string{"movies:read", "movies:write"} {
+			if !slices.Contains(codes, code) {
+				codes = append(codes, code)
+			}
+		}
+		err = app.requestModels(r).Permissions.AddForUser(user.ID, codes...)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusCreated, envelope{"user": user}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
 	// Add the "movies:read" permission for the new user.
-	err = app.models.Permissions.AddForUser(user.ID, "movies:read")
+	// err = app.models.Permissions.AddForUser(user.ID, "movies:read")
+
+	// Add the default permissions for the new user.
+	err = app.requestModels(r).Permissions.AddForUser(user.ID, app.config.defaultPermissions...)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -76,7 +120,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 
 	// After the user record has been created in the database, generate a new activation
 	// token for the user.
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	token, err := app.requestModels(r).Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -126,7 +170,11 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		// err = app.mailer.Send(user.Email, "user_welcome.tmpl", user)
 
 		// Send the welcome email, passing in the map above as dynamic data.
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
+		// err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
+
+		// Pass in the background context, so that retries stop when the application
+		// is shutting down.
+		err = app.mailer.Send(app.backgroundCtx, user.Email, "user_welcome.tmpl", data)
 		if err != nil {
 			app.logger.Error(err.Error())
 		}
@@ -167,7 +215,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	// Retrieve the details of the user associated with the token using the
 	// GetForToken() method (which we will create in a minute). If no matching record
 	// is found, then we let the client know that the token they provided is not valid.
-	user, err := app.models.Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+	user, err := app.requestModels(r).Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -184,7 +232,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 
 	// Save the updated user record in our database, checking for any edit conflicts in
 	// the same way that we did for our movie records.
-	err = app.models.Users.Update(user)
+	err = app.requestModels(r).Users.Update(user)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -197,7 +245,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 
 	// If everything went successfully, then we delete all activation tokens for the
 	// user.
-	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	err = app.requestModels(r).Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -209,3 +257,104 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// The userStatsHandler returns aggregate counts of the users for admin dashboards.
+// The counts are cached for userStatsTTL, so they may be slightly out of date.
+func (app *application) userStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := app.userStats.get(userStatsTTL, app.models.Users.Stats)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"stats": stats}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The bulkActivateUsersHandler activates many users at once, without them having to
+// use their activation tokens. Users are selected either by a list of IDs or by
+// having registered before a given time. If notify is true, then each activated user
+// is sent an email to let them know.
+func (app *application) bulkActivateUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		UserIDs          []jsonID   `json:"user_ids"`
+		RegisteredBefore *time.Time `json:"registered_before"`
+		Notify           bool       `json:"notify"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	userIDs := make([]int64, len(input.UserIDs))
+	for i, id := range input.UserIDs {
+		userIDs[i] = int64(id)
+	}
+
+	v := validator.New()
+
+	// Exactly one of user_ids and registered_before must be provided.
+	v.Check(len(input.UserIDs) > 0 || input.RegisteredBefore != nil, "user_ids", "must be provided if registered_before is not")
+	v.Check(len(input.UserIDs) == 0 || input.RegisteredBefore == nil, "registered_before", "must not be provided with user_ids")
+
+	v.Check(len(input.UserIDs) <= 1000, "user_ids", "must not contain more than 1000 user IDs")
+	v.Check(validator.Unique(userIDs), "user_ids", "must not contain duplicate values")
+	for _, id := range userIDs {
+		v.Check(id > 0, "user_ids", "must only contain positive integers")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, err := app.requestModels(r).Users.ActivateMany(userIDs, input.RegisteredBefore)
+	if err != nil {
+		var unknownUsersError *data.UnknownUsersError
+
+		switch {
+		case errors.As(err, &unknownUsersError):
+			v.AddError("user_ids", fmt.Sprintf("no matching users found for IDs %v", unknownUsersError.IDs))
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	activatedIDs := make([]int64, len(users))
+	for i, user := range users {
+		activatedIDs[i] = user.ID
+	}
+
+	// Send the notification emails one after another in a single background task,
+	// stopping early if the application starts shutting down.
+	if input.Notify && len(users) > 0 {
+		app.background(func() {
+			for _, user := range users {
+				if app.backgroundCtx.Err() != nil {
+					return
+				}
+
+				data := map[string]any{
+					"name":   user.Name,
+					"userID": user.ID,
+				}
+
+				err := app.mailer.Send(app.backgroundCtx, user.Email, "user_activated.tmpl", data)
+				if err != nil {
+					app.logger.Error(err.Error(), "user_id", user.ID)
+				}
+			}
+		})
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"activated": len(users), "user_ids": activatedIDs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,170 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"greenlight.nicolasleigh.net/internal/validator"
+)
+
+// Define an APIKey struct to hold the data for an individual API key. Unlike tokens,
+// API keys don't expire. Instead they remain valid until they are revoked, and they
+// carry their own set of permissions which limits what the key can be used for. The
+// plaintext key is only ever populated when the key is first created.
+type APIKey struct {
+	ID          int64       `json:"id"`
+	Plaintext   string      `json:"key,omitempty"`
+	Hash        []byte      `json:"-"`
+	UserID      int64       `json:"user_id"`
+	Name        string      `json:"name"`
+	Permissions Permissions `json:"permissions"`
+	CreatedAt   time.Time   `json:"created_at"`
+}
+
+func generateAPIKey(userID int64, name string, permissions Permissions) (*APIKey, error) {
+	key := &APIKey{
+		UserID:      userID,
+		Name:        name,
+		Permissions: permissions,
+	}
+
+	// API keys are long-lived, so we use 32 random bytes rather than the 16 that we
+	// use for tokens. Once base-32 encoded without padding this gives a 52 character
+	// plaintext key.
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+
+	// Like tokens, we only ever store the SHA-256 hash of the key in the database.
+	hash := sha256.Sum256([]byte(key.Plaintext))
+	key.Hash = hash[:]
+
+	return key, nil
+}
+
+// Check that the plaintext API key has been provided and is exactly 52 bytes long.
+func ValidateAPIKeyPlaintext(v *validator.Validator, keyPlaintext string) {
+	v.Check(keyPlaintext != "", "api_key", "must be provided")
+	v.Check(len(keyPlaintext) == 52, "api_key", "must be 52 bytes long")
+}
+
+func ValidateAPIKey(v *validator.Validator, key *APIKey) {
+	v.Check(key.UserID > 0, "user_id", "must be provided")
+
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(key.Permissions) >= 1, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+}
+
+// Define the APIKeyModel type.
+type APIKeyModel struct {
+	parentContext
+	DB *sql.DB
+}
+
+// The New() method is a shortcut which generates a new API key and then inserts the
+// data in the api_keys table.
+func (m APIKeyModel) New(userID int64, name string, permissions Permissions) (*APIKey, error) {
+	key, err := generateAPIKey(userID, name, permissions)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(key)
+	return key, err
+}
+
+// Insert() adds the data for a specific API key to the api_keys table.
+func (m APIKeyModel) Insert(key *APIKey) error {
+	query := `
+  INSERT INTO api_keys (hash, user_id, name, permissions)
+  VALUES ($1, $2, $3, $4)
+  RETURNING id, created_at`
+
+	args := []any{key.Hash, key.UserID, key.Name, pq.Array(key.Permissions)}
+
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+// GetForPlaintext() retrieves the API key matching the given plaintext key. If no
+// matching key is found, we return an ErrRecordNotFound error.
+func (m APIKeyModel) GetForPlaintext(keyPlaintext string) (*APIKey, error) {
+	keyHash := sha256.Sum256([]byte(keyPlaintext))
+
+	query := `
+  SELECT id, user_id, name, permissions, created_at
+  FROM api_keys
+  WHERE hash = $1`
+
+	var key APIKey
+
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, keyHash[:]).Scan(
+		&key.ID,
+		&key.UserID,
+		&key.Name,
+		pq.Array(&key.Permissions),
+		&key.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	key.Hash = keyHash[:]
+
+	return &key, nil
+}
+
+// Delete() revokes a specific API key, returning an ErrRecordNotFound error if the
+// key doesn't exist.
+func (m APIKeyModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+  DELETE FROM api_keys
+  WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
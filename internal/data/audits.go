@@ -0,0 +1,209 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Define a MovieSnapshot struct to hold the fields of a movie as they were at a
+// specific version. Snapshots are recorded in the movie_audits table by a database
+// trigger whenever a new version of a movie is written.
+type MovieSnapshot struct {
+	MovieID   int64     `json:"movie_id"`
+	Version   int32     `json:"version"`
+	ChangedAt time.Time `json:"changed_at"`
+	Title     string    `json:"title"`
+	Year      int32     `json:"year"`
+	Runtime   Runtime   `json:"runtime"`
+	Genres    []string  `json:"genres"`
+}
+
+// Define a FieldChange struct to hold the old and new values of a field which differs
+// between two snapshots.
+type FieldChange struct {
+	Old any `json:"old"`
+	New any `json:"new"`
+}
+
+// The DiffSnapshots() function compares two snapshots of a movie and returns the
+// fields which differ between them, keyed by their JSON names. Fields which are the
+// same in both snapshots aren't included, so an empty map means that nothing changed.
+func DiffSnapshots(from, to *MovieSnapshot) map[string]FieldChange {
+	changes := make(map[string]FieldChange)
+
+	if from.Title != to.Title {
+		changes["title"] = FieldChange{Old: from.Title, New: to.Title}
+	}
+
+	if from.Year != to.Year {
+		changes["year"] = FieldChange{Old: from.Year, New: to.Year}
+	}
+
+	if from.Runtime != to.Runtime {
+		changes["runtime"] = FieldChange{Old: from.Runtime, New: to.Runtime}
+	}
+
+	if !slices.Equal(from.Genres, to.Genres) {
+		changes["genres"] = FieldChange{Old: from.Genres, New: to.Genres}
+	}
+
+	return changes
+}
+
+// Define the MovieAuditModel type.
+type MovieAuditModel struct {
+	parentContext
+	DB *sql.DB
+}
+
+// The GetVersion() method returns the snapshot of a movie at a specific version. If
+// there isn't a snapshot for that version (including when the movie doesn't exist),
+// then an ErrRecordNotFound error is returned. The audit rows are kept after a movie
+// is deleted, so that the hash chain isn't broken, but they aren't returned here.
+func (m MovieAuditModel) GetVersion(movieID int64, version int32) (*MovieSnapshot, error) {
+	if movieID < 1 || version < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+  SELECT movie_id, version, changed_at, title, year, runtime, genres
+  FROM movie_audits
+  WHERE movie_id = $1 AND version = $2
+  AND EXISTS (SELECT 1 FROM movies WHERE movies.id = movie_audits.movie_id)`
+
+	var snapshot MovieSnapshot
+
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, movieID, version).Scan(
+		&snapshot.MovieID,
+		&snapshot.Version,
+		&snapshot.ChangedAt,
+		&snapshot.Title,
+		&snapshot.Year,
+		&snapshot.Runtime,
+		pq.Array(&snapshot.Genres),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &snapshot, nil
+}
+
+// The maximum length of time that verifying a range of the audit hash chain is
+// allowed to run for.
+const auditVerifyTimeout = 10 * time.Second
+
+// Define an AuditChainReport struct to hold the result of verifying a range of the
+// movie_audits hash chain. If the chain is broken, then BrokenAt holds the ID of the
+// first audit row which doesn't match, and Reason says why. If the range ended before
+// the end of the table, then NextID holds the ID to continue verifying from.
+type AuditChainReport struct {
+	Intact   bool   `json:"intact"`
+	Checked  int    `json:"checked"`
+	FromID   int64  `json:"from_id"`
+	ToID     int64  `json:"to_id,omitempty"`
+	BrokenAt int64  `json:"broken_at,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	NextID   int64  `json:"next_id,omitempty"`
+}
+
+// The VerifyChain() method checks up to limit rows of the movie_audits hash chain,
+// starting from the row with the given ID. The hash of each row is recomputed by the
+// database, using the same function as the trigger which wrote it, and each row's
+// prev_hash is checked against the hash of the row before it. The first row in the
+// range is checked against the last row before the range, or against nothing if it's
+// the genesis row, so the whole table can be verified one range at a time.
+func (m MovieAuditModel) VerifyChain(fromID int64, limit int) (*AuditChainReport, error) {
+	ctx, cancel := context.WithTimeout(m.parent(), auditVerifyTimeout)
+	defer cancel()
+
+	report := &AuditChainReport{Intact: true, FromID: fromID}
+
+	// Get the hash of the row before the range. If there isn't one, then the first row
+	// in the range must be the genesis row.
+	query := `
+  SELECT hash
+  FROM movie_audits
+  WHERE id < $1
+  ORDER BY id DESC
+  LIMIT 1`
+
+	var prev []byte
+
+	err := m.DB.QueryRowContext(ctx, query, fromID).Scan(&prev)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	// Fetch one more row than the limit, so that we know whether there's more to
+	// verify after the range.
+	query = `
+  SELECT id, prev_hash, hash,
+    movie_audit_hash(prev_hash, movie_id, version, changed_at, title, year, runtime, genres)
+  FROM movie_audits
+  WHERE id >= $1
+  ORDER BY id
+  LIMIT $2`
+
+	rows, err := m.DB.QueryContext(ctx, query, fromID, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			id       int64
+			prevHash []byte
+			hash     []byte
+			computed []byte
+		)
+
+		err := rows.Scan(&id, &prevHash, &hash, &computed)
+		if err != nil {
+			return nil, err
+		}
+
+		if report.Checked == limit {
+			report.NextID = id
+			break
+		}
+
+		report.Checked++
+		report.ToID = id
+
+		switch {
+		case !bytes.Equal(prevHash, prev):
+			report.Reason = "prev_hash doesn't match the hash of the previous row"
+		case !bytes.Equal(hash, computed):
+			report.Reason = "hash doesn't match the contents of the row"
+		}
+
+		if report.Reason != "" {
+			report.Intact = false
+			report.BrokenAt = id
+			break
+		}
+
+		prev = hash
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
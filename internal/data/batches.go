@@ -0,0 +1,143 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Define a MovieBatch type for inserting many movies inside a single transaction.
+// Nothing is visible to other connections until Commit() is called, and calling
+// Rollback() discards all of the movies inserted in the batch.
+type MovieBatch struct {
+	model  MovieModel
+	tx     *sql.Tx
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// The NewBatch() method starts a new transaction for a batch of inserts. The timeout
+// applies to the whole batch, rather than to each insert.
+func (m MovieModel) NewBatch(timeout time.Duration) (*MovieBatch, error) {
+	ctx, cancel := context.WithTimeout(m.parent(), timeout)
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return &MovieBatch{model: m, tx: tx, ctx: ctx, cancel: cancel}, nil
+}
+
+// The Insert() method adds a movie to the batch. If a movie with the same title
+// (ignoring case) and year already exists, then it is skipped and Insert() returns
+// false. Because a failed statement aborts the whole transaction in PostgreSQL, we
+// don't retry if the slug is taken by a concurrent insert; the error is returned and
+// the batch must be rolled back.
+//
+// The exception is ErrDuplicateTitle, when -unique-titles is set. The insert runs
+// inside a savepoint, which is rolled back for a duplicate title, so the batch can
+// carry on with the next movie.
+func (b *MovieBatch) Insert(movie *Movie) (bool, error) {
+	query := `
+  SELECT EXISTS (
+    SELECT 1 FROM movies WHERE lower(title) = lower($1) AND year = $2
+  )`
+
+	var exists bool
+
+	err := b.tx.QueryRowContext(b.ctx, query, movie.Title, movie.Year).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+
+	if exists {
+		return false, nil
+	}
+
+	_, err = b.tx.ExecContext(b.ctx, "SAVEPOINT movie_batch_insert")
+	if err != nil {
+		return false, err
+	}
+
+	err = b.model.insert(b.ctx, b.tx, movie, 1)
+	if errors.Is(err, ErrDuplicateTitle) {
+		_, rollbackErr := b.tx.ExecContext(b.ctx, "ROLLBACK TO SAVEPOINT movie_batch_insert")
+		if rollbackErr != nil {
+			return false, rollbackErr
+		}
+		return false, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	_, err = b.tx.ExecContext(b.ctx, "RELEASE SAVEPOINT movie_batch_insert")
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Commit() commits the transaction, making all of the movies in the batch visible.
+func (b *MovieBatch) Commit() error {
+	defer b.cancel()
+	return b.tx.Commit()
+}
+
+// Rollback() aborts the transaction, discarding all of the movies in the batch. It's
+// safe to call Rollback() after Commit(), in which case it does nothing.
+func (b *MovieBatch) Rollback() error {
+	defer b.cancel()
+
+	err := b.tx.Rollback()
+	if errors.Is(err, sql.ErrTxDone) {
+		return nil
+	}
+	return err
+}
+
+// Define a BatchItemError type which records the position of the item in a batch
+// which caused an error. It wraps the underlying error, so errors.Is() can still be
+// used to check for errors like ErrEditConflict.
+type BatchItemError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchItemError) Error() string {
+	return fmt.Sprintf("batch item %d: %v", e.Index, e.Err)
+}
+
+func (e *BatchItemError) Unwrap() error {
+	return e.Err
+}
+
+// The UpdateMany() method updates all of the given movies in a single transaction,
+// using the same version checks as Update(). If any of the updates fail, then none of
+// them are saved and a *BatchItemError is returned holding the index of the movie
+// which failed. Like MovieBatch, we don't retry if a regenerated slug is taken by a
+// concurrent request, as the failed statement aborts the transaction.
+func (m MovieModel) UpdateMany(movies []*Movie) error {
+	ctx, cancel := context.WithTimeout(m.parent(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, movie := range movies {
+		err := m.update(ctx, tx, movie, 1)
+		if err != nil {
+			return &BatchItemError{Index: i, Err: err}
+		}
+	}
+
+	return tx.Commit()
+}
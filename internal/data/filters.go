@@ -29,6 +29,14 @@ type Metadata struct {
 	TotalRecords int `json:"total_records,omitempty"`
 }
 
+// The Empty() method reports whether the metadata is for a list which was counted and
+// had no matching records at all. In that case calculateMetadata() returns the zero
+// Metadata value. It's false for a page past the end of a non-empty list, and for a
+// list which wasn't counted.
+func (m Metadata) Empty() bool {
+	return m == Metadata{}
+}
+
 func ValidateFilters(v *validator.Validator, f Filters) {
 	// Check that the page and page_size parameters contain sensible values.
 	v.Check(f.Page > 0, "page", "must be greater than zero")
@@ -89,3 +97,15 @@ func calculateMetadata(totalRecords, page, pageSize int) Metadata {
 		TotalRecords: totalRecords,
 	}
 }
+
+// The calculatePageMetadata() function returns the pagination metadata for when the
+// total number of records hasn't been counted. The last_page and total_records
+// values are left empty, so they're omitted from the JSON, which lets the client
+// know that the count isn't present.
+func calculatePageMetadata(page, pageSize int) Metadata {
+	return Metadata{
+		CurrentPage: page,
+		PageSize:    pageSize,
+		FirstPage:   1,
+	}
+}
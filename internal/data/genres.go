@@ -0,0 +1,294 @@
+package data
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	_ "embed"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Genres is the canonical set of movie genres supported by the API. All of the
+// canonical genres are lower case.
+var Genres = []string{
+	"action",
+	"adventure",
+	"animation",
+	"biography",
+	"comedy",
+	"crime",
+	"documentary",
+	"drama",
+	"family",
+	"fantasy",
+	"history",
+	"horror",
+	"music",
+	"musical",
+	"mystery",
+	"romance",
+	"sci-fi",
+	"sport",
+	"thriller",
+	"war",
+	"western",
+}
+
+//go:embed "genre_synonyms.txt"
+var genreSynonymsFile string
+
+// genreSynonyms maps lower case genre synonyms, like "scifi", to the canonical genre
+// that they stand for. It defaults to the embedded list, and can be replaced at
+// startup with SetGenreSynonyms().
+var genreSynonyms = func() map[string]string {
+	synonyms, err := ParseGenreSynonyms(strings.NewReader(genreSynonymsFile))
+	if err != nil {
+		panic(err)
+	}
+	return synonyms
+}()
+
+// The ParseGenreSynonyms() function reads genre synonyms, one per line in the form
+// "synonym = canonical". Blank lines and lines starting with # are ignored. It returns
+// an error if a line is malformed, if a synonym maps to a genre which isn't in the
+// canonical set, or if a synonym is itself a canonical genre.
+func ParseGenreSynonyms(r io.Reader) (map[string]string, error) {
+	synonyms := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		synonym, genre, found := strings.Cut(text, "=")
+		synonym = strings.ToLower(strings.TrimSpace(synonym))
+		genre = strings.ToLower(strings.TrimSpace(genre))
+
+		switch {
+		case !found || synonym == "" || genre == "":
+			return nil, fmt.Errorf("line %d: must be in the form synonym = genre", line)
+		case !slices.Contains(Genres, genre):
+			return nil, fmt.Errorf("line %d: %q is not a canonical genre", line, genre)
+		case slices.Contains(Genres, synonym):
+			return nil, fmt.Errorf("line %d: %q is already a canonical genre", line, synonym)
+		}
+
+		synonyms[synonym] = genre
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return synonyms, nil
+}
+
+// The SetGenreSynonyms() function replaces the genre synonyms. It isn't safe to call
+// while requests are being handled, so it should only be used at startup.
+func SetGenreSynonyms(synonyms map[string]string) {
+	genreSynonyms = synonyms
+}
+
+// The GenreSynonyms() function returns a copy of the current genre synonyms.
+func GenreSynonyms() map[string]string {
+	return maps.Clone(genreSynonyms)
+}
+
+// The CanonicalGenre() function returns the canonical form of the given genre, which
+// is matched case-insensitively against the Genres set. If the genre isn't in the set,
+// then it returns false as the second value.
+// func CanonicalGenre(genre string) (string, bool) {
+// 	for _, canonical := range Genres {
+// 		if strings.EqualFold(genre, canonical) {
+// 			return canonical, true
+// 		}
+// 	}
+//
+// 	return "", false
+// }
+
+// The CanonicalGenre() function returns the canonical form of the given genre. The
+// genre is matched case-insensitively against the Genres set and then the genre
+// synonyms, so both "Sci-Fi" and "science fiction" give "sci-fi". If the genre isn't
+// recognized, then it returns false as the second value.
+func CanonicalGenre(genre string) (string, bool) {
+	genre = strings.ToLower(strings.TrimSpace(genre))
+
+	if slices.Contains(Genres, genre) {
+		return genre, true
+	}
+
+	if canonical, ok := genreSynonyms[genre]; ok {
+		return canonical, true
+	}
+
+	return "", false
+}
+
+// Define a Facet struct to hold the number of movies in a specific genre, along with
+// (optionally) the titles of the most recent movies in that genre.
+type Facet struct {
+	Genre     string   `json:"genre"`
+	Count     int      `json:"count"`
+	TopTitles []string `json:"top_titles,omitempty"`
+}
+
+// The Facets() method returns a Facet for each of the given genres, in the same order
+// that they were provided. Genres which don't match any movies are included with a
+// count of zero. If top is greater than zero, then each facet also includes the
+// titles of up to that many of the most recently released movies in the genre.
+func (m MovieModel) Facets(genres []string, top int) ([]*Facet, error) {
+	// We unnest the requested genres WITH ORDINALITY so that we can return the facets
+	// in the requested order, and use a LEFT JOIN so that genres without any movies
+	// still appear in the results. The FILTER clause stops the NULL titles produced
+	// by the LEFT JOIN from being aggregated.
+	query := `
+  SELECT g.genre, count(movies.id),
+    (array_agg(movies.title ORDER BY movies.year DESC, movies.id ASC) FILTER (WHERE movies.id IS NOT NULL))[1:$2]
+  FROM unnest($1::text[]) WITH ORDINALITY AS g(genre, position)
+  LEFT JOIN movies ON movies.genres @> ARRAY[g.genre]
+  GROUP BY g.genre, g.position
+  ORDER BY g.position`
+
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(genres), top)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	facets := []*Facet{}
+
+	for rows.Next() {
+		var facet Facet
+
+		err := rows.Scan(&facet.Genre, &facet.Count, pq.Array(&facet.TopTitles))
+		if err != nil {
+			return nil, err
+		}
+
+		facets = append(facets, &facet)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return facets, nil
+}
+
+// The ListGenres() method returns a page of the genres which are used by at least one
+// movie, along with the number of movies in each. The results can be sorted by the
+// genre name or the count, using the "name" and "count" sort values. Genres with the
+// same count are always ordered by name, so that the ordering is stable.
+func (m MovieModel) ListGenres(filters Filters) ([]*Facet, Metadata, error) {
+	query := fmt.Sprintf(`
+  SELECT count(*) OVER(), genre AS name, count(*) AS count
+  FROM movies, unnest(genres) AS genre
+  GROUP BY genre
+  ORDER BY %s %s, name ASC
+  LIMIT $1 OFFSET $2`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	genres := []*Facet{}
+
+	for rows.Next() {
+		var genre Facet
+
+		err := rows.Scan(&totalRecords, &genre.Genre, &genre.Count)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		genres = append(genres, &genre)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return genres, metadata, nil
+}
+
+// Define a Genre struct to hold a row from the genres reference table. The Color is
+// an optional display color for clients, and is empty if it hasn't been set.
+type Genre struct {
+	ID    int64  `json:"id,omitempty"`
+	Name  string `json:"name"`
+	Color string `json:"color,omitempty"`
+}
+
+// Define a MovieWithGenres type which wraps a Movie so that its genres are encoded as
+// Genre objects, rather than as strings. The Genres field here takes the place of
+// the one on the embedded Movie. CreatedAt and UpdatedAt are only included in the
+// JSON if they're set, in the same way as for MovieWithTimestamps.
+type MovieWithGenres struct {
+	*Movie
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	Genres    []*Genre   `json:"genres"`
+}
+
+// Define a GenreModel type which wraps the genres reference table.
+type GenreModel struct {
+	parentContext
+	DB *sql.DB
+}
+
+// The GetByNames() method returns the genres with the given names, keyed by name.
+// Names which aren't in the genres table are left out of the map.
+func (m GenreModel) GetByNames(names []string) (map[string]*Genre, error) {
+	query := `
+  SELECT id, name, color
+  FROM genres
+  WHERE name = ANY($1)`
+
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(names))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	genres := make(map[string]*Genre)
+
+	for rows.Next() {
+		var genre Genre
+
+		err := rows.Scan(&genre.ID, &genre.Name, &genre.Color)
+		if err != nil {
+			return nil, err
+		}
+
+		genres[genre.Name] = &genre
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return genres, nil
+}
@@ -0,0 +1,113 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// MaintenanceTimeout is the maximum length of time that a maintenance operation is
+// allowed to run for. It's much longer than our usual 3-second timeout, as ANALYZE
+// and REINDEX can take a while on large tables.
+const MaintenanceTimeout = 5 * time.Minute
+
+// Define the MaintenanceModel type, which runs database maintenance operations.
+type MaintenanceModel struct {
+	parentContext
+	DB *sql.DB
+}
+
+// The PoolStats() method returns the current statistics for the database connection
+// pool. It doesn't run a query, so it's cheap to call.
+func (m MaintenanceModel) PoolStats() sql.DBStats {
+	return m.DB.Stats()
+}
+
+// The Ping() method checks that the database is reachable.
+func (m MaintenanceModel) Ping() error {
+	ctx, cancel := context.WithTimeout(m.parent(), time.Second)
+	defer cancel()
+
+	return m.DB.PingContext(ctx)
+}
+
+// The ListIndexes() method returns the names of the indexes on a table, in
+// alphabetical order.
+func (m MaintenanceModel) ListIndexes(table string) ([]string, error) {
+	query := `
+  SELECT indexname
+  FROM pg_indexes
+  WHERE schemaname = current_schema() AND tablename = $1
+  ORDER BY indexname`
+
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	indexes := []string{}
+
+	for rows.Next() {
+		var index string
+
+		err := rows.Scan(&index)
+		if err != nil {
+			return nil, err
+		}
+
+		indexes = append(indexes, index)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return indexes, nil
+}
+
+// The ReindexIndex() method rebuilds a single index. Like REINDEX TABLE, this locks
+// the table against writes while it runs, but only for as long as the one index
+// takes to rebuild.
+func (m MaintenanceModel) ReindexIndex(index string) error {
+	ctx, cancel := context.WithTimeout(m.parent(), MaintenanceTimeout)
+	defer cancel()
+
+	// Identifiers can't be passed as placeholder values, so we quote the index name
+	// instead.
+	_, err := m.DB.ExecContext(ctx, "REINDEX INDEX "+pq.QuoteIdentifier(index))
+	return err
+}
+
+// The AnalyzeTable() method refreshes the query planner statistics for a single
+// table.
+func (m MaintenanceModel) AnalyzeTable(table string) error {
+	ctx, cancel := context.WithTimeout(m.parent(), MaintenanceTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, "ANALYZE "+pq.QuoteIdentifier(table))
+	return err
+}
+
+// The Analyze() method refreshes the query planner statistics for the database. If
+// reindex is true, then the indexes on the movies table are rebuilt first. Note that
+// REINDEX locks the table against writes (and blocks reads which use the index) while
+// it runs.
+func (m MaintenanceModel) Analyze(reindex bool) error {
+	ctx, cancel := context.WithTimeout(m.parent(), MaintenanceTimeout)
+	defer cancel()
+
+	if reindex {
+		_, err := m.DB.ExecContext(ctx, "REINDEX TABLE movies")
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := m.DB.ExecContext(ctx, "ANALYZE")
+	return err
+}
@@ -1,8 +1,10 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 )
 
 // Define a custom ErrRecordNotFound error. We'll return this from our Get() method when
@@ -10,24 +12,96 @@ import (
 var (
 	ErrRecordNotFound = errors.New("record not found")
 	ErrEditConflict   = errors.New("edit conflict")
+	// ErrTimeout is returned when a query fails because its context's deadline passed
+	// or the context was cancelled, rather than because of a problem with the query.
+	ErrTimeout = errors.New("query timed out")
 )
 
+// The contextError() function checks whether a failed query's context is done, and if
+// so returns an ErrTimeout which also wraps the context's error. Callers can then use
+// errors.Is() with context.Canceled to tell a client going away apart from a slow
+// query. Once a query is cancelled, the driver returns its own error instead of the
+// context's, so we check the context rather than err. Other errors are returned
+// unchanged.
+func contextError(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrTimeout, ctx.Err())
+}
+
+// The queryer interface is satisfied by both *sql.DB and *sql.Tx, so that methods
+// which use it can run either directly on the connection pool or inside a
+// transaction.
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// The parentContext type is embedded in each of the models. It holds the context
+// which the model's queries derive their timeouts from, so that when a model is used
+// while handling a request, the request's deadline also applies to its queries. The
+// zero value uses context.Background().
+type parentContext struct {
+	ctx context.Context
+}
+
+func (p parentContext) parent() context.Context {
+	if p.ctx == nil {
+		return context.Background()
+	}
+	return p.ctx
+}
+
 // Create a Models struct which wraps the MovieModel. We'll add other models to this,
 // like a UserModel and PermissionModel, as our build progresses.
 type Models struct {
-	Movies      MovieModel
-	Users       UserModel       // Add a new Users field.
-	Permissions PermissionModel // Add a new Permissions field.
-	Tokens      TokenModel      // Add a new Tokens field.
+	Movies            MovieModel
+	Users             UserModel       // Add a new Users field.
+	Permissions       PermissionModel // Add a new Permissions field.
+	Tokens            TokenModel      // Add a new Tokens field.
+	APIKeys           APIKeyModel
+	RateLimits        RateLimitModel
+	MovieTranslations MovieTranslationModel
+	Maintenance       MaintenanceModel
+	MovieAudits       MovieAuditModel
+	Genres            GenreModel
 }
 
 // For ease of use, we also add a New() method which returns a Models struct containing
 // the initialized MovieModel.
 func NewModels(db *sql.DB) Models {
 	return Models{
-		Movies:      MovieModel{DB: db},
-		Users:       UserModel{DB: db},       // Initialize a new UserModel instance.
-		Permissions: PermissionModel{DB: db}, // Initialize a new PermissionModel instance.
-		Tokens:      TokenModel{DB: db},      // Initialize a new TokenModel instance.
+		Movies:            MovieModel{DB: db},
+		Users:             UserModel{DB: db},       // Initialize a new UserModel instance.
+		Permissions:       PermissionModel{DB: db}, // Initialize a new PermissionModel instance.
+		Tokens:            TokenModel{DB: db},      // Initialize a new TokenModel instance.
+		APIKeys:           APIKeyModel{DB: db},
+		RateLimits:        RateLimitModel{DB: db},
+		MovieTranslations: MovieTranslationModel{DB: db},
+		Maintenance:       MaintenanceModel{DB: db},
+		MovieAudits:       MovieAuditModel{DB: db},
+		Genres:            GenreModel{DB: db},
 	}
 }
+
+// The WithContext() method returns a copy of the models whose queries derive their
+// timeouts from ctx, rather than from context.Background(). The queries still keep
+// their own timeouts, so ctx can only make them shorter.
+func (m Models) WithContext(ctx context.Context) Models {
+	p := parentContext{ctx: ctx}
+
+	m.Movies.parentContext = p
+	m.Users.parentContext = p
+	m.Permissions.parentContext = p
+	m.Tokens.parentContext = p
+	m.APIKeys.parentContext = p
+	m.RateLimits.parentContext = p
+	m.MovieTranslations.parentContext = p
+	m.Maintenance.parentContext = p
+	m.MovieAudits.parentContext = p
+	m.Genres.parentContext = p
+
+	return m
+}
@@ -3,8 +3,10 @@ package data
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
@@ -51,7 +53,11 @@ type Movie struct {
 type Movie struct {
 	ID        int64     `json:"id"`
 	CreatedAt time.Time `json:"-"`
+	// UpdatedAt is set whenever the movie is created or updated. Like CreatedAt it's
+	// hidden unless the timestamps are asked for.
+	UpdatedAt time.Time `json:"-"`
 	Title     string    `json:"title"`
+	Slug      string    `json:"slug"`
 	Year      int32     `json:"year,omitempty"`
 	// Use the Runtime type instead of int32. Note that the omitempty directive will
 	// still work on this: if the Runtime field has the underlying value 0, then it will
@@ -59,10 +65,49 @@ type Movie struct {
 	// won't be called at all.
 	Runtime Runtime  `json:"runtime,omitempty"`
 	Genres  []string `json:"genres,omitempty"`
+	// Tags are free-form labels chosen by editors, unlike the curated genres.
+	Tags    []string `json:"tags"`
 	Version int32    `json:"version"`
+	// Movies don't have an overview of their own, so this is only populated (and
+	// included in the JSON) when a translation with an overview is applied.
+	Overview string `json:"overview,omitempty"`
 }
 
+// Define a MovieWithTimestamps type which wraps a Movie so that its created_at and
+// updated_at timestamps, which are normally hidden, are included in the JSON. The
+// fields here take the place of the ones on the embedded Movie, which are ignored by
+// the JSON encoder because of their json:"-" tags.
+type MovieWithTimestamps struct {
+	*Movie
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// The WithTimestamps() method returns the movie wrapped in a MovieWithTimestamps.
+func (movie *Movie) WithTimestamps() MovieWithTimestamps {
+	return MovieWithTimestamps{Movie: movie, CreatedAt: movie.CreatedAt, UpdatedAt: movie.UpdatedAt}
+}
+
+// The ApplyTranslation() method replaces the title of the movie (and sets its
+// overview) using the given translation.
+func (movie *Movie) ApplyTranslation(translation *MovieTranslation) {
+	movie.Title = translation.Title
+	movie.Overview = translation.Overview
+}
+
+// The ValidateMovie() function checks the movie's fields. Before the genres are
+// checked, any genres which are synonyms or differently-cased versions of a canonical
+// genre are replaced by the canonical genre, so this changes movie.Genres in place.
+// Genres which still aren't canonical after that fail validation.
 func ValidateMovie(v *validator.Validator, movie *Movie) {
+	ValidateMovieUpdate(v, movie, true)
+}
+
+// The ValidateMovieUpdate() function is the same as ValidateMovie(), but the genres
+// are only checked if genresChanged is true. Movies added before the genres were
+// restricted to the canonical set may still have other genres, and they shouldn't
+// stop the other fields from being updated.
+func ValidateMovieUpdate(v *validator.Validator, movie *Movie, genresChanged bool) {
 	v.Check(movie.Title != "", "title", "must be provided")
 	v.Check(len(movie.Title) <= 500, "title", "must not be more than 500 bytes long")
 
@@ -73,45 +118,211 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 	v.Check(movie.Runtime != 0, "runtime", "must be provided")
 	v.Check(movie.Runtime > 0, "runtime", "must be a positive integer")
 
+	if !genresChanged {
+		return
+	}
+
 	v.Check(movie.Genres != nil, "genres", "must be provided")
 	v.Check(len(movie.Genres) >= 1, "genres", "must contain at least 1 genre")
 	v.Check(len(movie.Genres) <= 5, "genres", "must not contain more than 5 genres")
+	for i, genre := range movie.Genres {
+		if canonical, ok := CanonicalGenre(genre); ok {
+			movie.Genres[i] = canonical
+		} else {
+			v.AddError("genres", fmt.Sprintf("unsupported genre %q", genre))
+		}
+	}
+
 	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
 }
 
+// Define the supported title search modes. SearchModeFullText uses PostgreSQL's
+// full-text search, which matches whole words, whereas SearchModeLike matches any
+// substring of the title.
+const (
+	SearchModeFullText = "fulltext"
+	SearchModeLike     = "like"
+)
+
+// SearchModes returns the names of the supported title search modes.
+func SearchModes() []string {
+	return []string{SearchModeFullText, SearchModeLike}
+}
+
+// ErrDuplicateTitle is returned when a movie is inserted or updated with a title which
+// another movie already has, and unique titles are enabled.
+var ErrDuplicateTitle = errors.New("duplicate title")
+
+// The isDuplicateTitleError() function reports whether err was raised by the unique
+// title trigger. Unlike the unique indexes, the trigger's error message includes the
+// title, so we check the error code and constraint name rather than the message.
+func isDuplicateTitleError(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "movies_title_unique"
+}
+
 // Define a MovieModel struct type which wraps a sql.DB connection pool.
+// If RegenerateSlugs is true, then a movie's slug is regenerated when its title is
+// updated. It's false by default, so that existing links to a movie keep working.
+// SearchMode controls how the title filter in GetAll() is matched, and defaults to
+// full-text search when it's empty.
 type MovieModel struct {
-	DB *sql.DB
+	parentContext
+	DB              *sql.DB
+	RegenerateSlugs bool
+	SearchMode      string
+}
+
+// The titleCondition() method returns the SQL condition for the title filter in
+// GetAll(), along with the value for its placeholder. The title is always passed as
+// a placeholder parameter rather than interpolated, so it can't be used for SQL
+// injection in either mode. In like mode we also escape the LIKE wildcards, so that
+// a title containing % or _ only matches those characters literally.
+func (m MovieModel) titleCondition(title string) (string, string) {
+	if m.SearchMode == SearchModeLike {
+		escaped := likeEscaper.Replace(title)
+		return `(title ILIKE '%' || $1 || '%' OR $1 = '')`, escaped
+	}
+
+	return `(to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')`, title
 }
 
+// likeEscaper escapes the characters which have a special meaning in LIKE patterns,
+// using the default backslash escape character.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
 // Add a placeholder method for inserting a new record in the movies table.
 
 // The Insert() method accepts a pointer to a movie struct, which should contain the
 // data for the new record.
 func (m MovieModel) Insert(movie *Movie) error {
+	// Create a context with a 3-second timeout.
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	// return m.insert(ctx, m.DB, movie, slugAttempts)
+	return contextError(ctx, m.insert(ctx, m.DB, movie, slugAttempts))
+}
+
+// The InsertOrGet() method inserts the movie, unless a movie with the same title
+// (ignoring case) and year already exists, which is the same match that's used to
+// skip duplicates in a MovieBatch. If there's an existing movie, then the movie struct
+// is filled in with its data instead. It returns true if the movie was inserted.
+//
+// Two requests for the same movie could both find that it doesn't exist and then
+// both insert it, so we take a transaction-level advisory lock on the title and year
+// first. The lock is released when the transaction ends.
+func (m MovieModel) InsertOrGet(movie *Movie) (bool, error) {
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext(lower($1) || ':' || $2::text))`, movie.Title, movie.Year)
+	if err != nil {
+		return false, err
+	}
+
+	query := `
+  SELECT id, created_at, updated_at, title, slug, year, runtime, genres, tags, version
+  FROM movies
+  WHERE lower(title) = lower($1) AND year = $2
+  ORDER BY id
+  LIMIT 1`
+
+	err = tx.QueryRowContext(ctx, query, movie.Title, movie.Year).Scan(
+		&movie.ID,
+		&movie.CreatedAt,
+		&movie.UpdatedAt,
+		&movie.Title,
+		&movie.Slug,
+		&movie.Year,
+		&movie.Runtime,
+		pq.Array(&movie.Genres),
+		pq.Array(&movie.Tags),
+		&movie.Version,
+	)
+	switch {
+	case err == nil:
+		return false, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return false, err
+	}
+
+	// As with MovieBatch, a failed statement aborts the transaction, so we only make
+	// one attempt at finding a unique slug.
+	err = m.insert(ctx, tx, movie, 1)
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// The insert() method does the work for Insert(), using q to run the queries so that
+// it can also be used inside a transaction. It makes up to attempts attempts at
+// finding a unique slug.
+func (m MovieModel) insert(ctx context.Context, q queryer, movie *Movie, attempts int) error {
 	// Define the SQL query for inserting a new record in the movies table and returning
 	// the system-generated data.
-	query := `    
-  INSERT INTO movies (title, year, runtime, genres)    
-  VALUES ($1, $2, $3, $4)       
-  RETURNING id, created_at, version`
+	// query := `
+	// INSERT INTO movies (title, year, runtime, genres)
+	// VALUES ($1, $2, $3, $4)
+	// RETURNING id, created_at, version`
+
+	// Include the slug column in the insert.
+	query := `
+  INSERT INTO movies (title, year, runtime, genres, slug)
+  VALUES ($1, $2, $3, $4, $5)
+  RETURNING id, created_at, updated_at, tags, version`
 
 	// Create an args slice containing the values for the placeholder parameters from
 	// the movie struct. Declaring this slice immediately next to our SQL query helps to
 	// make it nice and clear *what values are being used where* in the query.
 	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
 
-	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
 	// Use the QueryRow() method to execute the SQL query on our connection pool,
 	// passing in the args slice as a variadic parameter and scanning the system
 	// generated id, created_at and version values into the movie struct.
 	// return m.DB.QueryRow(query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
 
 	// Use QueryRowContext() and pass the context as the first argument.
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	// return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+
+	// Generate a unique slug from the title and include it in the insert. If another
+	// movie grabs the same slug before our insert completes, the unique index on the
+	// slug column will reject it, so we pick a new slug and try again.
+	base := slugify(movie.Title)
+
+	for attempt := 1; ; attempt++ {
+		slug, err := m.uniqueSlug(ctx, q, base, 0)
+		if err != nil {
+			return err
+		}
+
+		err = q.QueryRowContext(ctx, query, append(args, slug)...).Scan(&movie.ID, &movie.CreatedAt, &movie.UpdatedAt, pq.Array(&movie.Tags), &movie.Version)
+		if isDuplicateSlugError(err) && attempt < attempts {
+			continue
+		}
+		if isDuplicateTitleError(err) {
+			return ErrDuplicateTitle
+		}
+		if err != nil {
+			return err
+		}
+
+		movie.Slug = slug
+		return nil
+	}
 }
 
 // Add a placeholder method for fetching a specific record from the movies table.
@@ -137,9 +348,15 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	// WHERE id = $1`
 
 	// Remove the pg_sleep(8) clause.
-	query := `     
-  SELECT id, created_at, title, year, runtime, genres, version    
-  FROM movies    
+	// query := `
+	// SELECT id, created_at, title, year, runtime, genres, version
+	// FROM movies
+	// WHERE id = $1`
+
+	// Include the slug in the returned data.
+	query := `
+  SELECT id, created_at, updated_at, title, slug, year, runtime, genres, tags, version
+  FROM movies
   WHERE id = $1`
 
 	// Declare a Movie struct to hold the data returned by the query.
@@ -148,7 +365,12 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	// Use the context.WithTimeout() function to create a context.Context which carries a
 	// 3-second timeout deadline. Note that we're using the empty context.Background()
 	// as the 'parent' context.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+
+	// Use the model's parent context instead, which is the request context when the
+	// model was returned by Models.WithContext(), so that the request's deadline also
+	// applies to the query.
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
 	// Importantly, use defer to make sure that we cancel the context before the Get()
 	// method returns.
 	defer cancel()
@@ -170,10 +392,13 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		// &[]byte{}, // Add this line.
 		&movie.ID,
 		&movie.CreatedAt,
+		&movie.UpdatedAt,
 		&movie.Title,
+		&movie.Slug,
 		&movie.Year,
 		&movie.Runtime,
 		pq.Array(&movie.Genres),
+		pq.Array(&movie.Tags),
 		&movie.Version,
 	)
 
@@ -185,7 +410,8 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		case errors.Is(err, sql.ErrNoRows):
 			return nil, ErrRecordNotFound
 		default:
-			return nil, err
+			// return nil, err
+			return nil, contextError(ctx, err)
 		}
 	}
 
@@ -193,52 +419,126 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	return &movie, nil
 }
 
+// The GetBySlug() method fetches a specific movie using its slug, returning an
+// ErrRecordNotFound error if there isn't a matching movie.
+func (m MovieModel) GetBySlug(slug string) (*Movie, error) {
+	if slug == "" {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+  SELECT id, created_at, updated_at, title, slug, year, runtime, genres, tags, version
+  FROM movies
+  WHERE slug = $1`
+
+	var movie Movie
+
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, slug).Scan(
+		&movie.ID,
+		&movie.CreatedAt,
+		&movie.UpdatedAt,
+		&movie.Title,
+		&movie.Slug,
+		&movie.Year,
+		&movie.Runtime,
+		pq.Array(&movie.Genres),
+		pq.Array(&movie.Tags),
+		&movie.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &movie, nil
+}
+
 // Add a placeholder method for updating a specific record in the movies table.
 func (m MovieModel) Update(movie *Movie) error {
 	// Declare the SQL query for updating the record and returning the new version
 	// number.
 
 	// Add the 'AND version = $6' clause to the SQL query.
-	query := `   
-  UPDATE movies      
-  SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1   
-  WHERE id = $5 AND version = $6     
-  RETURNING version`
+	// query := `
+	// UPDATE movies
+	// SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
+	// WHERE id = $5 AND version = $6
+	// RETURNING version`
 
-	// Create an args slice containing the values for the placeholder parameters.
-	args := []any{
-		movie.Title,
-		movie.Year,
-		movie.Runtime,
-		pq.Array(movie.Genres),
-		movie.ID,
-		movie.Version, // Add the expected movie version.
-	}
+	// The query now lives in update(), which also updates the slug.
 
 	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
 	defer cancel()
 
-	// Use the QueryRow() method to execute the query, passing in the args slice as a
-	// variadic parameter and scanning the new version value into the movie struct.
-	// return m.DB.QueryRow(query, args...).Scan(&movie.Version)
+	// return m.update(ctx, m.DB, movie, slugAttempts)
+	return contextError(ctx, m.update(ctx, m.DB, movie, slugAttempts))
+}
 
-	// Execute the SQL query. If no matching row could be found, we know the movie
-	// version has changed (or the record has been deleted) and we return our custom
-	// ErrEditConflict error.
-	// err := m.DB.QueryRow(query, args...).Scan(&movie.Version)
+// The update() method does the work for Update(), using q to run the queries so that
+// it can also be used inside a transaction. It makes up to attempts attempts at
+// finding a unique slug when the slug is regenerated.
+func (m MovieModel) update(ctx context.Context, q queryer, movie *Movie, attempts int) error {
+	// Also update the slug, which only changes if RegenerateSlugs is enabled, and
+	// record when the movie was updated.
+	query := `
+  UPDATE movies
+  SET title = $1, year = $2, runtime = $3, genres = $4, slug = $5, version = version + 1, updated_at = NOW()
+  WHERE id = $6 AND version = $7
+  RETURNING version, updated_at`
 
-	// Use QueryRowContext() and pass the context as the first argument.
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
-	if err != nil {
-		switch {
-		case errors.Is(err, sql.ErrNoRows):
-			return ErrEditConflict
-		default:
-			return err
+	// If slugs should be regenerated and the current slug no longer matches the title,
+	// then pick a new unique slug. Like in Insert(), we retry if the slug is taken by
+	// another movie before our update completes.
+	slug := movie.Slug
+	base := slugify(movie.Title)
+	regenerate := m.RegenerateSlugs && !slugHasBase(movie.Slug, base)
+
+	for attempt := 1; ; attempt++ {
+		if regenerate {
+			var err error
+			slug, err = m.uniqueSlug(ctx, q, base, movie.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Create an args slice containing the values for the placeholder parameters.
+		args := []any{
+			movie.Title,
+			movie.Year,
+			movie.Runtime,
+			pq.Array(movie.Genres),
+			slug,
+			movie.ID,
+			movie.Version, // Add the expected movie version.
+		}
+
+		err := q.QueryRowContext(ctx, query, args...).Scan(&movie.Version, &movie.UpdatedAt)
+		if regenerate && isDuplicateSlugError(err) && attempt < attempts {
+			continue
+		}
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrEditConflict
+			case isDuplicateTitleError(err):
+				return ErrDuplicateTitle
+			default:
+				return err
+			}
 		}
+
+		movie.Slug = slug
+		return nil
 	}
-	return nil
 }
 
 // Add a placeholder method for deleting a specific record from the movies table.
@@ -254,7 +554,7 @@ func (m MovieModel) Delete(id int64) error {
   WHERE id = $1`
 
 	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
 	defer cancel()
 
 	// Execute the SQL query using the Exec() method, passing in the id variable as
@@ -265,7 +565,7 @@ func (m MovieModel) Delete(id int64) error {
 	// Use ExecContext() and pass the context as the first argument.
 	result, err := m.DB.ExecContext(ctx, query, id)
 	if err != nil {
-		return err
+		return contextError(ctx, err)
 	}
 
 	// Call the RowsAffected() method on the sql.Result object to get the number of rows
@@ -291,7 +591,26 @@ func (m MovieModel) Delete(id int64) error {
 // func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, error) {
 
 // Update the function signature to return a Metadata struct.
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+// Accept optional CreatedFrom and CreatedTo times, which restrict the results to
+// movies created within that range. Passing nil for either means that end of the
+// range is unbounded.
+//
+// If WithCount is false, then the total number of matching records isn't counted.
+// The window function has to find every matching row, which gets expensive when
+// paging deep into a large result set, so clients can opt out of it. In that case
+// the metadata doesn't include the last_page and total_records values.
+//
+// If UpdatedSince isn't nil, then only the movies updated after that time are
+// returned, ordered by when they were updated, so that clients can fetch the changes
+// since their last sync by paging through the results.
+//
+// Like genres, if tags isn't empty then only the movies with all of the given tags
+// are returned.
+// func (m MovieModel) GetAll(title string, genres, tags []string, createdFrom, createdTo, updatedSince *time.Time, filters Filters, withCount bool) ([]*Movie, Metadata, error) {
+
+// Take the filters in a MovieListFilters struct, rather than as a long list of
+// arguments which had to be updated in every caller whenever a filter was added.
+func (m MovieModel) GetAll(filters MovieListFilters) ([]*Movie, Metadata, error) {
 	// Construct the SQL query to retrieve all movie records.
 	// query := `
 	// SELECT id, created_at, title, year, runtime, genres, version
@@ -336,16 +655,33 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 
 	// Update the SQL query to include the window function which counts the total
 	// (filtered) records.
-	query := fmt.Sprintf(`  
-  SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version    
-  FROM movies    
-  WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')  
-  AND (genres @> $2 OR $2 = '{}')    
-  ORDER BY %s %s, id ASC     
-  LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+	// query := fmt.Sprintf(`
+	// SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+	// FROM movies
+	// WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
+	// AND (genres @> $2 OR $2 = '{}')
+	// ORDER BY %s %s, id ASC
+	// LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+
+	// Add the created_at range conditions. When a bound is nil the placeholder is
+	// NULL, so the condition is always true and the query behaves exactly as before.
+	// query := fmt.Sprintf(`
+	// SELECT count(*) OVER(), id, created_at, title, slug, year, runtime, genres, version
+	// FROM movies
+	// WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
+	// AND (genres @> $2 OR $2 = '{}')
+	// AND (created_at >= $3 OR $3 IS NULL)
+	// AND (created_at <= $4 OR $4 IS NULL)
+	// ORDER BY %s %s, id ASC
+	// LIMIT $5 OFFSET $6`, filters.sortColumn(), filters.sortDirection())
+
+	// Build the query and its placeholder values. The filtering and ordering are
+	// shared with GetAllIDs(), so that the two always return the same movies.
+	// query, args := m.listQuery("id, created_at, updated_at, title, slug, year, runtime, genres, tags, version", title, genres, tags, createdFrom, createdTo, updatedSince, filters, withCount)
+	query, args := m.listQuery(movieListColumns, filters)
 
 	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
 	defer cancel()
 
 	// Use QueryContext() to execute the query. This returns a sql.Rows resultset
@@ -362,12 +698,13 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	// values for the placeholders in a slice. Notice here how we call the limit() and
 	// offset() methods on the Filters struct to get the appropriate values for the
 	// LIMIT and OFFSET clauses.
-	args := []any{title, pq.Array(genres), filters.limit(), filters.offset()}
+	// args := []any{title, pq.Array(genres), createdFrom, createdTo, filters.limit(), filters.offset()}
+	// args := []any{title, pq.Array(genres), createdFrom, createdTo, updatedSince, filters.limit(), filters.offset()}
 	// And then pass the args slice to QueryContext() as a variadic parameter.
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		// return nil, err
-		return nil, Metadata{}, err // Update this to return an empty Metadata struct.
+		return nil, Metadata{}, contextError(ctx, err)
 	}
 
 	// Importantly, defer a call to rows.Close() to ensure that the resultset is closed
@@ -390,15 +727,18 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&totalRecords, // Scan the count from the window function into totalRecords.
 			&movie.ID,
 			&movie.CreatedAt,
+			&movie.UpdatedAt,
 			&movie.Title,
+			&movie.Slug,
 			&movie.Year,
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
+			pq.Array(&movie.Tags),
 			&movie.Version,
 		)
 		if err != nil {
 			// return nil, err
-			return nil, Metadata{}, err // Update this to return an empty Metadata struct.
+			return nil, Metadata{}, contextError(ctx, err)
 		}
 
 		// Add the Movie struct to the slice.
@@ -409,7 +749,7 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	// that was encountered during the iteration.
 	if err = rows.Err(); err != nil {
 		//  return nil, err
-		return nil, Metadata{}, err // Update this to return an empty Metadata struct.
+		return nil, Metadata{}, contextError(ctx, err)
 	}
 
 	// If everything went OK, then return the slice of movies.
@@ -417,7 +757,556 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 
 	// Generate a Metadata struct, passing in the total record count and pagination
 	// parameters from the client.
-	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	// metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	// If the count was skipped, then only the page values are known.
+	var metadata Metadata
+	if filters.WithCount {
+		metadata = calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	} else {
+		metadata = calculatePageMetadata(filters.Page, filters.PageSize)
+	}
 	// Include the metadata struct when returning.
 	return movies, metadata, nil
 }
+
+// Define a MovieListFilters struct to hold the filters for a list of movies, which
+// are shared by GetAll(), GetAllIDs(), GetMetadata() and ExplainGetAll(). Empty
+// values don't filter anything. If WithCount is false, then the total number of
+// matching records isn't counted.
+type MovieListFilters struct {
+	Title        string
+	Genres       []string
+	Tags         []string
+	CreatedFrom  *time.Time
+	CreatedTo    *time.Time
+	UpdatedSince *time.Time
+	// UpdatedAfterID is the ID of the last movie the client received with the
+	// UpdatedSince timestamp. Together they form a keyset cursor, so that movies
+	// updated in the same instant as the cursor aren't skipped.
+	UpdatedAfterID int64
+	WithCount      bool
+	Filters
+}
+
+// The columns selected by GetAll(). They're shared with ExplainGetAll(), so that the
+// explained query is exactly the one that GetAll() runs.
+const movieListColumns = "id, created_at, updated_at, title, slug, year, runtime, genres, tags, version"
+
+// The listQuery() method returns the SQL query and placeholder values for a page of
+// movies matching the filters, used by GetAll() and GetAllIDs(). The columns are
+// selected after the total record count (or a constant 0 if WithCount is false), so
+// the rows always start with the count.
+func (m MovieModel) listQuery(columns string, filters MovieListFilters) (string, []any) {
+	where, args := m.listConditions(filters)
+
+	// When the count isn't wanted, select a constant 0 in place of the window
+	// function, so that the rows can be scanned in exactly the same way.
+	countColumn := "count(*) OVER()"
+	if !filters.WithCount {
+		countColumn = "0"
+	}
+
+	// When fetching the movies updated since a given time, always order them by
+	// updated_at, so that paging through the changes is stable.
+	//
+	// The "relevance" sort orders the movies by how well their title matches the
+	// title search, with the best matches first, and "-relevance" reverses it. The
+	// handlers only accept it when there's a title to search for.
+	orderBy := fmt.Sprintf("%s %s, id ASC", filters.sortColumn(), filters.sortDirection())
+	switch {
+	case filters.UpdatedSince != nil:
+		orderBy = "updated_at ASC, id ASC"
+	case filters.sortColumn() == "relevance":
+		direction := "DESC"
+		if filters.sortDirection() == "DESC" {
+			direction = "ASC"
+		}
+		orderBy = fmt.Sprintf("ts_rank(to_tsvector('simple', title), plainto_tsquery('simple', $1)) %s, id ASC", direction)
+	}
+
+	query := fmt.Sprintf(`
+  SELECT %s, %s
+  FROM movies
+  WHERE %s
+  ORDER BY %s
+  LIMIT $8 OFFSET $9`, countColumn, columns, where, orderBy)
+
+	args = append(args, filters.limit(), filters.offset())
+
+	return query, args
+}
+
+// The listConditions() method returns the WHERE conditions for the movie list
+// filters, along with the values for the $1 to $7 placeholders which they use.
+func (m MovieModel) listConditions(filters MovieListFilters) (string, []any) {
+	// Use the title condition for the configured search mode. Note that only the
+	// fixed SQL for the condition is interpolated, the title itself is still passed
+	// as the $1 placeholder value.
+	titleClause, title := m.titleCondition(filters.Title)
+
+	where := titleClause + `
+  AND (genres @> $2 OR $2 = '{}')
+  AND (created_at >= $3 OR $3 IS NULL)
+  AND (created_at <= $4 OR $4 IS NULL)
+  AND ((updated_at, id) > ($5, $7) OR $5 IS NULL)
+  AND (tags @> $6 OR $6 = '{}')`
+
+	args := []any{title, pq.Array(filters.Genres), filters.CreatedFrom, filters.CreatedTo, filters.UpdatedSince, pq.Array(filters.Tags), filters.UpdatedAfterID}
+
+	return where, args
+}
+
+// The GetMetadata() method counts the movies matching the filters, without fetching
+// any of them, and returns the pagination metadata for the page in the filters. The
+// sort and WithCount values in the filters aren't used, as they don't change the
+// count.
+func (m MovieModel) GetMetadata(filters MovieListFilters) (Metadata, error) {
+	where, args := m.listConditions(filters)
+
+	query := fmt.Sprintf(`
+  SELECT count(*)
+  FROM movies
+  WHERE %s`, where)
+
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	totalRecords := 0
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&totalRecords)
+	if err != nil {
+		return Metadata{}, contextError(ctx, err)
+	}
+
+	return calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// The GetAllIDs() method returns the IDs of a page of movies, using the same
+// filtering, ordering and pagination as GetAll(). Only the id column is selected, so
+// it's much lighter than fetching the full movies.
+func (m MovieModel) GetAllIDs(filters MovieListFilters) ([]int64, Metadata, error) {
+	query, args := m.listQuery("id", filters)
+
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	totalRecords := 0
+
+	for rows.Next() {
+		var id int64
+
+		err := rows.Scan(&totalRecords, &id)
+		if err != nil {
+			return nil, Metadata{}, contextError(ctx, err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	var metadata Metadata
+	if filters.WithCount {
+		metadata = calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	} else {
+		metadata = calculatePageMetadata(filters.Page, filters.PageSize)
+	}
+
+	return ids, metadata, nil
+}
+
+// The ExplainGetAll() method runs the GetAll() query for the filters with EXPLAIN
+// (ANALYZE, FORMAT JSON) and returns the query plan as JSON, without returning any
+// movies. Note that ANALYZE means that the query really is executed.
+func (m MovieModel) ExplainGetAll(filters MovieListFilters) (json.RawMessage, error) {
+	query, args := m.listQuery(movieListColumns, filters)
+
+	query = "EXPLAIN (ANALYZE, FORMAT JSON)" + query
+
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	var plan []byte
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&plan)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return json.RawMessage(plan), nil
+}
+
+// The number of rounds of random candidate IDs which GetRandom() tries before falling
+// back to ORDER BY random().
+const randomMovieRounds = 5
+
+// The GetRandom() method returns up to count randomly selected movies. Rather than
+// using ORDER BY random(), which has to scan and sort the whole table, we generate a
+// set of random IDs between the lowest and highest movie IDs and look them up using
+// the primary key index. Because IDs can have gaps (from deleted movies), we generate
+// three times as many candidate IDs as we need, and if that still doesn't find
+// enough movies we try again for the rest, leaving out the movies we already have.
+// Only if the table is so sparse that randomMovieRounds rounds aren't enough do we
+// fall back to ORDER BY random() for the remainder, so fewer than count movies are
+// only returned if there are fewer movies than that in the table.
+func (m MovieModel) GetRandom(count int) ([]*Movie, error) {
+	sampleQuery := `
+  WITH bounds AS (
+    SELECT min(id) AS low, max(id) AS high FROM movies
+  ), candidates AS (
+    SELECT DISTINCT low + floor(random() * (high - low + 1))::bigint AS id
+    FROM bounds, generate_series(1, $1 * 3)
+  )
+  SELECT movies.id, movies.created_at, movies.updated_at, movies.title, movies.slug, movies.year, movies.runtime, movies.genres, movies.tags, movies.version
+  FROM movies
+  INNER JOIN candidates ON candidates.id = movies.id
+  WHERE movies.id <> ALL($2)
+  LIMIT $1`
+
+	fallbackQuery := `
+  SELECT id, created_at, updated_at, title, slug, year, runtime, genres, tags, version
+  FROM movies
+  WHERE id <> ALL($2)
+  ORDER BY random()
+  LIMIT $1`
+
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	movies := []*Movie{}
+	ids := []int64{}
+
+	for round := 0; round <= randomMovieRounds && len(movies) < count; round++ {
+		query := sampleQuery
+		if round == randomMovieRounds {
+			query = fallbackQuery
+		}
+
+		rows, err := m.DB.QueryContext(ctx, query, count-len(movies), pq.Array(ids))
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var movie Movie
+
+			err := rows.Scan(
+				&movie.ID,
+				&movie.CreatedAt,
+				&movie.UpdatedAt,
+				&movie.Title,
+				&movie.Slug,
+				&movie.Year,
+				&movie.Runtime,
+				pq.Array(&movie.Genres),
+				pq.Array(&movie.Tags),
+				&movie.Version,
+			)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+
+			movies = append(movies, &movie)
+			ids = append(ids, movie.ID)
+		}
+
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return movies, nil
+}
+
+// The GetRecent() method returns the count most recently created movies, newest
+// first.
+func (m MovieModel) GetRecent(count int) ([]*Movie, error) {
+	query := `
+  SELECT id, created_at, updated_at, title, slug, year, runtime, genres, tags, version
+  FROM movies
+  ORDER BY created_at DESC, id DESC
+  LIMIT $1`
+
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, count)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.UpdatedAt,
+			&movie.Title,
+			&movie.Slug,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			pq.Array(&movie.Tags),
+			&movie.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return movies, nil
+}
+
+// The GetByYear() method returns the movies released between fromYear and toYear
+// (inclusive) which match the title and genres filters, ordered by year and then
+// title. At most perYear movies are returned for each year, and only the earliest
+// maxYears years which have any matching movies are included, so the caller can
+// limit the size of the results.
+func (m MovieModel) GetByYear(title string, genres []string, fromYear, toYear, perYear, maxYears int) ([]*Movie, error) {
+	titleClause, title := m.titleCondition(title)
+
+	// The window functions number the movies within each year, and rank the years
+	// themselves, so that both limits are applied by the database.
+	query := fmt.Sprintf(`
+  SELECT id, created_at, updated_at, title, slug, year, runtime, genres, tags, version
+  FROM (
+    SELECT *,
+      row_number() OVER (PARTITION BY year ORDER BY title, id) AS position,
+      dense_rank() OVER (ORDER BY year) AS year_rank
+    FROM movies
+    WHERE %s
+    AND (genres @> $2 OR $2 = '{}')
+    AND year BETWEEN $3 AND $4
+  ) AS ranked
+  WHERE position <= $5 AND year_rank <= $6
+  ORDER BY year, title, id`, titleClause)
+
+	args := []any{title, pq.Array(genres), fromYear, toYear, perYear, maxYears}
+
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.UpdatedAt,
+			&movie.Title,
+			&movie.Slug,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			pq.Array(&movie.Tags),
+			&movie.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return movies, nil
+}
+
+// The GetSimilar() method returns up to count movies which share at least one genre
+// with the given movie, not including the movie itself. The movies with the most
+// genres in common come first, followed by those released closest to the same year.
+func (m MovieModel) GetSimilar(movie *Movie, count int) ([]*Movie, error) {
+	query := `
+  SELECT id, created_at, updated_at, title, slug, year, runtime, genres, tags, version
+  FROM movies
+  WHERE genres && $1 AND id <> $2
+  ORDER BY cardinality(ARRAY(SELECT unnest(genres) INTERSECT SELECT unnest($1::text[]))) DESC, abs(year - $3) ASC, id ASC
+  LIMIT $4`
+
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(movie.Genres), movie.ID, movie.Year, count)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.UpdatedAt,
+			&movie.Title,
+			&movie.Slug,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			pq.Array(&movie.Tags),
+			&movie.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return movies, nil
+}
+
+// The maximum number of tags on a movie, and the maximum length of each tag.
+const (
+	MaxMovieTags   = 20
+	MaxMovieTagLen = 50
+)
+
+// The ValidateTags() function checks the tags for a movie. Unlike genres, tags are
+// free text, so only their number and length are checked, along with the characters
+// which would break the tags query string filter (a comma) or the
+// DELETE /v1/movies/:id/tags/:tag path (a slash).
+func ValidateTags(v *validator.Validator, tags []string) {
+	v.Check(len(tags) <= MaxMovieTags, "tags", fmt.Sprintf("must not contain more than %d tags", MaxMovieTags))
+	v.Check(validator.Unique(tags), "tags", "must not contain duplicate values")
+
+	for _, tag := range tags {
+		v.Check(tag != "", "tags", "must not contain empty tags")
+		v.Check(len(tag) <= MaxMovieTagLen, "tags", fmt.Sprintf("must not contain tags more than %d bytes long", MaxMovieTagLen))
+		v.Check(!strings.ContainsAny(tag, "/,"), "tags", "must not contain tags with a slash or comma")
+	}
+}
+
+// The UpdateTags() method replaces the tags of a movie. Like Update(), it increments
+// the version and uses it to check for edit conflicts, so that concurrent tag changes
+// aren't lost.
+func (m MovieModel) UpdateTags(movie *Movie) error {
+	query := `
+  UPDATE movies
+  SET tags = $1, version = version + 1, updated_at = NOW()
+  WHERE id = $2 AND version = $3
+  RETURNING version, updated_at`
+
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, pq.Array(movie.Tags), movie.ID, movie.Version).Scan(&movie.Version, &movie.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ErrGenreCount is returned by PatchGenres() if the changes would leave the movie
+// with fewer than 1 or more than 5 genres.
+var ErrGenreCount = errors.New("genre count out of bounds")
+
+// The PatchGenres() method adds and removes genres from a movie in a single UPDATE,
+// rather than replacing the whole genres array, so that concurrent changes to
+// different genres don't overwrite each other. The genres to add should already be
+// canonical. Added genres which the movie already has are ignored, and removing
+// takes precedence over adding. The existing genres keep their order, with any new
+// ones appended.
+func (m MovieModel) PatchGenres(id int64, add, remove []string) (*Movie, error) {
+	// The new genres are worked out from the genres column in both the SET and WHERE
+	// clauses, rather than from a value read beforehand. If another update to the
+	// same movie commits first, PostgreSQL re-evaluates both clauses against the
+	// updated row, so that update isn't lost. The bounds are the same as in
+	// ValidateMovie().
+	genres := `ARRAY(
+    SELECT g FROM unnest(genres || $1::text[]) WITH ORDINALITY AS t(g, n)
+    WHERE g <> ALL($2::text[])
+    GROUP BY g
+    ORDER BY min(n))`
+
+	query := fmt.Sprintf(`
+  UPDATE movies
+  SET genres = %[1]s, version = version + 1, updated_at = NOW()
+  WHERE id = $3 AND cardinality(%[1]s) BETWEEN 1 AND 5
+  RETURNING id, created_at, updated_at, title, slug, year, runtime, genres, tags, version`, genres)
+
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	var movie Movie
+
+	err := m.DB.QueryRowContext(ctx, query, pq.Array(add), pq.Array(remove), id).Scan(
+		&movie.ID,
+		&movie.CreatedAt,
+		&movie.UpdatedAt,
+		&movie.Title,
+		&movie.Slug,
+		&movie.Year,
+		&movie.Runtime,
+		pq.Array(&movie.Genres),
+		pq.Array(&movie.Tags),
+		&movie.Version,
+	)
+	if err == nil {
+		return &movie, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	// No row was updated, either because there's no such movie or because the genre
+	// count would be out of bounds.
+	var exists bool
+
+	err = m.DB.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM movies WHERE id = $1)`, id).Scan(&exists)
+	switch {
+	case err != nil:
+		return nil, err
+	case !exists:
+		return nil, ErrRecordNotFound
+	default:
+		return nil, ErrGenreCount
+	}
+}
@@ -0,0 +1,79 @@
+package data
+
+import (
+	"bufio"
+	_ "embed"
+	"strings"
+	"unicode"
+
+	"greenlight.nicolasleigh.net/internal/validator"
+)
+
+// Define constants for the supported password policies. The basic policy only checks
+// the length of the password, while the strong policy also checks its complexity and
+// rejects commonly used passwords.
+const (
+	PasswordPolicyBasic  = "basic"
+	PasswordPolicyStrong = "strong"
+)
+
+// PasswordPolicies returns the names of the supported password policies.
+func PasswordPolicies() []string {
+	return []string{PasswordPolicyBasic, PasswordPolicyStrong}
+}
+
+//go:embed "common_passwords.txt"
+var commonPasswordsFile string
+
+// Parse the embedded list of common passwords into a set when the package is
+// initialized. The passwords are stored in lower case so that the lookup is
+// case-insensitive.
+var commonPasswords = func() map[string]struct{} {
+	passwords := make(map[string]struct{})
+
+	scanner := bufio.NewScanner(strings.NewReader(commonPasswordsFile))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		passwords[strings.ToLower(line)] = struct{}{}
+	}
+
+	return passwords
+}()
+
+// ValidatePasswordForPolicy() checks a new plaintext password against the given
+// policy. The basic length checks from ValidatePasswordPlaintext() are always
+// applied. Because the validator only records the first error for each key, the
+// client sees the message for the first rule that the password fails.
+func ValidatePasswordForPolicy(v *validator.Validator, password, policy string) {
+	ValidatePasswordPlaintext(v, password)
+
+	if policy != PasswordPolicyStrong {
+		return
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			hasSymbol = true
+		}
+	}
+
+	v.Check(hasUpper, "password", "must contain at least one upper case letter")
+	v.Check(hasLower, "password", "must contain at least one lower case letter")
+	v.Check(hasDigit, "password", "must contain at least one digit")
+	v.Check(hasSymbol, "password", "must contain at least one symbol")
+
+	_, common := commonPasswords[strings.ToLower(password)]
+	v.Check(!common, "password", "must not be a commonly used password")
+}
@@ -5,16 +5,46 @@ package data
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
 	"slices"
 	"time"
 
 	"github.com/lib/pq"
+	"greenlight.nicolasleigh.net/internal/validator"
 )
 
 // Define a Permissions slice, which we will use to hold the permission codes (like
 // "movies:read" and "movies:write") for a single user.
 type Permissions []string
 
+// PermissionCodes is the list of built-in permission codes which the application
+// checks for. It matches the codes inserted into the permissions table by the
+// migrations. Grants are checked against the permissions table instead, so that
+// codes added with the sync endpoint can be granted too. The users:read:pii
+// permission lets a user see other users' personal data, like their email addresses,
+// unmasked.
+var PermissionCodes = []string{"movies:read", "movies:write", "admin:read", "admin:write", "users:read:pii"}
+
+// PermissionCodeRX is a regular expression for checking the format of permission
+// codes, which are in the form "resource:action", like "movies:read", optionally
+// followed by a qualifier, like "users:read:pii".
+var PermissionCodeRX = regexp.MustCompile(`^[a-z][a-z0-9_-]*:[a-z][a-z0-9_-]*(:[a-z][a-z0-9_-]*)?$`)
+
+// The ValidatePermissionCodes() function checks a list of permission codes for the
+// permissions table, such as the list sent to the permissions sync endpoint.
+func ValidatePermissionCodes(v *validator.Validator, codes []string) {
+	v.Check(len(codes) >= 1, "codes", "must contain at least 1 permission code")
+	v.Check(len(codes) <= 100, "codes", "must not contain more than 100 permission codes")
+	v.Check(validator.Unique(codes), "codes", "must not contain duplicate values")
+
+	for _, code := range codes {
+		v.Check(len(code) <= 100, "codes", "must not contain codes more than 100 bytes long")
+		v.Check(validator.Matches(code, PermissionCodeRX), "codes", fmt.Sprintf("contains %q, which is not in the form resource:action", code))
+	}
+}
+
 // Add a helper method to check whether the Permissions slice contains a specific
 // permission code.
 func (p Permissions) Include(code string) bool {
@@ -23,6 +53,7 @@ func (p Permissions) Include(code string) bool {
 
 // Define the PermissionModel type.
 type PermissionModel struct {
+	parentContext
 	DB *sql.DB
 }
 
@@ -38,7 +69,7 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
   INNER JOIN users ON users_permissions.user_id = users.id   
   WHERE users.id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
 	defer cancel()
 
 	rows, err := m.DB.QueryContext(ctx, query, userID)
@@ -66,6 +97,42 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	return permissions, nil
 }
 
+// The GetAllCodes() method returns the codes of all the permissions in the
+// permissions table, in alphabetical order.
+func (m PermissionModel) GetAllCodes() ([]string, error) {
+	query := `
+  SELECT code
+  FROM permissions
+  ORDER BY code`
+
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	codes := []string{}
+
+	for rows.Next() {
+		var code string
+
+		err := rows.Scan(&code)
+		if err != nil {
+			return nil, err
+		}
+
+		codes = append(codes, code)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
 // Add the provided permission codes for a specific user. Notice that we're using a
 // variadic parameter for the codes so that we can assign multiple permissions in a
 // single call.
@@ -74,9 +141,365 @@ func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
   INSERT INTO users_permissions     
   SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
 	return err
 }
+
+// Define an UnknownUsersError type, which BulkUpdate() and UserModel.ActivateMany()
+// return if any of the user IDs don't match an existing user. It holds the IDs that
+// couldn't be found.
+type UnknownUsersError struct {
+	IDs []int64
+}
+
+func (e *UnknownUsersError) Error() string {
+	return fmt.Sprintf("unknown user IDs: %v", e.IDs)
+}
+
+// Define a UserPermissions struct to hold the permission codes for a specific user.
+type UserPermissions struct {
+	UserID      int64       `json:"user_id"`
+	Permissions Permissions `json:"permissions"`
+}
+
+// Define a BulkPermissionsResult struct to summarize the changes made by BulkUpdate().
+// Granted and Revoked are the number of user permissions which were actually added
+// and removed, and Users holds the resulting permissions for each of the users.
+type BulkPermissionsResult struct {
+	Granted int64              `json:"granted"`
+	Revoked int64              `json:"revoked"`
+	Users   []*UserPermissions `json:"users"`
+}
+
+// The BulkUpdate() method grants and revokes the given permission codes for all of
+// the given users in a single transaction. If any of the users don't exist, then
+// nothing is changed and an *UnknownUsersError is returned. Granting a permission
+// that a user already has, or revoking one that they don't, is not an error.
+func (m PermissionModel) BulkUpdate(userIDs []int64, grant, revoke []string) (*BulkPermissionsResult, error) {
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Calling Rollback() after the transaction has been committed is a no-op, so it's
+	// safe to defer it here to make sure that the transaction is always closed.
+	defer tx.Rollback()
+
+	// Lock the rows for the users, so that they can't be deleted while we're working
+	// on them, and check that every one of them exists.
+	query := `
+  SELECT id
+  FROM users
+  WHERE id = ANY($1)
+  FOR SHARE`
+
+	rows, err := tx.QueryContext(ctx, query, pq.Array(userIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := make(map[int64]bool)
+
+	for rows.Next() {
+		var id int64
+
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+
+		found[id] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var missing []int64
+
+	for _, id := range userIDs {
+		if !found[id] {
+			missing = append(missing, id)
+		}
+	}
+
+	if len(missing) > 0 {
+		return nil, &UnknownUsersError{IDs: missing}
+	}
+
+	result := &BulkPermissionsResult{}
+
+	if len(revoke) > 0 {
+		query = `
+  DELETE FROM users_permissions
+  USING permissions
+  WHERE users_permissions.permission_id = permissions.id
+  AND users_permissions.user_id = ANY($1)
+  AND permissions.code = ANY($2)`
+
+		res, err := tx.ExecContext(ctx, query, pq.Array(userIDs), pq.Array(revoke))
+		if err != nil {
+			return nil, err
+		}
+
+		result.Revoked, err = res.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(grant) > 0 {
+		// Insert every combination of user and permission in one statement, skipping
+		// any that the user already has.
+		query = `
+  INSERT INTO users_permissions (user_id, permission_id)
+  SELECT u.id, permissions.id
+  FROM unnest($1::bigint[]) AS u(id)
+  CROSS JOIN permissions
+  WHERE permissions.code = ANY($2)
+  ON CONFLICT DO NOTHING`
+
+		res, err := tx.ExecContext(ctx, query, pq.Array(userIDs), pq.Array(grant))
+		if err != nil {
+			return nil, err
+		}
+
+		result.Granted, err = res.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Read back the resulting permissions for each user, in the order that the user
+	// IDs were provided.
+	query = `
+  SELECT u.id, coalesce(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+  FROM unnest($1::bigint[]) WITH ORDINALITY AS u(id, position)
+  LEFT JOIN users_permissions ON users_permissions.user_id = u.id
+  LEFT JOIN permissions ON permissions.id = users_permissions.permission_id
+  GROUP BY u.id, u.position
+  ORDER BY u.position`
+
+	rows, err = tx.QueryContext(ctx, query, pq.Array(userIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var up UserPermissions
+
+		err := rows.Scan(&up.UserID, pq.Array(&up.Permissions))
+		if err != nil {
+			return nil, err
+		}
+
+		result.Users = append(result.Users, &up)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// The ResetForUser() method replaces all of the permissions for a specific user with
+// the given permission codes, in a single transaction, and returns the resulting
+// permissions. If the user doesn't exist then an ErrRecordNotFound error is returned
+// and nothing is changed.
+func (m PermissionModel) ResetForUser(userID int64, codes ...string) (Permissions, error) {
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock the user row so that the user can't be deleted while we're working on it,
+	// and check that it exists.
+	query := `
+  SELECT id
+  FROM users
+  WHERE id = $1
+  FOR SHARE`
+
+	var id int64
+
+	err = tx.QueryRowContext(ctx, query, userID).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	query = `
+  DELETE FROM users_permissions
+  WHERE user_id = $1`
+
+	_, err = tx.ExecContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Insert the new permissions and read back their codes in the same statement.
+	query = `
+  WITH inserted AS (
+    INSERT INTO users_permissions
+    SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+    RETURNING permission_id
+  )
+  SELECT permissions.code
+  FROM permissions
+  INNER JOIN inserted ON inserted.permission_id = permissions.id
+  ORDER BY permissions.code`
+
+	rows, err := tx.QueryContext(ctx, query, userID, pq.Array(codes))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := Permissions{}
+
+	for rows.Next() {
+		var permission string
+
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// Define a PermissionSyncResult struct to summarize the changes made by Sync(). Added
+// holds the codes which were inserted, and Existing the codes which were already in
+// the permissions table. Unlisted holds the codes in the table which weren't in the
+// list, and Pruned is true if they were deleted.
+type PermissionSyncResult struct {
+	Added    []string `json:"added"`
+	Existing []string `json:"existing"`
+	Unlisted []string `json:"unlisted"`
+	Pruned   bool     `json:"pruned"`
+}
+
+// The Sync() method makes the permissions table match the given permission codes, in
+// a single transaction. Codes which aren't in the table are inserted. Codes in the
+// table which aren't in the list are only deleted if prune is true, and deleting them
+// also removes them from any users who have them.
+func (m PermissionModel) Sync(codes []string, prune bool) (*PermissionSyncResult, error) {
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// There's no unique constraint on the permission codes, so lock the table to stop
+	// two syncs running at once and inserting the same code twice. Reads of the table
+	// aren't blocked by this lock mode.
+	_, err = tx.ExecContext(ctx, `LOCK TABLE permissions IN SHARE ROW EXCLUSIVE MODE`)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT code FROM permissions ORDER BY code`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var current []string
+
+	for rows.Next() {
+		var code string
+
+		err := rows.Scan(&code)
+		if err != nil {
+			return nil, err
+		}
+
+		current = append(current, code)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := &PermissionSyncResult{
+		Added:    []string{},
+		Existing: []string{},
+		Unlisted: []string{},
+		Pruned:   prune,
+	}
+
+	for _, code := range codes {
+		if slices.Contains(current, code) {
+			result.Existing = append(result.Existing, code)
+		} else {
+			result.Added = append(result.Added, code)
+		}
+	}
+
+	for _, code := range current {
+		if !slices.Contains(codes, code) {
+			result.Unlisted = append(result.Unlisted, code)
+		}
+	}
+
+	if len(result.Added) > 0 {
+		query := `
+  INSERT INTO permissions (code)
+  SELECT unnest($1::text[])`
+
+		_, err = tx.ExecContext(ctx, query, pq.Array(result.Added))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if prune && len(result.Unlisted) > 0 {
+		query := `
+  DELETE FROM permissions
+  WHERE code = ANY($1)`
+
+		_, err = tx.ExecContext(ctx, query, pq.Array(result.Unlisted))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,68 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Define a RateLimitModel struct type. This stores a token bucket for each client in
+// the rate_limits table, so that the rate limits are shared by every instance of the
+// application which uses the same database.
+type RateLimitModel struct {
+	parentContext
+	DB *sql.DB
+}
+
+// The Take() method tries to take a token from the bucket for the given key, working
+// in the same way as the Allow() method on a rate.Limiter. The bucket refills at rps
+// tokens per second up to a maximum of burst tokens. It returns whether the request is
+// allowed, along with the number of tokens left in the bucket afterwards.
+func (m RateLimitModel) Take(key string, rps float64, burst int) (bool, float64, error) {
+	// Refilling the bucket and taking a token happens in a single statement, so the
+	// row lock taken by the upsert stops concurrent requests for the same key from
+	// both taking the last token. If there's no existing bucket for the key, then we
+	// create a full one and take a token from it straight away.
+	query := `
+  INSERT INTO rate_limits (key, tokens, allowed, updated_at)
+  VALUES ($1, greatest($2::double precision - 1, 0), $2 >= 1, clock_timestamp())
+  ON CONFLICT (key) DO UPDATE
+  SET tokens = CASE
+        WHEN least($2, rate_limits.tokens + extract(epoch FROM clock_timestamp() - rate_limits.updated_at)::double precision * $3::double precision) >= 1
+        THEN least($2, rate_limits.tokens + extract(epoch FROM clock_timestamp() - rate_limits.updated_at)::double precision * $3::double precision) - 1
+        ELSE least($2, rate_limits.tokens + extract(epoch FROM clock_timestamp() - rate_limits.updated_at)::double precision * $3::double precision)
+      END,
+      allowed = least($2, rate_limits.tokens + extract(epoch FROM clock_timestamp() - rate_limits.updated_at)::double precision * $3::double precision) >= 1,
+      updated_at = clock_timestamp()
+  RETURNING allowed, tokens`
+
+	// Use a much shorter timeout than usual. This query runs on every request, so if
+	// the database is struggling we'd rather give up quickly.
+	ctx, cancel := context.WithTimeout(m.parent(), 500*time.Millisecond)
+	defer cancel()
+
+	var allowed bool
+	var tokens float64
+
+	err := m.DB.QueryRowContext(ctx, query, key, float64(burst), rps).Scan(&allowed, &tokens)
+	if err != nil {
+		return false, 0, err
+	}
+
+	return allowed, tokens, nil
+}
+
+// The DeleteStale() method deletes the buckets which haven't been used within the
+// given duration. By then they will have refilled, so deleting them doesn't change
+// how future requests are limited.
+func (m RateLimitModel) DeleteStale(olderThan time.Duration) error {
+	query := `
+  DELETE FROM rate_limits
+  WHERE updated_at < clock_timestamp() - $1 * interval '1 second'`
+
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, olderThan.Seconds())
+	return err
+}
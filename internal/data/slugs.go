@@ -0,0 +1,132 @@
+package data
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The maximum length of a slug (excluding any numeric suffix), in runes.
+const maxSlugLength = 100
+
+// The number of times that we retry an insert or update if another request takes the
+// slug that we picked between us checking for it and writing the record.
+const slugAttempts = 3
+
+// slugify() converts a movie title into the base for its slug by lower-casing it and
+// replacing each run of characters which aren't letters or digits with a single
+// hyphen. For example "Black Panther: Wakanda Forever" becomes
+// "black-panther-wakanda-forever". The slug is cut to maxSlugLength runes, without
+// leaving a trailing hyphen. If nothing is left, then "movie" is used instead.
+//
+// The backfill in the 000009_add_movies_slug migration does the same in SQL, so any
+// change here needs to be made there too.
+func slugify(title string) string {
+	var b strings.Builder
+	count := 0
+	hyphen := false
+
+	for _, r := range strings.ToLower(title) {
+		if count >= maxSlugLength {
+			break
+		}
+
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if hyphen && b.Len() > 0 {
+				b.WriteRune('-')
+				count++
+
+				// Stop if the hyphen used up the last rune, so that the slug is never
+				// longer than the limit. The hyphen is trimmed below.
+				if count >= maxSlugLength {
+					break
+				}
+			}
+			b.WriteRune(r)
+			count++
+			hyphen = false
+			continue
+		}
+
+		hyphen = true
+	}
+
+	slug := strings.Trim(b.String(), "-")
+	if slug == "" {
+		return "movie"
+	}
+
+	return slug
+}
+
+// slugHasBase() reports whether the slug is either exactly the base, or the base
+// followed by a numeric collision suffix like "-2".
+func slugHasBase(slug, base string) bool {
+	if slug == base {
+		return true
+	}
+
+	suffix, found := strings.CutPrefix(slug, base+"-")
+	if !found {
+		return false
+	}
+
+	n, err := strconv.Atoi(suffix)
+	return err == nil && n >= 2
+}
+
+// The uniqueSlug() method returns the base slug if no other movie is using it.
+// Otherwise, it appends the smallest numeric suffix (starting from 2) which isn't
+// already taken. The movie with the ID excludeID is ignored, so that a movie never
+// collides with itself when it is updated. The query is run using q, which can be
+// either the connection pool or a transaction.
+func (m MovieModel) uniqueSlug(ctx context.Context, q queryer, base string, excludeID int64) (string, error) {
+	// Slugs only ever contain letters, digits and hyphens, so it's safe to use the base
+	// in a LIKE pattern without escaping it.
+	query := `
+  SELECT slug
+  FROM movies
+  WHERE (slug = $1 OR slug LIKE $1 || '-%')
+  AND id <> $2`
+
+	rows, err := q.QueryContext(ctx, query, base, excludeID)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	taken := make(map[string]bool)
+
+	for rows.Next() {
+		var slug string
+
+		err := rows.Scan(&slug)
+		if err != nil {
+			return "", err
+		}
+
+		taken[slug] = true
+	}
+
+	if err = rows.Err(); err != nil {
+		return "", err
+	}
+
+	if !taken[base] {
+		return base, nil
+	}
+
+	for n := 2; ; n++ {
+		slug := base + "-" + strconv.Itoa(n)
+		if !taken[slug] {
+			return slug, nil
+		}
+	}
+}
+
+// isDuplicateSlugError() reports whether err was caused by the unique index on the
+// slug column.
+func isDuplicateSlugError(err error) bool {
+	return err != nil && err.Error() == `pq: duplicate key value violates unique constraint "movies_slug_idx"`
+}
@@ -0,0 +1,176 @@
+package data
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// A QueryTimer adds up the time spent in database calls made with a context, so that
+// the time can be reported for a request. It's safe for concurrent use, as a request
+// can run its queries in parallel.
+type QueryTimer struct {
+	nanoseconds atomic.Int64
+	queries     atomic.Int64
+}
+
+// The Duration() method returns the total time spent in database calls so far.
+func (t *QueryTimer) Duration() time.Duration {
+	return time.Duration(t.nanoseconds.Load())
+}
+
+// The Queries() method returns the number of queries and statements run so far.
+func (t *QueryTimer) Queries() int {
+	return int(t.queries.Load())
+}
+
+// The record() method adds the time since start. It does nothing if the timer is nil,
+// which is the case for contexts without a timer.
+func (t *QueryTimer) record(start time.Time, query bool) {
+	if t == nil {
+		return
+	}
+
+	t.nanoseconds.Add(int64(time.Since(start)))
+	if query {
+		t.queries.Add(1)
+	}
+}
+
+type queryTimerKey struct{}
+
+// The WithQueryTimer() function returns a copy of ctx with a new QueryTimer. The time
+// of the database calls made with the returned context (or contexts derived from it)
+// is added to the timer, as long as the connection pool was opened with a connector
+// from NewTimingConnector().
+func WithQueryTimer(ctx context.Context) (context.Context, *QueryTimer) {
+	t := &QueryTimer{}
+	return context.WithValue(ctx, queryTimerKey{}, t), t
+}
+
+func queryTimerFrom(ctx context.Context) *QueryTimer {
+	t, _ := ctx.Value(queryTimerKey{}).(*QueryTimer)
+	return t
+}
+
+// The NewTimingConnector() function wraps a driver.Connector so that the time spent
+// running queries, reading their rows, and beginning and ending transactions is
+// added to the QueryTimer in the context of each call. Prepared statements aren't
+// timed, as the models don't use them.
+func NewTimingConnector(c driver.Connector) driver.Connector {
+	return timingConnector{c}
+}
+
+type timingConnector struct {
+	driver.Connector
+}
+
+func (c timingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return timingConn{conn}, nil
+}
+
+// The timingConn type wraps a driver connection. Calls to the optional interfaces
+// are passed through if the wrapped connection implements them, and otherwise
+// behave as if the interface wasn't implemented.
+type timingConn struct {
+	driver.Conn
+}
+
+func (c timingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	timer := queryTimerFrom(ctx)
+	start := time.Now()
+	defer timer.record(start, true)
+
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return timingRows{rows, timer}, nil
+}
+
+func (c timingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	defer queryTimerFrom(ctx).record(time.Now(), true)
+
+	return execer.ExecContext(ctx, query, args)
+}
+
+func (c timingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	beginner, ok := c.Conn.(driver.ConnBeginTx)
+	if !ok {
+		return nil, errors.New("driver doesn't support BeginTx")
+	}
+
+	timer := queryTimerFrom(ctx)
+	start := time.Now()
+	defer timer.record(start, false)
+
+	tx, err := beginner.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return timingTx{tx, timer}, nil
+}
+
+func (c timingConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c timingConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c timingConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+// The timingRows type times reading each row, as the driver may still be receiving
+// the rows from the database after the query call has returned.
+type timingRows struct {
+	driver.Rows
+	timer *QueryTimer
+}
+
+func (r timingRows) Next(dest []driver.Value) error {
+	defer r.timer.record(time.Now(), false)
+	return r.Rows.Next(dest)
+}
+
+type timingTx struct {
+	driver.Tx
+	timer *QueryTimer
+}
+
+func (tx timingTx) Commit() error {
+	defer tx.timer.record(time.Now(), false)
+	return tx.Tx.Commit()
+}
+
+func (tx timingTx) Rollback() error {
+	defer tx.timer.record(time.Now(), false)
+	return tx.Tx.Rollback()
+}
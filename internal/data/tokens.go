@@ -4,10 +4,14 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/sha512"
 	"database/sql"
 	"encoding/base32"
+	"errors"
+	"fmt"
 	"time"
 
+	"github.com/lib/pq"
 	"greenlight.nicolasleigh.net/internal/validator"
 )
 
@@ -18,6 +22,52 @@ const (
 	ScopeAuthentication = "authentication" // Include a new authentication scope.
 )
 
+// Define constants for the supported token hashing algorithms.
+const (
+	TokenHashSHA256 = "sha256"
+	TokenHashSHA512 = "sha512"
+)
+
+// The tokenHashFuncs map holds the hashing function for each supported algorithm.
+var tokenHashFuncs = map[string]func([]byte) []byte{
+	TokenHashSHA256: func(b []byte) []byte {
+		hash := sha256.Sum256(b)
+		return hash[:]
+	},
+	TokenHashSHA512: func(b []byte) []byte {
+		hash := sha512.Sum512(b)
+		return hash[:]
+	},
+}
+
+// TokenHashAlgorithms returns the names of the supported token hashing algorithms.
+func TokenHashAlgorithms() []string {
+	return []string{TokenHashSHA256, TokenHashSHA512}
+}
+
+// hashToken returns the hash of the plaintext token using the given algorithm. The
+// hash is prefixed with the algorithm name and a colon (like "sha512:<digest>") so
+// that we always know which algorithm was used to create a stored hash.
+func hashToken(algorithm, tokenPlaintext string) []byte {
+	hash := tokenHashFuncs[algorithm]([]byte(tokenPlaintext))
+	return append([]byte(algorithm+":"), hash...)
+}
+
+// tokenHashCandidates returns all of the forms that the hash of a plaintext token
+// could have been stored in: one for each supported algorithm, plus the unprefixed
+// SHA-256 digest that was used before the algorithm became configurable. This means
+// that tokens stay valid when the configured algorithm is changed.
+func tokenHashCandidates(tokenPlaintext string) [][]byte {
+	legacyHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	candidates := [][]byte{legacyHash[:]}
+	for _, algorithm := range TokenHashAlgorithms() {
+		candidates = append(candidates, hashToken(algorithm, tokenPlaintext))
+	}
+
+	return candidates
+}
+
 // Define a Token struct to hold the data for an individual token. This includes the
 // plaintext and hashed versions of the token, associated user ID, expiry time and
 // scope.
@@ -31,7 +81,7 @@ type Token struct {
 	Scope     string    `json:"-"`
 }
 
-func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
+func generateToken(userID int64, ttl time.Duration, scope, algorithm string) (*Token, error) {
 	// Create a Token instance containing the user ID, expiry, and scope information.
 	// Notice that we add the provided ttl (time-to-live) duration parameter to the
 	// current time to get the expiry time.
@@ -63,12 +113,9 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 	// we use the WithPadding(base32.NoPadding) method in the line below to omit them.
 	token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
 
-	// Generate a SHA-256 hash of the plaintext token string. This will be the value
-	// that we store in the `hash` field of our database table. Note that the
-	// sha256.Sum256() function returns an *array* of length 32, so to make it easier to
-	// work with we convert it to a slice using the [:] operator before storing it.
-	hash := sha256.Sum256([]byte(token.Plaintext))
-	token.Hash = hash[:]
+	// Generate a hash of the plaintext token string using the configured algorithm.
+	// This will be the value that we store in the `hash` field of our database table.
+	token.Hash = hashToken(algorithm, token.Plaintext)
 
 	return token, nil
 }
@@ -79,15 +126,24 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
 }
 
-// Define the TokenModel type.
+// Define the TokenModel type. The HashAlgorithm field holds the algorithm used to
+// hash newly created tokens, and should be one of the values returned by
+// TokenHashAlgorithms(). If it's empty, SHA-256 is used.
 type TokenModel struct {
-	DB *sql.DB
+	parentContext
+	DB            *sql.DB
+	HashAlgorithm string
 }
 
 // The New() method is a shortcut which creates a new Token struct and then inserts
 // the data in the tokens table.
 func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
-	token, err := generateToken(userID, ttl, scope)
+	algorithm := m.HashAlgorithm
+	if algorithm == "" {
+		algorithm = TokenHashSHA256
+	}
+
+	token, err := generateToken(userID, ttl, scope, algorithm)
 	if err != nil {
 		return nil, err
 	}
@@ -96,6 +152,75 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
+// Define a TokenInfo struct to describe an active token for the admin token listing,
+// along with the name and email address of the user it belongs to. It never holds the
+// plaintext or the hash of the token. The email address is masked by the handler for
+// viewers without the users:read:pii permission.
+type TokenInfo struct {
+	UserID    int64     `json:"user_id"`
+	UserName  string    `json:"user_name"`
+	UserEmail string    `json:"user_email"`
+	Scope     string    `json:"scope"`
+	CreatedAt time.Time `json:"created_at"`
+	Expiry    time.Time `json:"expiry"`
+}
+
+// The GetAll() method returns a page of the tokens which haven't expired. If scope
+// isn't empty, then only tokens with that scope are returned, and likewise if userID
+// is greater than zero, then only that user's tokens are returned.
+func (m TokenModel) GetAll(scope string, userID int64, filters Filters) ([]*TokenInfo, Metadata, error) {
+	// The token hash is only used as a tie-breaker, so that the ordering is stable
+	// when several tokens have the same value in the sort column.
+	query := fmt.Sprintf(`
+  SELECT count(*) OVER(), tokens.user_id, users.name, users.email, tokens.scope, tokens.created_at, tokens.expiry
+  FROM tokens
+  INNER JOIN users ON users.id = tokens.user_id
+  WHERE tokens.expiry > NOW()
+  AND (tokens.scope = $1 OR $1 = '')
+  AND (tokens.user_id = $2 OR $2 = 0)
+  ORDER BY tokens.%s %s, tokens.hash ASC
+  LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, scope, userID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	tokens := []*TokenInfo{}
+
+	for rows.Next() {
+		var token TokenInfo
+
+		err := rows.Scan(
+			&totalRecords,
+			&token.UserID,
+			&token.UserName,
+			&token.UserEmail,
+			&token.Scope,
+			&token.CreatedAt,
+			&token.Expiry,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		tokens = append(tokens, &token)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return tokens, metadata, nil
+}
+
 // Insert() adds the data for a specific token to the tokens table.
 func (m TokenModel) Insert(token *Token) error {
 	query := `   
@@ -104,22 +229,147 @@ func (m TokenModel) Insert(token *Token) error {
 
 	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, args...)
 	return err
 }
 
+// The DeleteExpired() method deletes all of the tokens which have expired, and
+// returns the number that were deleted.
+func (m TokenModel) DeleteExpired() (int64, error) {
+	query := `
+  DELETE FROM tokens
+  WHERE expiry < NOW()`
+
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
 // DeleteAllForUser() deletes all tokens for a specific user and scope.
 func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	query := `    
   DELETE FROM tokens    
   WHERE scope = $1 AND user_id = $2`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
+
+// Define a RevokedCredentials struct to hold the number of each kind of credential
+// which was deleted by RotateForUser().
+type RevokedCredentials struct {
+	Tokens  int64 `json:"authentication_tokens"`
+	APIKeys int64 `json:"api_keys"`
+}
+
+// The RotateForUser() method deletes all of a user's authentication tokens and API
+// keys in a single transaction, so that every existing credential stops working at
+// once. If ttl is greater than zero, then a new authentication token with that ttl
+// is created in the same transaction and returned. Otherwise the returned token is
+// nil. Activation tokens aren't affected.
+func (m TokenModel) RotateForUser(userID int64, ttl time.Duration) (*Token, RevokedCredentials, error) {
+	var revoked RevokedCredentials
+
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, revoked, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM tokens WHERE scope = $1 AND user_id = $2`, ScopeAuthentication, userID)
+	if err != nil {
+		return nil, revoked, err
+	}
+
+	revoked.Tokens, err = result.RowsAffected()
+	if err != nil {
+		return nil, revoked, err
+	}
+
+	result, err = tx.ExecContext(ctx, `DELETE FROM api_keys WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, revoked, err
+	}
+
+	revoked.APIKeys, err = result.RowsAffected()
+	if err != nil {
+		return nil, revoked, err
+	}
+
+	var token *Token
+
+	if ttl > 0 {
+		algorithm := m.HashAlgorithm
+		if algorithm == "" {
+			algorithm = TokenHashSHA256
+		}
+
+		token, err = generateToken(userID, ttl, ScopeAuthentication, algorithm)
+		if err != nil {
+			return nil, revoked, err
+		}
+
+		query := `
+  INSERT INTO tokens (hash, user_id, expiry, scope)
+  VALUES ($1, $2, $3, $4)`
+
+		_, err = tx.ExecContext(ctx, query, token.Hash, token.UserID, token.Expiry, token.Scope)
+		if err != nil {
+			return nil, revoked, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, revoked, err
+	}
+
+	return token, revoked, nil
+}
+
+// The GetForPlaintext() method retrieves the details of an unexpired token with the
+// given scope and plaintext value. The Plaintext and Hash fields of the returned
+// token are left empty. If there's no matching token, or it has expired, we return
+// an ErrRecordNotFound error.
+func (m TokenModel) GetForPlaintext(scope, tokenPlaintext string) (*Token, error) {
+	query := `
+  SELECT user_id, expiry, scope
+  FROM tokens
+  WHERE hash = ANY($1)
+  AND scope = $2
+  AND expiry > $3`
+
+	args := []any{pq.Array(tokenHashCandidates(tokenPlaintext)), scope, time.Now()}
+
+	var token Token
+
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&token.UserID, &token.Expiry, &token.Scope)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &token, nil
+}
@@ -0,0 +1,137 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"strings"
+	"time"
+
+	"greenlight.nicolasleigh.net/internal/validator"
+)
+
+// LanguageRX is a (loose) regular expression for checking language tags, like "en",
+// "fr-CA" and "zh-Hant-TW". Tags are stored in lower case, so "fr-CA" is stored as
+// "fr-ca".
+var LanguageRX = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})*$`)
+
+// Define a MovieTranslation struct to hold the localized fields for a movie in a
+// single language.
+type MovieTranslation struct {
+	MovieID  int64  `json:"movie_id"`
+	Lang     string `json:"lang"`
+	Title    string `json:"title"`
+	Overview string `json:"overview,omitempty"`
+}
+
+func ValidateMovieTranslation(v *validator.Validator, translation *MovieTranslation) {
+	v.Check(validator.Matches(translation.Lang, LanguageRX), "lang", "must be a valid language tag")
+
+	v.Check(translation.Title != "", "title", "must be provided")
+	v.Check(len(translation.Title) <= 500, "title", "must not be more than 500 bytes long")
+
+	v.Check(len(translation.Overview) <= 5000, "overview", "must not be more than 5000 bytes long")
+}
+
+// Define the MovieTranslationModel type.
+type MovieTranslationModel struct {
+	parentContext
+	DB *sql.DB
+}
+
+// The Upsert() method adds the translation for a movie, or replaces it if one already
+// exists for the same language. If the movie doesn't exist, then an ErrRecordNotFound
+// error is returned.
+func (m MovieTranslationModel) Upsert(translation *MovieTranslation) error {
+	query := `
+  INSERT INTO movie_translations (movie_id, lang, title, overview)
+  VALUES ($1, $2, $3, $4)
+  ON CONFLICT (movie_id, lang) DO UPDATE
+  SET title = EXCLUDED.title, overview = EXCLUDED.overview`
+
+	args := []any{translation.MovieID, translation.Lang, translation.Title, translation.Overview}
+
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: insert or update on table "movie_translations" violates foreign key constraint "movie_translations_movie_id_fkey"`:
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The GetForLanguages() method returns the translation of a movie for the first of
+// the given languages which has one, in order of preference. A language which isn't
+// translated also matches a translation for a more specific tag, so "fr" matches
+// "fr-ca" if there's no "fr" translation, and "fr-ch" falls back to "fr". If there's
+// no suitable translation, then an ErrRecordNotFound error is returned.
+func (m MovieTranslationModel) GetForLanguages(movieID int64, langs []string) (*MovieTranslation, error) {
+	if len(langs) == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+  SELECT movie_id, lang, title, overview
+  FROM movie_translations
+  WHERE movie_id = $1
+  ORDER BY lang`
+
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, movieID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	translations := make(map[string]*MovieTranslation)
+	var tags []string
+
+	for rows.Next() {
+		var translation MovieTranslation
+
+		err := rows.Scan(&translation.MovieID, &translation.Lang, &translation.Title, &translation.Overview)
+		if err != nil {
+			return nil, err
+		}
+
+		translations[translation.Lang] = &translation
+		tags = append(tags, translation.Lang)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, lang := range langs {
+		lang = strings.ToLower(lang)
+
+		// Look for an exact match first.
+		if translation, ok := translations[lang]; ok {
+			return translation, nil
+		}
+
+		// Then for a more specific tag, like "fr-ca" for "fr".
+		for _, tag := range tags {
+			if strings.HasPrefix(tag, lang+"-") {
+				return translations[tag], nil
+			}
+		}
+
+		// And finally for a less specific tag, like "fr" for "fr-ch".
+		if base, _, found := strings.Cut(lang, "-"); found {
+			if translation, ok := translations[base]; ok {
+				return translation, nil
+			}
+		}
+	}
+
+	return nil, ErrRecordNotFound
+}
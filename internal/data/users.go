@@ -2,11 +2,13 @@ package data
 
 import (
 	"context"
-	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 	"greenlight.nicolasleigh.net/internal/validator"
 )
@@ -18,6 +20,7 @@ var (
 
 // Create a UserModel struct which wraps the connection pool.
 type UserModel struct {
+	parentContext
 	DB *sql.DB
 }
 
@@ -44,6 +47,20 @@ func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
 
+// The MaskEmail() function masks an email address for viewers who aren't allowed to
+// see it, keeping only the first character of the local part and the domain, so that
+// "jane@example.com" becomes "j***@example.com".
+func MaskEmail(email string) string {
+	local, domain, found := strings.Cut(email, "@")
+	if !found || local == "" {
+		return "***"
+	}
+
+	first, _ := utf8.DecodeRuneInString(local)
+
+	return string(first) + "***@" + domain
+}
+
 // Create a custom password type which is a struct containing the plaintext and hashed
 // versions of the password for a user. The plaintext field is a *pointer*
 // to a string, so that we're able to distinguish between a plaintext password not
@@ -127,7 +144,7 @@ func (m UserModel) Insert(user *User) error {
   RETURNING id, created_at, version`
 
 	args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
 	defer cancel()
 
 	// If the table already contains a record with this email address, then when we try
@@ -147,6 +164,44 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
+// Retrieve the User details from the database based on the user's ID, returning an
+// ErrRecordNotFound error if there is no matching user.
+func (m UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+  SELECT id, created_at, name, email, password_hash, activated, version
+  FROM users
+  WHERE id = $1`
+
+	var user User
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
 // Retrieve the User details from the database based on the user's email address.
 // Because we have a UNIQUE constraint on the email column, this SQL query will only
 // return one record (or none at all, in which case we return a ErrRecordNotFound error).
@@ -157,7 +212,7 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
   WHERE email = $1`
 
 	var user User
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, email).Scan(
@@ -203,7 +258,7 @@ func (m UserModel) Update(user *User) error {
 		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
@@ -221,10 +276,130 @@ func (m UserModel) Update(user *User) error {
 	return nil
 }
 
+// The ActivateMany() method activates users in a single transaction and returns the
+// users which it activated. Users are selected by ID or, if userIDs is empty, by
+// having registered before the given time. Users who are already activated are left
+// unchanged. If any of the user IDs don't match an existing user, then nothing is
+// changed and an *UnknownUsersError is returned. Any activation tokens for the
+// activated users are deleted, as they can't be used any more.
+func (m UserModel) ActivateMany(userIDs []int64, registeredBefore *time.Time) ([]*User, error) {
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var query string
+	var args []any
+
+	if len(userIDs) > 0 {
+		// Lock the rows for the users and check that every one of them exists.
+		query = `
+  SELECT id
+  FROM users
+  WHERE id = ANY($1)
+  FOR UPDATE`
+
+		rows, err := tx.QueryContext(ctx, query, pq.Array(userIDs))
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		found := make(map[int64]bool)
+
+		for rows.Next() {
+			var id int64
+
+			err := rows.Scan(&id)
+			if err != nil {
+				return nil, err
+			}
+
+			found[id] = true
+		}
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+
+		var missing []int64
+
+		for _, id := range userIDs {
+			if !found[id] {
+				missing = append(missing, id)
+			}
+		}
+
+		if len(missing) > 0 {
+			return nil, &UnknownUsersError{IDs: missing}
+		}
+
+		query = `
+  UPDATE users
+  SET activated = true, version = version + 1
+  WHERE id = ANY($1) AND NOT activated
+  RETURNING id, created_at, name, email, activated, version`
+
+		args = []any{pq.Array(userIDs)}
+	} else {
+		query = `
+  UPDATE users
+  SET activated = true, version = version + 1
+  WHERE created_at < $1 AND NOT activated
+  RETURNING id, created_at, name, email, activated, version`
+
+		args = []any{registeredBefore}
+	}
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	activatedIDs := []int64{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(&user.ID, &user.CreatedAt, &user.Name, &user.Email, &user.Activated, &user.Version)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, &user)
+		activatedIDs = append(activatedIDs, user.ID)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = `
+  DELETE FROM tokens
+  WHERE scope = $1 AND user_id = ANY($2)`
+
+	_, err = tx.ExecContext(ctx, query, ScopeActivation, pq.Array(activatedIDs))
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
 func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
-	// Calculate the SHA-256 hash of the plaintext token provided by the client.
-	// Remember that this returns a byte *array* with length 32, not a slice.
-	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	// Calculate every possible stored hash of the plaintext token provided by the
+	// client, one for each supported hashing algorithm (plus the legacy unprefixed
+	// SHA-256 form).
+	tokenHashes := tokenHashCandidates(tokenPlaintext)
 
 	// Set up the SQL query.
 	query := `   
@@ -232,19 +407,18 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
   FROM users    
   INNER JOIN tokens    
   ON users.id = tokens.user_id    
-  WHERE tokens.hash = $1     
+  WHERE tokens.hash = ANY($1)     
   AND tokens.scope = $2   
   AND tokens.expiry > $3`
 
-	// Create a slice containing the query arguments. Notice how we use the [:] operator
-	// to get a slice containing the token hash, rather than passing in the array (which
-	// is not supported by the pq driver), and that we pass the current time as the
-	// value to check against the token expiry.
-	args := []any{tokenHash[:], tokenScope, time.Now()}
+	// Create a slice containing the query arguments. Notice how we use the pq.Array()
+	// adapter for the candidate hashes, and that we pass the current time as the value
+	// to check against the token expiry.
+	args := []any{pq.Array(tokenHashes), tokenScope, time.Now()}
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
 	defer cancel()
 
 	// Execute the query, scanning the return values into a User struct. If no matching
@@ -271,3 +445,45 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	// Return the matching user.
 	return &user, nil
 }
+
+// Define a UserStats struct to hold aggregate counts of the users.
+type UserStats struct {
+	Total         int       `json:"total"`
+	Activated     int       `json:"activated"`
+	NotActivated  int       `json:"not_activated"`
+	NewLast7Days  int       `json:"new_last_7_days"`
+	NewLast30Days int       `json:"new_last_30_days"`
+	GeneratedAt   time.Time `json:"generated_at"`
+}
+
+// The Stats() method returns the aggregate counts for all users. All of the counts
+// are calculated in a single pass over the users table using FILTER clauses.
+func (m UserModel) Stats() (*UserStats, error) {
+	query := `
+  SELECT count(*),
+    count(*) FILTER (WHERE activated),
+    count(*) FILTER (WHERE NOT activated),
+    count(*) FILTER (WHERE created_at >= NOW() - INTERVAL '7 days'),
+    count(*) FILTER (WHERE created_at >= NOW() - INTERVAL '30 days'),
+    NOW()
+  FROM users`
+
+	var stats UserStats
+
+	ctx, cancel := context.WithTimeout(m.parent(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(
+		&stats.Total,
+		&stats.Activated,
+		&stats.NotActivated,
+		&stats.NewLast7Days,
+		&stats.NewLast30Days,
+		&stats.GeneratedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
@@ -2,8 +2,13 @@ package mailer
 
 import (
 	"bytes"
+	"context"
 	"embed"
+	"errors"
+	"fmt"
 	"html/template"
+	"io/fs"
+	"strings"
 	"time"
 
 	"github.com/go-mail/mail/v2"
@@ -20,33 +25,81 @@ var templateFS embed.FS
 // Define a Mailer struct which contains a mail.Dialer instance (used to connect to a
 // SMTP server) and the sender information for your emails (the name and address you
 // want the email to be from, such as "Alice Smith <alice@example.com>").
+//
+// The retries field holds the number of times that sending an email is retried after
+// the first attempt fails.
 type Mailer struct {
-	dialer *mail.Dialer
-	sender string
+	dialer  *mail.Dialer
+	sender  string
+	retries int
 }
 
-func New(host string, port int, username, password, sender string) Mailer {
-	// Initialize a new mail.Dialer instance with the given SMTP server settings. We
-	// also configure this to use a 5-second timeout whenever we send an email.
+// The delay before the first retry when sending an email fails. The delay doubles for
+// each subsequent retry.
+const retryDelay = 500 * time.Millisecond
+
+// func New(host string, port int, username, password, sender string) Mailer {
+// 	// Initialize a new mail.Dialer instance with the given SMTP server settings. We
+// 	// also configure this to use a 5-second timeout whenever we send an email.
+// 	dialer := mail.NewDialer(host, port, username, password)
+// 	dialer.Timeout = 5 * time.Second
+//
+// 	// Return a Mailer instance containing the dialer and sender information.
+// 	return Mailer{
+// 		dialer: dialer,
+// 		sender: sender,
+// 	}
+// }
+
+// Accept the timeout for connecting to and sending to the SMTP server, and the number
+// of retries, as parameters rather than hard-coding them.
+func New(host string, port int, username, password, sender string, timeout time.Duration, retries int) Mailer {
 	dialer := mail.NewDialer(host, port, username, password)
-	dialer.Timeout = 5 * time.Second
+	dialer.Timeout = timeout
 
-	// Return a Mailer instance containing the dialer and sender information.
 	return Mailer{
-		dialer: dialer,
-		sender: sender,
+		dialer:  dialer,
+		sender:  sender,
+		retries: retries,
 	}
 }
 
-// Define a Send() method on the Mailer type. This takes the recipient email address
-// as the first parameter, the name of the file containing the templates, and any
-// dynamic data for the templates as an any parameter.
-func (m Mailer) Send(recipient, templateFile string, data any) error {
+// Define an error that Render() returns if the requested template file doesn't exist.
+var ErrTemplateNotFound = errors.New("template not found")
+
+// Define an Email struct to hold the rendered subject, plain-text body and HTML body
+// of an email.
+type Email struct {
+	Subject   string
+	PlainBody string
+	HTMLBody  string
+}
+
+// The Render() method executes the "subject", "plainBody" and "htmlBody" templates in
+// the given template file, passing in the dynamic data. It doesn't send anything, so
+// it's also safe to use for previewing templates.
+func (m Mailer) Render(templateFile string, data any) (*Email, error) {
+	// Check that the template file exists in the embedded file system, so we can tell
+	// the difference between an unknown template and one which fails to parse. We also
+	// reject any names containing a path separator, so that only the files directly in
+	// the templates directory can be used.
+	if strings.Contains(templateFile, "/") {
+		return nil, ErrTemplateNotFound
+	}
+
+	_, err := fs.Stat(templateFS, "templates/"+templateFile)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) {
+			return nil, ErrTemplateNotFound
+		}
+		return nil, err
+	}
+
 	// Use the ParseFS() method to parse the required template file from the embedded
 	// file system.
 	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Execute the named template "subject", passing in the dynamic data and storing the
@@ -54,7 +107,7 @@ func (m Mailer) Send(recipient, templateFile string, data any) error {
 	subject := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(subject, "subject", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Follow the same pattern to execute the "plainBody" template and store the result
@@ -62,12 +115,32 @@ func (m Mailer) Send(recipient, templateFile string, data any) error {
 	plainBody := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(plainBody, "plainBody", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// And likewise with the "htmlBody" template.
 	htmlBody := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Email{
+		Subject:   subject.String(),
+		PlainBody: plainBody.String(),
+		HTMLBody:  htmlBody.String(),
+	}, nil
+}
+
+// Define a Send() method on the Mailer type. This takes the recipient email address
+// as the first parameter, the name of the file containing the templates, and any
+// dynamic data for the templates as an any parameter.
+//
+// If sending fails, then it's retried with an exponential backoff. The ctx parameter
+// is used to stop waiting between retries, so that retries don't hold up a graceful
+// shutdown of the application.
+func (m Mailer) Send(ctx context.Context, recipient, templateFile string, data any) error {
+	email, err := m.Render(templateFile, data)
 	if err != nil {
 		return err
 	}
@@ -80,18 +153,36 @@ func (m Mailer) Send(recipient, templateFile string, data any) error {
 	msg := mail.NewMessage()
 	msg.SetHeader("To", recipient)
 	msg.SetHeader("From", m.sender)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
+	msg.SetHeader("Subject", email.Subject)
+	msg.SetBody("text/plain", email.PlainBody)
+	msg.AddAlternative("text/html", email.HTMLBody)
 
 	// Call the DialAndSend() method on the dialer, passing in the message to send. This
 	// opens a connection to the SMTP server, sends the message, then closes the
 	// connection. If there is a timeout, it will return a "dial tcp: i/o timeout"
 	// error.
-	err = m.dialer.DialAndSend(msg)
-	if err != nil {
-		return err
-	}
+	// err = m.dialer.DialAndSend(msg)
+	// if err != nil {
+	// 	return err
+	// }
 
-	return nil
+	// Retry sending the message if it fails, doubling the delay each time. Errors
+	// from rendering the templates above aren't retried, as they would just fail
+	// again.
+	for attempt := 0; ; attempt++ {
+		err = m.dialer.DialAndSend(msg)
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= m.retries {
+			return fmt.Errorf("sending email failed after %d attempts: %w", attempt+1, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("sending email failed after %d attempts, not retrying: %w", attempt+1, err)
+		case <-time.After(retryDelay << attempt):
+		}
+	}
 }
@@ -0,0 +1,175 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Define a job struct to hold a periodic task along with the status of its most recent
+// run.
+type job struct {
+	name     string
+	interval time.Duration
+	fn       func() error
+	next     time.Time
+	status   Status
+}
+
+// Define a Status struct to describe a job and the outcome of its most recent run, for
+// the admin endpoint. LastRun is nil if the job hasn't run yet, and LastError is empty
+// if the most recent run succeeded.
+type Status struct {
+	Name         string     `json:"name"`
+	Interval     string     `json:"interval"`
+	Runs         int64      `json:"runs"`
+	LastRun      *time.Time `json:"last_run"`
+	LastDuration string     `json:"last_duration,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+}
+
+// Define a Scheduler type which runs named jobs periodically. All of the jobs are run
+// one at a time by a single loop, started with Run().
+type Scheduler struct {
+	logger *slog.Logger
+	mu     sync.Mutex
+	jobs   []*job
+}
+
+// The New() function returns a new Scheduler which logs to the given logger.
+func New(logger *slog.Logger) *Scheduler {
+	return &Scheduler{logger: logger}
+}
+
+// The Add() method registers a job which is run every interval, starting one interval
+// after Run() is called. It should be called before Run(). Names are used in the logs
+// and the job status, so they should be unique.
+func (s *Scheduler) Add(name string, interval time.Duration, fn func() error) {
+	if interval <= 0 {
+		panic(fmt.Sprintf("scheduler: job %q must have a positive interval", name))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jobs = append(s.jobs, &job{
+		name:     name,
+		interval: interval,
+		fn:       fn,
+		status:   Status{Name: name, Interval: interval.String()},
+	})
+}
+
+// The Run() method runs the jobs until the context is cancelled. It blocks, so it
+// should be called in a goroutine which is tracked by the shutdown WaitGroup. A job
+// which is running when the context is cancelled is allowed to finish.
+func (s *Scheduler) Run(ctx context.Context) {
+	s.mu.Lock()
+	now := time.Now()
+	for _, j := range s.jobs {
+		j.next = now.Add(j.interval)
+	}
+	s.mu.Unlock()
+
+	for {
+		// Wait until the next job is due.
+		timer := time.NewTimer(time.Until(s.nextRun()))
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		for _, j := range s.due(time.Now()) {
+			s.run(j)
+		}
+	}
+}
+
+// The nextRun() method returns the time at which the next job is due. If there aren't
+// any jobs, then it returns a time far enough in the future that the loop just waits
+// for the context to be cancelled.
+func (s *Scheduler) nextRun() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := time.Now().Add(24 * time.Hour)
+	for _, j := range s.jobs {
+		if j.next.Before(next) {
+			next = j.next
+		}
+	}
+
+	return next
+}
+
+// The due() method returns the jobs which are due to run at the given time, in the
+// order that they were added.
+func (s *Scheduler) due(now time.Time) []*job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []*job
+	for _, j := range s.jobs {
+		if !j.next.After(now) {
+			due = append(due, j)
+		}
+	}
+
+	return due
+}
+
+// The run() method runs a single job, recovering from any panic, and records and logs
+// the outcome. The next run is scheduled one interval after this run finishes, so
+// a slow job never runs back-to-back with itself.
+func (s *Scheduler) run(j *job) {
+	start := time.Now()
+
+	err := func() (err error) {
+		defer func() {
+			if pv := recover(); pv != nil {
+				err = fmt.Errorf("panic: %v", pv)
+			}
+		}()
+
+		return j.fn()
+	}()
+
+	duration := time.Since(start)
+
+	s.mu.Lock()
+	j.next = time.Now().Add(j.interval)
+	j.status.Runs++
+	j.status.LastRun = &start
+	j.status.LastDuration = duration.String()
+	j.status.LastError = ""
+	if err != nil {
+		j.status.LastError = err.Error()
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		s.logger.Error("scheduled job failed", "job", j.name, "duration", duration.String(), "error", err.Error())
+		return
+	}
+
+	s.logger.Info("scheduled job completed", "job", j.name, "duration", duration.String())
+}
+
+// The Status() method returns the status of every job, in the order that they were
+// added.
+func (s *Scheduler) Status() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]Status, len(s.jobs))
+	for i, j := range s.jobs {
+		statuses[i] = j.status
+	}
+
+	return statuses
+}
@@ -0,0 +1 @@
+DELETE FROM permissions WHERE code IN ('admin:read', 'admin:write');
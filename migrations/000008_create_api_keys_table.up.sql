@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+  id bigserial PRIMARY KEY,
+  hash bytea UNIQUE NOT NULL,
+  user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+  name text NOT NULL,
+  permissions text[] NOT NULL,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
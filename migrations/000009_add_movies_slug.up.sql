@@ -0,0 +1,42 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS slug text;
+
+-- Create the unique index before the backfill, so that the collision checks below can
+-- use it. NULLs are distinct, so the movies without a slug yet don't conflict.
+CREATE UNIQUE INDEX IF NOT EXISTS movies_slug_idx ON movies (slug);
+
+-- Backfill the slugs in the same way as the slugify() and uniqueSlug() functions in
+-- internal/data/slugs.go. The base is the lower-cased title with each run of
+-- characters which aren't letters or digits replaced by a single hyphen, cut to 100
+-- characters without a trailing hyphen, or "movie" if nothing is left. Note that
+-- [:alnum:] follows the database's LC_CTYPE, which matches unicode.IsLetter() and
+-- unicode.IsDigit() for a UTF-8 locale.
+--
+-- The movies are given their slugs in ID order, and each one gets the smallest
+-- numeric suffix (starting from 2) which isn't already taken, so "Foo", "Foo" and
+-- "Foo 2" become foo, foo-2 and foo-2-2.
+DO $$
+DECLARE
+  movie record;
+  base text;
+  candidate text;
+  n integer;
+BEGIN
+  FOR movie IN SELECT id, title FROM movies WHERE slug IS NULL ORDER BY id LOOP
+    base := trim(trailing '-' FROM left(trim(both '-' FROM regexp_replace(lower(movie.title), '[^[:alnum:]]+', '-', 'g')), 100));
+    IF base = '' THEN
+      base := 'movie';
+    END IF;
+
+    candidate := base;
+    n := 1;
+
+    WHILE EXISTS (SELECT 1 FROM movies WHERE slug = candidate) LOOP
+      n := n + 1;
+      candidate := base || '-' || n;
+    END LOOP;
+
+    UPDATE movies SET slug = candidate WHERE id = movie.id;
+  END LOOP;
+END $$;
+
+ALTER TABLE movies ALTER COLUMN slug SET NOT NULL;
@@ -0,0 +1,8 @@
+CREATE UNLOGGED TABLE IF NOT EXISTS rate_limits (
+  key text PRIMARY KEY,
+  tokens double precision NOT NULL,
+  allowed boolean NOT NULL,
+  updated_at timestamp(6) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS rate_limits_updated_at_idx ON rate_limits (updated_at);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS movie_translations (
+  movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+  lang text NOT NULL,
+  title text NOT NULL,
+  overview text NOT NULL DEFAULT '',
+  PRIMARY KEY (movie_id, lang)
+);
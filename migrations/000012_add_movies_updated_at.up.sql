@@ -0,0 +1,6 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+
+-- Existing movies haven't been updated since they were created, as far as we know.
+UPDATE movies SET updated_at = created_at;
+
+CREATE INDEX IF NOT EXISTS movies_updated_at_idx ON movies (updated_at, id);
@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS movies_audit ON movies;
+DROP FUNCTION IF EXISTS record_movie_audit();
+DROP TABLE IF EXISTS movie_audits;
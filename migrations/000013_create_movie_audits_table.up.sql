@@ -0,0 +1,31 @@
+CREATE TABLE IF NOT EXISTS movie_audits (
+  movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+  version integer NOT NULL,
+  changed_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  title text NOT NULL,
+  year integer NOT NULL,
+  runtime integer NOT NULL,
+  genres text[] NOT NULL,
+  PRIMARY KEY (movie_id, version)
+);
+
+-- Record a snapshot of each movie whenever a new version is written, whichever code
+-- path writes it. Updates which don't change the version keep the original snapshot.
+CREATE OR REPLACE FUNCTION record_movie_audit() RETURNS trigger AS $$
+BEGIN
+  INSERT INTO movie_audits (movie_id, version, changed_at, title, year, runtime, genres)
+  VALUES (NEW.id, NEW.version, NEW.updated_at, NEW.title, NEW.year, NEW.runtime, NEW.genres)
+  ON CONFLICT (movie_id, version) DO NOTHING;
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS movies_audit ON movies;
+CREATE TRIGGER movies_audit AFTER INSERT OR UPDATE ON movies
+  FOR EACH ROW EXECUTE FUNCTION record_movie_audit();
+
+-- Earlier versions of the existing movies weren't recorded, so start their history
+-- from the current version.
+INSERT INTO movie_audits (movie_id, version, changed_at, title, year, runtime, genres)
+SELECT id, version, updated_at, title, year, runtime, genres FROM movies
+ON CONFLICT (movie_id, version) DO NOTHING;
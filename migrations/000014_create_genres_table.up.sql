@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS genres (
+  id bigserial PRIMARY KEY,
+  name text UNIQUE NOT NULL,
+  color text NOT NULL DEFAULT ''
+);
+
+-- Seed the table with the canonical genres.
+INSERT INTO genres (name) VALUES
+  ('action'), ('adventure'), ('animation'), ('biography'), ('comedy'), ('crime'),
+  ('documentary'), ('drama'), ('family'), ('fantasy'), ('history'), ('horror'),
+  ('music'), ('musical'), ('mystery'), ('romance'), ('sci-fi'), ('sport'),
+  ('thriller'), ('war'), ('western')
+ON CONFLICT (name) DO NOTHING;
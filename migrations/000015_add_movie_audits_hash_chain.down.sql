@@ -0,0 +1,18 @@
+CREATE OR REPLACE FUNCTION record_movie_audit() RETURNS trigger AS $$
+BEGIN
+  INSERT INTO movie_audits (movie_id, version, changed_at, title, year, runtime, genres)
+  VALUES (NEW.id, NEW.version, NEW.updated_at, NEW.title, NEW.year, NEW.runtime, NEW.genres)
+  ON CONFLICT (movie_id, version) DO NOTHING;
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP FUNCTION IF EXISTS movie_audit_hash(bytea, bigint, integer, timestamptz, text, integer, integer, text[]);
+
+-- Remove the audit rows of deleted movies before restoring the foreign key.
+DELETE FROM movie_audits WHERE NOT EXISTS (SELECT 1 FROM movies WHERE movies.id = movie_audits.movie_id);
+ALTER TABLE movie_audits ADD CONSTRAINT movie_audits_movie_id_fkey FOREIGN KEY (movie_id) REFERENCES movies ON DELETE CASCADE;
+
+ALTER TABLE movie_audits DROP COLUMN IF EXISTS hash;
+ALTER TABLE movie_audits DROP COLUMN IF EXISTS prev_hash;
+ALTER TABLE movie_audits DROP COLUMN IF EXISTS id;
@@ -0,0 +1,56 @@
+-- Give the audit rows a global order for the hash chain, along with the hash of the
+-- previous row and the hash of the row itself.
+ALTER TABLE movie_audits ADD COLUMN IF NOT EXISTS id bigserial UNIQUE;
+ALTER TABLE movie_audits ADD COLUMN IF NOT EXISTS prev_hash bytea;
+ALTER TABLE movie_audits ADD COLUMN IF NOT EXISTS hash bytea;
+
+-- Deleting a movie would otherwise delete its audit rows and break the chain, so keep
+-- the audit rows after the movie is gone.
+ALTER TABLE movie_audits DROP CONSTRAINT IF EXISTS movie_audits_movie_id_fkey;
+
+-- The hash of an audit row covers the previous row's hash and the row's contents. The
+-- genesis row has a NULL prev_hash, which is hashed as an empty value. The contents
+-- are encoded as a JSON array, so that the fields can't run into each other.
+CREATE OR REPLACE FUNCTION movie_audit_hash(prev_hash bytea, movie_id bigint, version integer, changed_at timestamptz, title text, year integer, runtime integer, genres text[]) RETURNS bytea AS $$
+  SELECT sha256(
+    coalesce(prev_hash, ''::bytea) ||
+    convert_to(json_build_array(movie_id, version, extract(epoch FROM changed_at)::bigint, title, year, runtime, genres)::text, 'UTF8')
+  );
+$$ LANGUAGE sql IMMUTABLE;
+
+-- Chain the existing rows in order.
+DO $$
+DECLARE
+  prev bytea;
+  audit record;
+BEGIN
+  FOR audit IN SELECT * FROM movie_audits ORDER BY id LOOP
+    UPDATE movie_audits
+    SET prev_hash = prev,
+        hash = movie_audit_hash(prev, audit.movie_id, audit.version, audit.changed_at, audit.title, audit.year, audit.runtime, audit.genres)
+    WHERE id = audit.id
+    RETURNING hash INTO prev;
+  END LOOP;
+END;
+$$;
+
+ALTER TABLE movie_audits ALTER COLUMN hash SET NOT NULL;
+
+-- Link each new audit row to the last one. The advisory lock is held until the end of
+-- the transaction, so that concurrent writes are added to the chain one at a time
+-- rather than both linking to the same previous row.
+CREATE OR REPLACE FUNCTION record_movie_audit() RETURNS trigger AS $$
+DECLARE
+  prev bytea;
+BEGIN
+  PERFORM pg_advisory_xact_lock(hashtext('movie_audits'));
+
+  SELECT hash INTO prev FROM movie_audits ORDER BY id DESC LIMIT 1;
+
+  INSERT INTO movie_audits (movie_id, version, changed_at, title, year, runtime, genres, prev_hash, hash)
+  VALUES (NEW.id, NEW.version, NEW.updated_at, NEW.title, NEW.year, NEW.runtime, NEW.genres, prev,
+    movie_audit_hash(prev, NEW.id, NEW.version, NEW.updated_at, NEW.title, NEW.year, NEW.runtime, NEW.genres))
+  ON CONFLICT (movie_id, version) DO NOTHING;
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,3 @@
+-- Existing tokens didn't record when they were created, so they're given the time of
+-- the migration.
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS created_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
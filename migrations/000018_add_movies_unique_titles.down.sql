@@ -0,0 +1,4 @@
+DROP TRIGGER IF EXISTS movies_unique_title ON movies;
+DROP FUNCTION IF EXISTS check_movie_unique_title();
+
+DROP INDEX IF EXISTS movies_title_lower_idx;
@@ -0,0 +1,53 @@
+-- Index the lower case titles, so that the unique title check below is quick.
+CREATE INDEX IF NOT EXISTS movies_title_lower_idx ON movies (lower(title));
+
+-- Unique titles are optional, so they can't be enforced with a unique index. Instead,
+-- this trigger rejects a new or changed title which matches another movie's title
+-- (ignoring case), but only when the greenlight.unique_titles setting is on. The API
+-- turns the setting on for its own connections with the -unique-titles flag. The
+-- error uses the same code as a unique index would, so it can be told apart from
+-- other errors. The advisory lock is held until the end of the transaction, so that
+-- two movies with the same title can't be added at the same time.
+CREATE OR REPLACE FUNCTION check_movie_unique_title() RETURNS trigger AS $$
+BEGIN
+  IF current_setting('greenlight.unique_titles', true) IS DISTINCT FROM 'on' THEN
+    RETURN NEW;
+  END IF;
+
+  IF TG_OP = 'UPDATE' AND lower(NEW.title) = lower(OLD.title) THEN
+    RETURN NEW;
+  END IF;
+
+  PERFORM pg_advisory_xact_lock(hashtext('movies_title:' || lower(NEW.title)));
+
+  IF EXISTS (SELECT 1 FROM movies WHERE lower(title) = lower(NEW.title) AND id <> NEW.id) THEN
+    RAISE EXCEPTION 'duplicate movie title %', NEW.title
+      USING ERRCODE = 'unique_violation', CONSTRAINT = 'movies_title_unique';
+  END IF;
+
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS movies_unique_title ON movies;
+CREATE TRIGGER movies_unique_title
+BEFORE INSERT OR UPDATE OF title ON movies
+FOR EACH ROW EXECUTE FUNCTION check_movie_unique_title();
+
+-- Existing duplicate titles are left alone, as there's no right answer for which one
+-- should be renamed, but they're reported so that they can be tidied up by hand.
+DO $$
+DECLARE
+  duplicate record;
+BEGIN
+  FOR duplicate IN
+    SELECT lower(title) AS title, count(*) AS count
+    FROM movies
+    GROUP BY lower(title)
+    HAVING count(*) > 1
+    ORDER BY lower(title)
+  LOOP
+    RAISE NOTICE 'duplicate movie title "%" is used by % movies', duplicate.title, duplicate.count;
+  END LOOP;
+END;
+$$;
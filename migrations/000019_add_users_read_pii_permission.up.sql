@@ -0,0 +1,3 @@
+INSERT INTO permissions (code)
+SELECT 'users:read:pii'
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE code = 'users:read:pii');
@@ -0,0 +1,4 @@
+-- Store updated_at with microsecond precision, so that movies updated within the
+-- same second can still be told apart by incremental sync clients and by the
+-- client_updated_at conflict check.
+ALTER TABLE movies ALTER COLUMN updated_at TYPE timestamp(6) with time zone;